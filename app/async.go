@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OverflowPolicy decides what Fire does in async mode when the queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Fire wait for room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discards the entry, counting it in Stats.DroppedEntries.
+	OverflowDrop
+)
+
+// enqueue hands entry to the writer goroutine according to OverflowPolicy.
+func (hook *ClickHouseHook) enqueue(entry *logrus.Entry) {
+	if hook.config.OverflowPolicy == OverflowDrop {
+		select {
+		case hook.queue <- *entry:
+		default:
+			hook.mu.Lock()
+			hook.dropped++
+			hook.metrics.dropped.Inc()
+			hook.mu.Unlock()
+			hook.fallback([]logrus.Entry{*entry})
+		}
+		return
+	}
+
+	select {
+	case hook.queue <- *entry:
+	case <-hook.ctx.Done():
+		// The writer is gone; buffer it for Close to flush.
+		hook.buffer(entry)
+	}
+}
+
+// runWriter buffers queued entries, flushing full batches and, when ticker
+// is not nil, the whole buffer on every tick, until Stop is called. Like
+// Fire, it doesn't flush while backingOff, except for FlushOnLevel entries.
+func (hook *ClickHouseHook) runWriter(ticker Ticker) {
+	defer hook.wg.Done()
+
+	var tick <-chan time.Time
+	if ticker != nil {
+		defer func() { ticker.Stop() }()
+		tick = ticker.C()
+	}
+
+	for {
+		select {
+		case entry := <-hook.queue:
+			if hook.buffer(&entry) && (!hook.backingOff() || hook.flushOnLevel(entry.Level)) {
+				hook.backgroundFlush()
+			}
+		case <-tick:
+			if !hook.backingOff() {
+				hook.backgroundFlush()
+			}
+		case interval := <-hook.intervals:
+			ticker.Stop()
+			ticker = hook.config.Clock.NewTicker(interval)
+			tick = ticker.C()
+		case <-hook.ctx.Done():
+			return
+		}
+	}
+}
+
+// drainQueue moves entries still queued into the buffer without flushing.
+func (hook *ClickHouseHook) drainQueue() {
+	for {
+		select {
+		case entry := <-hook.queue:
+			hook.buffer(&entry)
+		default:
+			return
+		}
+	}
+}
+
+// stopped reports whether Stop has been called.
+func (hook *ClickHouseHook) stopped() bool {
+	return hook.ctx.Err() != nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error of flushes skipped while the circuit breaker
+// is open.
+var ErrCircuitOpen = errors.New("clickhouse hook: circuit breaker open, flush skipped")
+
+// defaultBreakerCooldown is the BreakerCooldown default.
+const defaultBreakerCooldown = 30 * time.Second
+
+// BreakerState is the state of the hook's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every flush through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips flushes until the cooldown has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe flush through to test recovery.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is the circuit breaker of BreakerThreshold.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a flush may go ahead at now, moving an open breaker
+// whose cooldown has passed to half-open. changed reports that the state
+// changed.
+func (b *breaker) allow(now time.Time) (ok, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.state, changed = BreakerHalfOpen, true
+	}
+	switch {
+	case b.state == BreakerClosed:
+		return true, changed
+	case b.state == BreakerHalfOpen && !b.probing:
+		b.probing = true
+		return true, changed
+	}
+	return false, changed
+}
+
+// record counts the outcome of a flush allow let through at now. changed
+// reports that the state changed.
+func (b *breaker) record(failed bool, now time.Time) (changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.state
+	b.probing = false
+	if !failed {
+		b.state, b.failures = BreakerClosed, 0
+		return b.state != previous
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = BreakerOpen, now
+	}
+	return b.state != previous
+}
+
+// current returns the breaker's state.
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerAllow reports whether a flush may go ahead, always without a
+// breaker.
+func (hook *ClickHouseHook) breakerAllow() bool {
+	if hook.breaker == nil {
+		return true
+	}
+	ok, changed := hook.breaker.allow(hook.config.Clock.Now())
+	if changed {
+		hook.breakerChanged()
+	}
+	return ok
+}
+
+// breakerRecord counts the outcome of a flush breakerAllow let through.
+func (hook *ClickHouseHook) breakerRecord(failed bool) {
+	if hook.breaker == nil {
+		return
+	}
+	if hook.breaker.record(failed, hook.config.Clock.Now()) {
+		hook.breakerChanged()
+	}
+}
+
+// breakerChanged reports the breaker's new state to the diagnostic logger
+// and OnBreakerChange.
+func (hook *ClickHouseHook) breakerChanged() {
+	state := hook.breaker.current()
+	hook.log().WithField("state", state.String()).Warn("circuit breaker changed state")
+	if hook.config.OnBreakerChange != nil {
+		hook.config.OnBreakerChange(state)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	var states []BreakerState
+	onChange := func(config *Config) {
+		config.OnBreakerChange = func(state BreakerState) { states = append(states, state) }
+	}
+	hook, err := NewHookWithSink(sink, 100, WithClock(clock), WithRetries(0, time.Second), WithCircuitBreaker(3, 10*time.Second), onChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "m")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := hook.Flush(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("flush %d returned %v, want the sink's error", i, err)
+		}
+		want := BreakerClosed
+		if i == 3 {
+			want = BreakerOpen
+		}
+		if got := hook.Stats().Breaker; got != want {
+			t.Fatalf("breaker %s after %d failures, want %s", got, i, want)
+		}
+	}
+
+	// While open, flushes are skipped without reaching the sink.
+	clock.Advance(9 * time.Second)
+	if err := hook.Flush(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("flush during the cooldown returned %v, want ErrCircuitOpen", err)
+	}
+	if got := sink.Attempts(); got != 3 {
+		t.Fatalf("%d writes attempted during the cooldown, want 3", got)
+	}
+
+	// After the cooldown a failed probe opens the breaker again at once.
+	clock.Advance(time.Second)
+	if err := hook.Flush(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("probe returned %v, want the sink's error", err)
+	}
+	if got := hook.Stats().Breaker; got != BreakerOpen {
+		t.Fatalf("breaker %s after a failed probe, want open", got)
+	}
+
+	// A successful probe closes it.
+	clock.Advance(10 * time.Second)
+	sink.SetError(nil)
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("probe returned %v", err)
+	}
+	if got := hook.Stats().Breaker; got != BreakerClosed {
+		t.Fatalf("breaker %s after a successful probe, want closed", got)
+	}
+	if got := sink.Attempts(); got != 5 {
+		t.Errorf("%d writes attempted, want 5", got)
+	}
+	if got := messagesOf(sink.Entries()); !slices.Equal(got, []string{"m"}) {
+		t.Errorf("flushed %v, want the entry kept through the outage", got)
+	}
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if !slices.Equal(states, want) {
+		t.Errorf("OnBreakerChange called with %v, want %v", states, want)
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &breaker{threshold: 1, cooldown: time.Second}
+	b.record(true, now)
+	if ok, _ := b.allow(now.Add(time.Second - 1)); ok {
+		t.Fatal("open breaker allowed a flush before its cooldown")
+	}
+	if ok, changed := b.allow(now.Add(time.Second)); !ok || !changed {
+		t.Fatalf("allow after the cooldown = %v, %v, want a probe and a state change", ok, changed)
+	}
+	if ok, _ := b.allow(now.Add(time.Second)); ok {
+		t.Fatal("half-open breaker allowed a second flush during the probe")
+	}
+	if changed := b.record(false, now.Add(time.Second)); !changed || b.current() != BreakerClosed {
+		t.Fatalf("breaker %s after a successful probe, want closed", b.current())
+	}
+}
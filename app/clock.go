@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the hook's source of time for its flush timer, retry backoff and
+// the timestamps of entries it creates itself. The default is the system
+// clock; a FakeClock makes time-based flushing testable without sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker delivers ticks every period on C until stopped, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer delivers a single tick on C after its duration, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the Clock backed by package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+func (t systemTimer) Stop() { t.Timer.Stop() }
+
+// FakeClock is a Clock whose time only moves when Advance is called. Tickers
+// and timers fire from Advance; like their package time counterparts they
+// drop ticks that nobody has received yet.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock reading now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a Ticker firing every d of fake time.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	return c.add(d, true)
+}
+
+// NewTimer returns a Timer firing once after d of fake time.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, false)
+}
+
+// Advance moves the fake time forward by d, firing every ticker and timer
+// that falls due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	live := c.pending[:0]
+	for _, t := range c.pending {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if !t.repeat {
+				t.stopped = true
+				break
+			}
+			t.next = t.next.Add(t.period)
+		}
+		if !t.stopped {
+			live = append(live, t)
+		}
+	}
+	c.pending = live
+}
+
+func (c *FakeClock) add(d time.Duration, repeat bool) *fakeTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d), repeat: repeat}
+	c.pending = append(c.pending, t)
+	return t
+}
+
+// fakeTicker implements both Ticker and Timer for FakeClock. Its fields are
+// guarded by the clock's mutex.
+type fakeTicker struct {
+	clock   *FakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	repeat  bool
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	t.stopped = true
+	t.clock.mu.Unlock()
+}
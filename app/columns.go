@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// column describes one column of the insert, the ClickHouse type it is
+// expected to have and how to fill it from an entry. codec is only used when
+// creating the table. field names the entry field the value comes from, for
+// columns that are filled from one.
+type column struct {
+	name  string
+	typ   string
+	codec string
+	field string
+	value func(entry *logrus.Entry) interface{}
+}
+
+// logicalColumns lists the ColumnMap keys.
+var logicalColumns = map[string]bool{"time": true, "level": true, "message": true, "fields": true}
+
+// columnName returns the physical name of the logical column, or name when
+// ColumnMap doesn't rename it.
+func (config Config) columnName(logical, name string) string {
+	if mapped, ok := config.ColumnMap[logical]; ok {
+		return mapped
+	}
+	return name
+}
+
+// buildColumns returns the columns written for every entry, in insert order.
+// The order must not depend on map iteration: the INSERT's column list and
+// every row's arguments are both taken from the returned slice, and the
+// slice is built once per hook, so options configured as maps, such as
+// NumericFields, are added in sorted key order.
+func (hook *ClickHouseHook) buildColumns() []column {
+	if hook.config.RowMarshaler != nil {
+		return hook.marshalColumns()
+	}
+	if hook.config.CustomInsert != "" {
+		return nil
+	}
+	columns := []column{
+		{name: hook.config.columnName("time", "event_time"), typ: hook.timeType(), value: func(entry *logrus.Entry) interface{} {
+			return hook.eventTime(entry)
+		}},
+		// Inserting a string works with either driver: v2 encodes
+		// LowCardinality natively, and the server converts it to plain
+		// String for v1, whose protocol revision predates the type. Both
+		// map the label to its value for an Enum8.
+		{name: hook.config.columnName("level", "level"), typ: hook.levelType(), value: func(entry *logrus.Entry) interface{} {
+			return hook.levelName(entry.Level)
+		}},
+		{name: hook.config.columnName("message", "message"), typ: "String", codec: hook.config.MessageCodec, value: func(entry *logrus.Entry) interface{} {
+			return truncate(hook.renderMessage(entry), hook.config.MaxMessageBytes)
+		}},
+	}
+	if hook.config.IncludeFields {
+		switch hook.config.FieldEncoding {
+		case FieldsAsJSON:
+			columns = append(columns, column{name: hook.config.columnName("fields", "fields_json"), typ: "String", value: func(entry *logrus.Entry) interface{} {
+				return hook.fieldsJSON(entry)
+			}})
+		default:
+			columns = append(columns, column{name: hook.config.columnName("fields", "fields"), typ: "Map(String, String)", value: func(entry *logrus.Entry) interface{} {
+				return hook.fields(entry)
+			}})
+		}
+		if hook.config.MaxFieldsPerEntry > 0 {
+			columns = append(columns, column{name: "dropped_fields", typ: "UInt32", value: func(entry *logrus.Entry) interface{} {
+				return hook.droppedFields(entry)
+			}})
+		}
+	}
+	if hook.config.IncludeFormatted {
+		columns = append(columns, column{name: "formatted", typ: "String", value: func(entry *logrus.Entry) interface{} {
+			return formatted(entry)
+		}})
+	}
+	if hook.config.IncludeSeverityCode {
+		columns = append(columns, column{name: "severity", typ: "UInt8", value: func(entry *logrus.Entry) interface{} {
+			return hook.severity(entry.Level)
+		}})
+	}
+	if hook.config.IncludeCaller {
+		columns = append(columns, column{name: "caller", typ: "String", value: func(entry *logrus.Entry) interface{} {
+			return hook.caller(entry)
+		}})
+	}
+	if hook.config.IncludePID {
+		pid := uint32(os.Getpid())
+		columns = append(columns, column{name: "pid", typ: "UInt32", value: func(*logrus.Entry) interface{} {
+			return pid
+		}})
+	}
+	if version := hook.config.BuildVersion; version != "" {
+		columns = append(columns, column{name: "build_version", typ: "LowCardinality(String)", value: func(*logrus.Entry) interface{} {
+			return version
+		}})
+	}
+	if commit := hook.config.BuildCommit; commit != "" {
+		columns = append(columns, column{name: "build_commit", typ: "LowCardinality(String)", value: func(*logrus.Entry) interface{} {
+			return commit
+		}})
+	}
+	if hook.config.IncludeGoroutines {
+		columns = append(columns, column{name: "goroutines", typ: "UInt32", value: func(entry *logrus.Entry) interface{} {
+			return goroutines(entry)
+		}})
+	}
+	if hook.config.IncludeIngestLag {
+		columns = append(columns, column{name: "ingest_lag_ms", typ: "Int64", value: func(entry *logrus.Entry) interface{} {
+			return hook.config.Clock.Now().Sub(entry.Time).Milliseconds()
+		}})
+	}
+	if hook.config.Deduplicate {
+		columns = append(columns, column{name: "count", typ: "UInt64", value: func(entry *logrus.Entry) interface{} {
+			return dedupCount(entry)
+		}})
+	}
+	if name := hook.config.VersionColumn; name != "" {
+		columns = append(columns, column{name: name, typ: "UInt64", value: func(entry *logrus.Entry) interface{} {
+			return hook.version(entry)
+		}})
+	}
+	if hook.config.IncludeStackTrace {
+		columns = append(columns, column{name: "stack_trace", typ: "String", value: func(entry *logrus.Entry) interface{} {
+			return stackTrace(entry)
+		}})
+	}
+	if hook.config.IncludeErrorColumn {
+		columns = append(columns, column{name: "error", typ: "String", value: func(entry *logrus.Entry) interface{} {
+			err, ok := entry.Data[logrus.ErrorKey].(error)
+			if !ok {
+				return ""
+			}
+			return hook.errorText(err)
+		}})
+	}
+	if field := hook.config.TraceIDField; field != "" {
+		columns = append(columns, fieldColumn("trace_id", field))
+	}
+	if field := hook.config.SpanIDField; field != "" {
+		columns = append(columns, fieldColumn("span_id", field))
+	}
+	if field := hook.config.SourceField; field != "" {
+		columns = append(columns, fieldColumn("source", field))
+	}
+	if field := hook.config.RequestIDField; field != "" {
+		columns = append(columns, fieldColumn("request_id", field))
+	}
+	if field := hook.config.TTLField; field != "" {
+		columns = append(columns, column{name: "retention_days", typ: "UInt16", value: func(entry *logrus.Entry) interface{} {
+			return hook.retentionDays(entry)
+		}})
+	}
+	for _, field := range hook.config.ArrayColumns {
+		columns = append(columns, arrayColumn(field))
+	}
+	for _, field := range slices.Sorted(maps.Keys(hook.config.NumericFields)) {
+		columns = append(columns, numericColumn(field, hook.config.NumericFields[field]))
+	}
+	if hook.rowType != nil {
+		columns = append(columns, hook.rowType.columns()...)
+	}
+	return columns
+}
+
+// writtenColumns returns the columns a hook built from config writes,
+// leaving out those of a RowType that newHook rejects.
+func (config Config) writtenColumns() []column {
+	hook := &ClickHouseHook{config: config}
+	if config.RowType != nil {
+		hook.rowType, _ = newRowType(config.RowType)
+	}
+	return hook.buildColumns()
+}
+
+// arrayColumn is an Array(String) column holding the items of an entry
+// field.
+func arrayColumn(field string) column {
+	return column{name: field, typ: "Array(String)", field: field, value: func(entry *logrus.Entry) interface{} {
+		return stringItems(entry.Data[field])
+	}}
+}
+
+// numericZero holds the zero value of every type NumericFields supports, as
+// the Go type the drivers expect for it.
+var numericZero = map[string]interface{}{
+	"UInt8": uint8(0), "UInt16": uint16(0), "UInt32": uint32(0), "UInt64": uint64(0),
+	"Int8": int8(0), "Int16": int16(0), "Int32": int32(0), "Int64": int64(0),
+	"Float32": float32(0), "Float64": float64(0),
+}
+
+// numericColumn is a column of type typ holding an entry field parsed as a
+// number.
+func numericColumn(field, typ string) column {
+	return column{name: field, typ: typ, field: field, value: func(entry *logrus.Entry) interface{} {
+		value, ok := entry.Data[field]
+		if !ok {
+			return numericZero[typ]
+		}
+		if number, ok := parseNumber(typ, fmt.Sprint(value)); ok {
+			return number
+		}
+		return numericZero[typ]
+	}}
+}
+
+// parseNumber parses s as a number of ClickHouse type typ.
+func parseNumber(typ, s string) (interface{}, bool) {
+	t := reflect.TypeOf(numericZero[typ])
+	var parsed interface{}
+	var err error
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		parsed, err = strconv.ParseFloat(s, t.Bits())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err = strconv.ParseUint(s, 10, t.Bits())
+	default:
+		parsed, err = strconv.ParseInt(s, 10, t.Bits())
+	}
+	if err != nil {
+		return nil, false
+	}
+	return reflect.ValueOf(parsed).Convert(t).Interface(), true
+}
+
+// stringItems renders each item of a slice or array value with fmt.Sprint.
+// nil gives an empty slice and any other value, []byte included, a one-item
+// slice.
+func stringItems(value interface{}) []string {
+	switch value := value.(type) {
+	case nil:
+		return []string{}
+	case []string:
+		return value
+	case []byte:
+		return []string{string(value)}
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []string{fmt.Sprint(value)}
+	}
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return items
+}
+
+// fieldColumn is a String column holding the value of an entry field, or ""
+// when the entry lacks it.
+func fieldColumn(name, field string) column {
+	return column{name: name, typ: "String", field: field, value: func(entry *logrus.Entry) interface{} {
+		if value, ok := entry.Data[field]; ok {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}}
+}
+
+// makeNullable turns the NullableColumns of columns into Nullable ones that
+// are NULL when the entry lacks their field. Only columns filled from a
+// single field of a scalar type qualify.
+func makeNullable(columns []column, nullable []string) error {
+	for _, name := range nullable {
+		i := slices.IndexFunc(columns, func(col column) bool { return col.name == name })
+		if i < 0 {
+			return fmt.Errorf("clickhouse hook: nullable column %q is not written", name)
+		}
+		col := &columns[i]
+		if col.field == "" || strings.HasPrefix(col.typ, "Array(") || strings.HasPrefix(col.typ, "Map(") {
+			return fmt.Errorf("clickhouse hook: column %q can't be nullable", name)
+		}
+		field, value := col.field, col.value
+		col.typ = "Nullable(" + col.typ + ")"
+		col.value = func(entry *logrus.Entry) interface{} {
+			if _, ok := entry.Data[field]; !ok {
+				return nil
+			}
+			return value(entry)
+		}
+	}
+	return nil
+}
+
+// setColumnTypes replaces the types of columns with those listed in types.
+func setColumnTypes(columns []column, types map[string]string) error {
+	for name, typ := range types {
+		i := slices.IndexFunc(columns, func(col column) bool { return col.name == name })
+		if i < 0 {
+			return fmt.Errorf("clickhouse hook: typed column %q is not written", name)
+		}
+		columns[i].typ = typ
+	}
+	return nil
+}
+
+// validColumnType reports whether typ looks like a ClickHouse type: a name
+// with balanced parenthesized arguments and nothing that would end the
+// statement it is spliced into.
+func validColumnType(typ string) bool {
+	if !typePattern.MatchString(typ) || strings.ContainsAny(typ, ";`\n") || strings.Contains(typ, "--") {
+		return false
+	}
+	depth := 0
+	for _, r := range typ {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// version returns the VersionColumn value of entry: what VersionFunc
+// returns, or entry.Time in Unix nanoseconds.
+func (hook *ClickHouseHook) version(entry *logrus.Entry) uint64 {
+	if hook.config.VersionFunc != nil {
+		return hook.config.VersionFunc(entry)
+	}
+	return uint64(max(entry.Time.UnixNano(), 0))
+}
+
+// buildInfo returns the module version and VCS revision the binary was
+// built from, or "" for those it doesn't record.
+func buildInfo() (version, commit string) {
+	info, _ := debug.ReadBuildInfo()
+	return buildInfoOf(info)
+}
+
+// buildInfoOf is buildInfo for info, which is nil when the binary has none.
+// Binaries built from a checkout report the version as "(devel)", which is
+// left out.
+func buildInfoOf(info *debug.BuildInfo) (version, commit string) {
+	if info == nil {
+		return "", ""
+	}
+	if info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			commit = setting.Value
+		}
+	}
+	return version, commit
+}
+
+// retentionDays returns the TTLField value of entry, or
+// DefaultRetentionDays when it lacks a valid one.
+func (hook *ClickHouseHook) retentionDays(entry *logrus.Entry) uint16 {
+	value, ok := entry.Data[hook.config.TTLField]
+	if !ok {
+		return hook.config.DefaultRetentionDays
+	}
+	days, err := strconv.ParseUint(fmt.Sprint(value), 10, 16)
+	if err != nil {
+		return hook.config.DefaultRetentionDays
+	}
+	return uint16(days)
+}
+
+// renderMessage returns the message column of entry: MessageTemplate
+// executed against it, or the plain message without a template or if
+// executing it fails.
+func (hook *ClickHouseHook) renderMessage(entry *logrus.Entry) string {
+	if hook.message == nil {
+		return entry.Message
+	}
+	var b strings.Builder
+	if err := hook.message.Execute(&b, entry); err != nil {
+		return entry.Message
+	}
+	return b.String()
+}
+
+// levelType is the ClickHouse type of the level column.
+func (hook *ClickHouseHook) levelType() string {
+	if !hook.config.LevelEnum {
+		return "LowCardinality(String)"
+	}
+	labels := make([]string, len(logrus.AllLevels))
+	for i, level := range logrus.AllLevels {
+		labels[i] = fmt.Sprintf("%s = %d", quoteString(hook.levelName(level)), level)
+	}
+	return "Enum8(" + strings.Join(labels, ", ") + ")"
+}
+
+// levelName returns the name stored for level, from LevelNames if it lists
+// the level.
+func (hook *ClickHouseHook) levelName(level logrus.Level) string {
+	if name, ok := hook.config.LevelNames[level]; ok {
+		return name
+	}
+	return level.String()
+}
+
+// timeType is the ClickHouse type of the time column for the configured precision.
+func (hook *ClickHouseHook) timeType() string {
+	if hook.config.TimePrecision == 0 {
+		return "DateTime"
+	}
+	return fmt.Sprintf("DateTime64(%d)", hook.config.TimePrecision)
+}
+
+// eventTime returns the entry's time, from TimeField if set, truncated to
+// the configured TimePrecision.
+func (hook *ClickHouseHook) eventTime(entry *logrus.Entry) time.Time {
+	unit := time.Second
+	for i := 0; i < hook.config.TimePrecision; i++ {
+		unit /= 10
+	}
+	return hook.entryTime(entry).In(hook.config.TimeZone).Truncate(unit)
+}
+
+// entryTime returns the value of TimeField when the entry has one that
+// parses, and entry.Time otherwise.
+func (hook *ClickHouseHook) entryTime(entry *logrus.Entry) time.Time {
+	field := hook.config.TimeField
+	if field == "" {
+		return entry.Time
+	}
+	value, ok := entry.Data[field]
+	if !ok {
+		return entry.Time
+	}
+	t, ok := parseTime(value)
+	if !ok {
+		hook.logLimited(hook.log().WithField("field", field), logrus.WarnLevel, nil,
+			"time field is not a time, using the entry time")
+		return entry.Time
+	}
+	return t
+}
+
+// parseTime interprets value as a time: a time.Time, an RFC 3339 string or
+// Unix seconds, given as a number or numeric string.
+func parseTime(value interface{}) (time.Time, bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			return unixTime(seconds), true
+		}
+	case float64:
+		return unixTime(value), true
+	case float32:
+		return unixTime(float64(value)), true
+	case int:
+		return time.Unix(int64(value), 0), true
+	case int64:
+		return time.Unix(value, 0), true
+	case int32:
+		return time.Unix(int64(value), 0), true
+	case uint32:
+		return time.Unix(int64(value), 0), true
+	case uint64:
+		return time.Unix(int64(value), 0), true
+	}
+	return time.Time{}, false
+}
+
+// unixTime converts fractional Unix seconds to a time.
+func unixTime(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second)))
+}
+
+// plainFormatter renders entries whose logger has no formatter.
+var plainFormatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+
+// formatted renders entry with its logger's formatter, without the trailing
+// newline. A formatter error is stored in place of the line.
+func formatted(entry *logrus.Entry) string {
+	var formatter logrus.Formatter = plainFormatter
+	if entry.Logger != nil && entry.Logger.Formatter != nil {
+		formatter = entry.Logger.Formatter
+	}
+	line, err := formatter.Format(entry)
+	if err != nil {
+		return "format error: " + err.Error()
+	}
+	return strings.TrimSuffix(string(line), "\n")
+}
+
+// SeverityCode maps a logrus level to the code written to the severity
+// column by default: Trace 0, Debug 1, Info 2, Warning 3, Error 4, Fatal 5
+// and Panic 6.
+func SeverityCode(level logrus.Level) uint8 {
+	if level > logrus.TraceLevel {
+		return 0
+	}
+	return uint8(logrus.TraceLevel - level)
+}
+
+// severity returns the severity code of level, from SeverityCodes if it
+// lists the level.
+func (hook *ClickHouseHook) severity(level logrus.Level) uint8 {
+	if code, ok := hook.config.SeverityCodes[level]; ok {
+		return code
+	}
+	return SeverityCode(level)
+}
+
+// caller formats the entry's call site, or returns "" when the logger
+// wasn't recording it.
+func (hook *ClickHouseHook) caller(entry *logrus.Entry) string {
+	if !entry.HasCaller() {
+		return ""
+	}
+	location := fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line)
+	if hook.config.IncludeCallerFunction {
+		location += " " + entry.Caller.Function
+	}
+	return location
+}
+
+// stackTrace returns the stack trace of the error field of an Error, Fatal
+// or Panic entry, or "" when there is none.
+func stackTrace(entry *logrus.Entry) string {
+	if entry.Level > logrus.ErrorLevel {
+		return ""
+	}
+	err, ok := entry.Data[logrus.ErrorKey].(error)
+	if !ok {
+		return ""
+	}
+	if method := reflect.ValueOf(err).MethodByName("StackTrace"); method.IsValid() &&
+		method.Type().NumIn() == 0 && method.Type().NumOut() == 1 {
+		return strings.TrimSpace(fmt.Sprintf("%+v", method.Call(nil)[0].Interface()))
+	}
+	if _, ok := err.(fmt.Formatter); ok {
+		return fmt.Sprintf("%+v", err)
+	}
+	return ""
+}
+
+// goroutinesKey is the entry.Context key of the goroutine count captured by
+// withGoroutines.
+type goroutinesKey struct{}
+
+// withGoroutines returns a copy of entry carrying the current number of
+// goroutines in its Context, so the count reflects log time rather than
+// flush time without showing up in the entry's fields.
+func withGoroutines(entry *logrus.Entry) *logrus.Entry {
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	captured := *entry
+	captured.Context = context.WithValue(ctx, goroutinesKey{}, uint32(runtime.NumGoroutine()))
+	return &captured
+}
+
+// goroutines returns the count captured by withGoroutines, or zero for
+// entries without one, such as those replayed from the disk buffer.
+func goroutines(entry *logrus.Entry) uint32 {
+	if entry.Context == nil {
+		return 0
+	}
+	n, _ := entry.Context.Value(goroutinesKey{}).(uint32)
+	return n
+}
+
+// truncatedMarker is appended to values cut short by truncate.
+const truncatedMarker = "…[truncated]"
+
+// truncate cuts s to at most limit bytes, marker included, without
+// splitting a multibyte rune, and marks it as truncated. A limit too small
+// for the marker cuts s without one; a limit of zero or less leaves s
+// unchanged.
+func truncate(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	marker := truncatedMarker
+	if limit < len(marker) {
+		marker = ""
+	}
+	cut := limit - len(marker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + marker
+}
+
+// columnList returns the comma separated names of columns.
+func columnList(columns []column) string {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = quoteName(col.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// insertQuery builds the parameterised INSERT statement for columns, with
+// settings from settingsClause.
+func insertQuery(table string, columns []column, settings string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s)%s VALUES (%s)", quoteTable(table), columnList(columns), settings, placeholders)
+}
+
+// settingsKey is the context key of the SETTINGS clause of a batch.
+type settingsKey struct{}
+
+// withBatchSettings returns ctx carrying the SETTINGS clause of entries:
+// QuerySettings merged with what InsertSettingsFunc returns for them.
+func (hook *ClickHouseHook) withBatchSettings(ctx context.Context, entries []logrus.Entry) context.Context {
+	settings := maps.Clone(hook.config.QuerySettings)
+	if settings == nil {
+		settings = make(map[string]string)
+	}
+	for name, value := range hook.config.InsertSettingsFunc(entries) {
+		if !namePattern.MatchString(name) {
+			hook.logLimited(hook.log().WithField("setting", name), logrus.WarnLevel, nil,
+				"invalid setting name "+name+", skipping it")
+			continue
+		}
+		settings[name] = value
+	}
+	return context.WithValue(ctx, settingsKey{}, settingsClause(settings))
+}
+
+// batchSettings returns the SETTINGS clause of a batch: settings, or the
+// one ctx carries, with the batch's insert_deduplication_token added when
+// ctx carries one.
+func batchSettings(ctx context.Context, settings string) string {
+	if clause, ok := ctx.Value(settingsKey{}).(string); ok {
+		settings = clause
+	}
+	token := batchToken(ctx)
+	if token == "" {
+		return settings
+	}
+	clause := "insert_deduplication_token = '" + token + "'"
+	if settings == "" {
+		return " SETTINGS " + clause
+	}
+	return settings + ", " + clause
+}
+
+// hasBatchSettings reports whether ctx carries settings of a batch of its
+// own, so that a prepared INSERT won't do.
+func hasBatchSettings(ctx context.Context) bool {
+	_, ok := ctx.Value(settingsKey{}).(string)
+	return ok || batchToken(ctx) != ""
+}
+
+// numberPattern matches setting values sent unquoted.
+var numberPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// quoteString renders s as a ClickHouse string literal.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// settingsClause renders settings, sorted by name, as " SETTINGS k = v, ..."
+// for an INSERT, or "" when there are none. Names are validated by
+// prepareConfig; values other than numbers are quoted.
+func settingsClause(settings map[string]string) string {
+	if len(settings) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assignments := make([]string, len(names))
+	for i, name := range names {
+		value := settings[name]
+		if !numberPattern.MatchString(value) {
+			value = quoteString(value)
+		}
+		assignments[i] = name + " = " + value
+	}
+	return " SETTINGS " + strings.Join(assignments, ", ")
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testRow is a row type for WithRowType.
+type testRow struct {
+	User   string `ch:"user"`
+	Status int32  `ch:"status"`
+}
+
+func TestColumnsMatchRowLength(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"fields", []Option{WithFields()}},
+		{"fields as json", []Option{WithFields(), WithFieldEncoding(FieldsAsJSON)}},
+		{"capped fields", []Option{WithFields(), WithMaxFieldsPerEntry(2)}},
+		{"formatted", []Option{WithFormatted()}},
+		{"severity", []Option{WithSeverityCode(nil)}},
+		{"caller", []Option{WithCaller(true)}},
+		{"process info", []Option{WithProcessInfo(true, true)}},
+		{"build info", []Option{WithBuildVersion("v1.2.3"), WithBuildCommit("abc123")}},
+		{"ingest lag", []Option{WithIngestLag()}},
+		{"deduplication", []Option{WithDeduplication()}},
+		{"version", []Option{WithReplacingVersion("version", nil)}},
+		{"stack trace", []Option{WithStackTrace()}},
+		{"error column", []Option{WithDetailedErrors(true)}},
+		{"field columns", []Option{WithTraceFields("trace", "span"), WithSourceField("src"), WithRequestIDField("req")}},
+		{"retention", []Option{WithRetentionField("days", 30)}},
+		{"array columns", []Option{WithArrayColumns("tags", "hosts")}},
+		{"numeric fields", []Option{WithNumericFields(map[string]string{"b": "Float64", "a": "UInt32", "c": "Int8"})}},
+		{"row type", []Option{WithRowType(testRow{})}},
+		{"column map", []Option{WithColumnMap(map[string]string{"time": "ts", "message": "msg"})}},
+		{"everything", []Option{
+			WithFields(), WithMaxFieldsPerEntry(2), WithFormatted(), WithSeverityCode(nil), WithCaller(false),
+			WithProcessInfo(true, true), WithBuildVersion("v1"), WithBuildCommit("abc"), WithIngestLag(),
+			WithDeduplication(), WithReplacingVersion("version", nil), WithStackTrace(), WithDetailedErrors(true),
+			WithTraceFields("trace", "span"), WithSourceField("src"), WithRequestIDField("req"),
+			WithRetentionField("days", 7), WithArrayColumns("tags"), WithNumericFields(map[string]string{"n": "UInt8"}),
+			WithRowType(&testRow{}), WithNullableColumns("source"), WithTimePrecision(6),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := prepareConfig(Config{BatchSize: 10}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hook, err := newHook(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := newSQLSink(nil, "logs", hook.columns, "", nil, FlushStrategyPrepared)
+			entry := logrus.Entry{
+				Time:    time.Now(),
+				Level:   logrus.ErrorLevel,
+				Message: "failed",
+				Data: logrus.Fields{
+					"user": "ann", "status": 500, "tags": []string{"a"}, "n": 3, "days": 5,
+					"trace": "t1", "src": "api", logrus.ErrorKey: errors.New("boom"),
+				},
+			}
+			args := sink.row(&entry, hook.columns, make([]interface{}, len(hook.columns)))
+			if len(args) != len(hook.columns) {
+				t.Errorf("row has %d values for %d columns", len(args), len(hook.columns))
+			}
+			if placeholders := strings.Count(sink.query, "?"); placeholders != len(hook.columns) {
+				t.Errorf("INSERT has %d placeholders for %d columns", placeholders, len(hook.columns))
+			}
+			if names := strings.Count(columnList(hook.columns), ",") + 1; names != len(hook.columns) {
+				t.Errorf("INSERT lists %d columns for %d", names, len(hook.columns))
+			}
+		})
+	}
+}
+
+// nopMarshaler is a RowMarshaler returning no values.
+type nopMarshaler struct{}
+
+func (nopMarshaler) MarshalRow(*logrus.Entry) ([]interface{}, error) { return nil, nil }
+
+func TestValidateRejectsDuplicateColumns(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		column string
+	}{
+		{"array column", []Option{WithArrayColumns("message")}, "message"},
+		{"numeric field", []Option{WithNumericFields(map[string]string{"level": "UInt8"})}, "level"},
+		{"version column", []Option{WithDeduplication(), WithReplacingVersion("count", nil)}, "count"},
+		{"row type", []Option{WithRowType(struct {
+			Time string `ch:"event_time"`
+		}{})}, "event_time"},
+		{"column map", []Option{WithColumnMap(map[string]string{"message": "event_time"})}, "event_time"},
+		{"marshal columns", []Option{WithRowMarshaler(nopMarshaler{}, "a", "a")}, "a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := prepareConfig(Config{BatchSize: 10}, tc.opts)
+			want := `column "` + tc.column + `" written twice`
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got %v, want an error containing %s", err, want)
+			}
+		})
+	}
+}
+
+func TestBuildInfoOf(t *testing.T) {
+	revision := debug.BuildSetting{Key: "vcs.revision", Value: "4f2a9c1"}
+	for _, tc := range []struct {
+		name          string
+		info          *debug.BuildInfo
+		version, hash string
+	}{
+		{"no build info", nil, "", ""},
+		{"checkout", &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}, Settings: []debug.BuildSetting{revision}}, "", "4f2a9c1"},
+		{"module", &debug.BuildInfo{Main: debug.Module{Version: "v1.4.0"}}, "v1.4.0", ""},
+		{"module with revision", &debug.BuildInfo{Main: debug.Module{Version: "v1.4.0"}, Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"}, revision,
+		}}, "v1.4.0", "4f2a9c1"},
+	} {
+		if version, hash := buildInfoOf(tc.info); version != tc.version || hash != tc.hash {
+			t.Errorf("buildInfoOf(%s) = %q, %q, want %q, %q", tc.name, version, hash, tc.version, tc.hash)
+		}
+	}
+}
+
+func TestWithBuildInfoKeepsExplicitValues(t *testing.T) {
+	config, err := prepareConfig(Config{BatchSize: 1}, []Option{
+		WithBuildVersion("v2.0.0"), WithBuildCommit("abc123"), WithBuildInfo(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BuildVersion != "v2.0.0" || config.BuildCommit != "abc123" {
+		t.Fatalf("WithBuildInfo replaced explicit values with %q, %q", config.BuildVersion, config.BuildCommit)
+	}
+}
+
+func TestDateTime64KeepsNanoseconds(t *testing.T) {
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	for _, tc := range []struct {
+		precision int
+		typ       string
+		want      time.Time
+		literal   string
+	}{
+		{9, "DateTime64(9)", at, "fromUnixTimestamp64Nano(1714979289123456789)"},
+		{3, "DateTime64(3)", at.Truncate(time.Millisecond), "fromUnixTimestamp64Nano(1714979289123000000)"},
+	} {
+		t.Run(tc.typ, func(t *testing.T) {
+			col := newTestHook(t, WithTimePrecision(tc.precision)).columns[0]
+			if col.typ != tc.typ {
+				t.Fatalf("time column of type %s, want %s", col.typ, tc.typ)
+			}
+			value := col.value(&logrus.Entry{Time: at})
+			if got, ok := value.(time.Time); !ok || !got.Equal(tc.want) {
+				t.Fatalf("time column value %v, want %v", value, tc.want)
+			}
+			if literal, err := appendLiteral(nil, value); err != nil || string(literal) != tc.literal {
+				t.Errorf("time literal %s (%v), want %s", literal, err, tc.literal)
+			}
+			if got, _ := driverRoundTrip(t, col.typ, value).(time.Time); !got.Equal(tc.want) {
+				t.Errorf("driver read back %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeZoneKeepsStoredInstant(t *testing.T) {
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	utc := newTestHook(t).columns[0]
+	local := newTestHook(t, WithTimeZone(zone)).columns[0]
+	entry := &logrus.Entry{Time: at}
+
+	value := local.value(entry).(time.Time)
+	if value.Location() != zone || !value.Equal(at) {
+		t.Fatalf("time column value %v, want %v in %s", value, at, zone)
+	}
+	if got := jsonColumnValue(value); got != "2024-05-06T12:08:09+05:00" {
+		t.Errorf("JSONEachRow time %v, want the offset of the zone", got)
+	}
+
+	encoder, _ := rowBinaryEncoderFor(local.typ)
+	want, _ := encoder(nil, utc.value(entry))
+	if got, _ := encoder(nil, value); !bytes.Equal(got, want) {
+		t.Errorf("RowBinary time % x in %s, want % x as in UTC", got, zone, want)
+	}
+	want, _ = appendLiteral(nil, utc.value(entry))
+	if got, _ := appendLiteral(nil, value); !bytes.Equal(got, want) {
+		t.Errorf("time literal %s in %s, want %s as in UTC", got, zone, want)
+	}
+	if got, _ := driverRoundTrip(t, local.typ, value).(time.Time); !got.Equal(at) {
+		t.Errorf("driver read back %v, want %v", got, at)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		s     string
+		limit int
+		want  string
+	}{
+		{"short", "hello", 10, "hello"},
+		{"exact", "hello", 5, "hello"},
+		{"no limit", "hello", 0, "hello"},
+		{"ascii", strings.Repeat("a", 30), 20, "aaaaaa" + truncatedMarker},
+		{"rune at boundary", "aaaaaé" + strings.Repeat("b", 20), 20, "aaaaa" + truncatedMarker},
+		{"room for marker only", strings.Repeat("a", 30), len(truncatedMarker), truncatedMarker},
+		{"limit below marker", "héllo world", 2, "h"},
+		{"limit below first rune", "éa", 1, ""},
+	} {
+		got := truncate(tc.s, tc.limit)
+		if got != tc.want {
+			t.Errorf("%s: truncate(%q, %d) = %q, want %q", tc.name, tc.s, tc.limit, got, tc.want)
+		}
+		if tc.limit > 0 && len(got) > tc.limit {
+			t.Errorf("%s: truncate(%q, %d) is %d bytes, over the limit", tc.name, tc.s, tc.limit, len(got))
+		}
+	}
+}
+
+// columnNamed returns the column of hook named name.
+func columnNamed(t *testing.T, hook *ClickHouseHook, name string) column {
+	t.Helper()
+	for _, col := range hook.columns {
+		if col.name == name {
+			return col
+		}
+	}
+	t.Fatalf("no column %q", name)
+	return column{}
+}
+
+func TestNullableColumns(t *testing.T) {
+	hook := newTestHook(t, WithTraceFields("trace", ""), WithNumericFields(map[string]string{"latency": "Float64"}),
+		WithNullableColumns("trace_id", "latency"))
+	for _, tc := range []struct {
+		name, typ string
+		data      logrus.Fields
+		want      interface{}
+	}{
+		{"trace_id", "Nullable(String)", logrus.Fields{}, nil},
+		{"trace_id", "Nullable(String)", logrus.Fields{"trace": "abc"}, "abc"},
+		{"trace_id", "Nullable(String)", logrus.Fields{"trace": ""}, ""},
+		{"latency", "Nullable(Float64)", logrus.Fields{"trace": "abc"}, nil},
+		{"latency", "Nullable(Float64)", logrus.Fields{"latency": 1.5}, 1.5},
+	} {
+		col := columnNamed(t, hook, tc.name)
+		if col.typ != tc.typ {
+			t.Errorf("column %s of type %s, want %s", tc.name, col.typ, tc.typ)
+		}
+		if got := col.value(&logrus.Entry{Data: tc.data}); got != tc.want {
+			t.Errorf("column %s of %v = %#v, want %#v", tc.name, tc.data, got, tc.want)
+		}
+	}
+
+	for _, opts := range [][]Option{
+		{WithNullableColumns("trace_id")},
+		{WithNullableColumns("message")},
+	} {
+		config, err := prepareConfig(Config{BatchSize: 1}, opts)
+		if err == nil {
+			_, err = newHook(config)
+		}
+		if err == nil {
+			t.Errorf("%v: no error for a column that can't be nullable", config.NullableColumns)
+		}
+	}
+}
+
+func TestArrayColumnRoundTrip(t *testing.T) {
+	col := columnNamed(t, newTestHook(t, WithArrayColumns("tags")), "tags")
+	for _, tc := range []struct {
+		name    string
+		data    logrus.Fields
+		want    []string
+		literal string
+	}{
+		{"strings", logrus.Fields{"tags": []string{"a", "b'c"}}, []string{"a", "b'c"}, `['a', 'b\'c']`},
+		{"ints", logrus.Fields{"tags": []int{1, 2}}, []string{"1", "2"}, "['1', '2']"},
+		{"scalar", logrus.Fields{"tags": "solo"}, []string{"solo"}, "['solo']"},
+		{"missing", logrus.Fields{}, []string{}, "[]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			value := col.value(&logrus.Entry{Data: tc.data})
+			if got, ok := value.([]string); !ok || !slices.Equal(got, tc.want) {
+				t.Fatalf("column value %#v, want %q", value, tc.want)
+			}
+			if literal, err := appendLiteral(nil, value); err != nil || string(literal) != tc.literal {
+				t.Errorf("literal %s (%v), want %s", literal, err, tc.literal)
+			}
+			encoder, _ := rowBinaryEncoderFor(col.typ)
+			encoded, err := encoder(nil, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded[0] != byte(len(tc.want)) {
+				t.Errorf("RowBinary array of %d items, want %d", encoded[0], len(tc.want))
+			}
+			read := driverRoundTrip(t, col.typ, value)
+			if got, ok := read.([]string); !ok || !slices.Equal(got, tc.want) {
+				t.Errorf("driver read back %#v, want %q", read, tc.want)
+			}
+		})
+	}
+}
+
+func TestLevelLowCardinality(t *testing.T) {
+	hook := newTestHook(t)
+	col := columnNamed(t, hook, "level")
+	if col.typ != "LowCardinality(String)" {
+		t.Fatalf("level column of type %s, want LowCardinality(String)", col.typ)
+	}
+	if query := createTableQuery(hook.config, hook.columns); !strings.Contains(query, "`level` LowCardinality(String)") {
+		t.Errorf("createTableQuery() =\n%s\nwant a LowCardinality(String) level column", query)
+	}
+	for _, level := range logrus.AllLevels {
+		value := col.value(&logrus.Entry{Level: level})
+		if value != level.String() {
+			t.Errorf("level column of %s = %v, want %s", level, value, level)
+		}
+		if got := driverRoundTrip(t, driverInsertType(col.typ), value); got != value {
+			t.Errorf("driver read back %v for level %s, want %v", got, level, value)
+		}
+	}
+}
+
+func TestLevelEnum(t *testing.T) {
+	hook := newTestHook(t, WithLevelEnum(), WithLevelNames(map[logrus.Level]string{logrus.WarnLevel: "warn"}))
+	col := columnNamed(t, hook, "level")
+	want := "Enum8('panic' = 0, 'fatal' = 1, 'error' = 2, 'warn' = 3, 'info' = 4, 'debug' = 5, 'trace' = 6)"
+	if col.typ != want {
+		t.Fatalf("level column of type %s, want %s", col.typ, want)
+	}
+	for _, level := range logrus.AllLevels {
+		value := col.value(&logrus.Entry{Level: level})
+		if got := driverRoundTrip(t, col.typ, value); got != value {
+			t.Errorf("driver read back %v for level %s, want %v", got, level, value)
+		}
+	}
+
+	// A level logrus doesn't define is written as "unknown", which the
+	// Enum8 lacks, so the driver rejects the row rather than storing
+	// another level.
+	value := col.value(&logrus.Entry{Level: logrus.Level(42)})
+	if value != "unknown" {
+		t.Fatalf("level column of an undefined level = %v, want unknown", value)
+	}
+	if err := driverAppend(t, col.typ, value); err == nil {
+		t.Error("driver accepted a level missing from the Enum8")
+	}
+	if _, ok := rowBinaryEncoderFor(col.typ); ok {
+		t.Error("RowBinary encoder for an Enum8 level column")
+	}
+}
+
+func TestNumericFields(t *testing.T) {
+	hook := newTestHook(t, WithNumericFields(map[string]string{
+		"status": "UInt16", "delta": "Int32", "latency": "Float64", "ratio": "Float32", "bytes": "Int64",
+	}))
+	for _, tc := range []struct {
+		field string
+		value interface{}
+		want  interface{}
+	}{
+		{"status", 200, uint16(200)},
+		{"status", "404", uint16(404)},
+		{"status", nil, uint16(0)},
+		{"status", 70000, uint16(0)},
+		{"status", -1, uint16(0)},
+		{"status", "abc", uint16(0)},
+		{"delta", -5, int32(-5)},
+		{"delta", 1.5, int32(0)},
+		{"latency", 1.5, 1.5},
+		{"latency", "2.25", 2.25},
+		{"latency", true, float64(0)},
+		{"ratio", float32(0.1), float32(0.1)},
+		{"bytes", int64(math.MaxInt64), int64(math.MaxInt64)},
+		{"bytes", []int{1}, int64(0)},
+	} {
+		data := logrus.Fields{}
+		if tc.value != nil {
+			data[tc.field] = tc.value
+		}
+		col := columnNamed(t, hook, tc.field)
+		if got := col.value(&logrus.Entry{Data: data}); got != tc.want {
+			t.Errorf("%s column of %#v = %#v, want %#v", tc.field, tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+)
+
+// packedChunk is a gzip-compressed chunk of n entries in the disk buffer's
+// record format.
+type packedChunk struct {
+	data []byte
+	n    int
+}
+
+// pack compresses the buffered entries older than the newest
+// CompressThreshold into chunks of up to CompressThreshold entries, after
+// those already compressed. Entries that fail to encode stay as they are.
+// Callers must hold hook.mu.
+func (hook *ClickHouseHook) pack() {
+	threshold := hook.config.CompressThreshold
+	if threshold <= 0 || len(hook.entries) <= threshold {
+		return
+	}
+
+	chunks, kept := hook.packEntries(hook.entries[:len(hook.entries)-threshold])
+	hook.packed = append(hook.packed, chunks...)
+	hook.entries = append(kept, hook.entries[len(hook.entries)-threshold:]...)
+	hook.bytes = 0
+	for i := range hook.entries {
+		hook.bytes += entrySize(&hook.entries[i])
+	}
+}
+
+// packEntries compresses entries into chunks of up to CompressThreshold
+// entries, returning them and the entries that failed to encode. Callers
+// must hold hook.mu.
+func (hook *ClickHouseHook) packEntries(entries []logrus.Entry) ([]packedChunk, []logrus.Entry) {
+	var chunks []packedChunk
+	var kept []logrus.Entry
+	for len(entries) > 0 {
+		n := min(hook.config.CompressThreshold, len(entries))
+		data, raw, failed, err := packChunk(entries[:n])
+		if err != nil {
+			kept = append(kept, entries[:n]...)
+		} else {
+			chunks = append(chunks, packedChunk{data: data, n: n - len(failed)})
+			hook.packedCount += n - len(failed)
+			hook.recordCompression(raw, len(data))
+			kept = append(kept, failed...)
+		}
+		entries = entries[n:]
+	}
+	return chunks, kept
+}
+
+// packChunk compresses entries into one chunk, returning its size before
+// compression and the entries that failed to encode.
+func packChunk(entries []logrus.Entry) ([]byte, int, []logrus.Entry, error) {
+	var buf bytes.Buffer
+	var failed []logrus.Entry
+	var raw int
+	gz := gzip.NewWriter(&buf)
+	for i := range entries {
+		line, err := encodeRecord(&entries[i])
+		if err != nil {
+			failed = append(failed, entries[i])
+			continue
+		}
+		gz.Write(line)
+		gz.Write([]byte{'\n'})
+		raw += len(line) + 1
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, nil, err
+	}
+	return buf.Bytes(), raw, failed, nil
+}
+
+// recordCompression counts a chunk of raw bytes compressed into
+// compressed ones. Callers must hold hook.mu.
+func (hook *ClickHouseHook) recordCompression(raw, compressed int) {
+	hook.compressionIn += uint64(raw)
+	hook.compressionOut += uint64(compressed)
+	hook.metrics.compressionIn.Add(float64(raw))
+	hook.metrics.compressionOut.Add(float64(compressed))
+	hook.metrics.compressionRatio.Set(compressionRatio(hook.compressionIn, hook.compressionOut))
+}
+
+// compressionRatio returns in/out, or 0 before anything was compressed.
+func compressionRatio(in, out uint64) float64 {
+	if out == 0 {
+		return 0
+	}
+	return float64(in) / float64(out)
+}
+
+// unpack returns the entries pack compressed, oldest first, and forgets
+// them. Entries of a chunk that fails to decode are counted as dropped and
+// reported in the error. Callers must hold hook.mu.
+func (hook *ClickHouseHook) unpack() ([]logrus.Entry, error) {
+	if len(hook.packed) == 0 {
+		return nil, nil
+	}
+	entries := make([]logrus.Entry, 0, hook.packedCount)
+	var errs []error
+	for _, chunk := range hook.packed {
+		decoded, err := hook.unpackChunk(chunk)
+		entries = append(entries, decoded...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	hook.packed = nil
+	hook.packedCount = 0
+	return entries, errors.Join(errs...)
+}
+
+// unpackChunk decodes chunk, counting the entries it fails to as dropped.
+// Callers must hold hook.mu.
+func (hook *ClickHouseHook) unpackChunk(chunk packedChunk) ([]logrus.Entry, error) {
+	var entries []logrus.Entry
+	gz, err := gzip.NewReader(bytes.NewReader(chunk.data))
+	if err == nil {
+		var lines [][]byte
+		lines, err = scanLines(gz)
+		entries = decodeRecords(lines)
+	}
+	lost := chunk.n - len(entries)
+	if lost <= 0 {
+		return entries, nil
+	}
+	hook.dropped += uint64(lost)
+	hook.metrics.dropped.Add(float64(lost))
+	if err == nil {
+		err = errors.New("records failed to decode")
+	}
+	return entries, fmt.Errorf("clickhouse hook: lost %d compressed entries: %w", lost, err)
+}
+
+// dropOldest removes up to n of the oldest buffered entries, compressed
+// ones first, and returns them. Only a chunk that is partly dropped is
+// compressed again. Callers must hold hook.mu.
+func (hook *ClickHouseHook) dropOldest(n int) ([]logrus.Entry, error) {
+	var dropped []logrus.Entry
+	var errs []error
+	for n > 0 && len(hook.packed) > 0 {
+		chunk := hook.packed[0]
+		hook.packed = hook.packed[1:]
+		hook.packedCount -= chunk.n
+		entries, err := hook.unpackChunk(chunk)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if chunk.n <= n {
+			dropped = append(dropped, entries...)
+			n -= chunk.n
+			continue
+		}
+		k := min(n, len(entries))
+		dropped = append(dropped, entries[:k]...)
+		chunks, kept := hook.packEntries(entries[k:])
+		hook.packed = append(chunks, hook.packed...)
+		hook.entries = slices.Concat(kept, hook.entries)
+		n = 0
+	}
+	if n > 0 {
+		k := min(n, len(hook.entries))
+		dropped = append(dropped, hook.entries[:k]...)
+		hook.entries = slices.Clone(hook.entries[k:])
+	}
+	return dropped, errors.Join(errs...)
+}
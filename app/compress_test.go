@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fieldEntries returns n entries with a message, time and fields, as a
+// service would log them.
+func fieldEntries(n int) []logrus.Entry {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := make([]logrus.Entry, n)
+	for i := range entries {
+		entries[i] = logrus.Entry{
+			Time:    start.Add(time.Duration(i) * time.Millisecond),
+			Level:   logrus.InfoLevel,
+			Message: fmt.Sprintf("GET /api/orders/%d served", i),
+			Data:    logrus.Fields{"status": "200", "route": "/api/orders", "user": fmt.Sprintf("user-%d", i%50)},
+		}
+	}
+	return entries
+}
+
+func TestCompressedEntriesRoundTrip(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithInMemoryCompression(5), WithRetries(0, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	entries := fieldEntries(23)
+	for i := range entries {
+		hook.Fire(&entries[i])
+	}
+	sink.SetError(errors.New("server down"))
+	if err := hook.Flush(); err == nil {
+		t.Fatal("Flush into a failing sink returned nil")
+	}
+	hook.mu.Lock()
+	packed := hook.packedCount
+	hook.mu.Unlock()
+	if packed != 18 {
+		t.Fatalf("%d entries compressed after the failed flush, want all but the newest 5", packed)
+	}
+
+	sink.SetError(nil)
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := sink.Entries()
+	if len(got) != len(entries) {
+		t.Fatalf("%d entries flushed, want %d", len(got), len(entries))
+	}
+	for i := range got {
+		want := entries[i]
+		if !got[i].Time.Equal(want.Time) || got[i].Level != want.Level || got[i].Message != want.Message ||
+			fmt.Sprint(got[i].Data) != fmt.Sprint(want.Data) {
+			t.Fatalf("entry %d flushed as %v %s %q %v, want %v %s %q %v", i,
+				got[i].Time, got[i].Level, got[i].Message, got[i].Data, want.Time, want.Level, want.Message, want.Data)
+		}
+	}
+}
+
+func TestRequeueKeepsCompressedChunks(t *testing.T) {
+	hook := newTestHook(t, WithInMemoryCompression(5))
+	failure := errors.New("server down")
+	hook.requeue(fieldEntries(20), failure)
+
+	hook.mu.Lock()
+	before := slices.Clone(hook.packed)
+	hook.mu.Unlock()
+	if len(before) == 0 {
+		t.Fatal("nothing compressed")
+	}
+
+	hook.requeue(fieldEntries(20), failure)
+	hook.mu.Lock()
+	after := hook.packed
+	hook.mu.Unlock()
+	// The chunks compressed first hold the newer entries, so they come last.
+	kept := after[len(after)-len(before):]
+	for i := range before {
+		if &kept[i].data[0] != &before[i].data[0] {
+			t.Fatalf("chunk %d was compressed again on the second failure", i)
+		}
+	}
+}
+
+func TestRequeueDropsOldestCompressedEntries(t *testing.T) {
+	hook := newTestHook(t, WithInMemoryCompression(5), WithMaxBufferSize(12))
+	failure := errors.New("server down")
+	hook.requeue(fieldEntries(12), failure)
+	dropped := hook.requeue(fieldEntries(3), failure)
+
+	// The second requeue's entries are the oldest, and dropped first.
+	if got, want := messagesOf(dropped), messagesOf(fieldEntries(3)); !slices.Equal(got, want) {
+		t.Fatalf("dropped %v, want %v", got, want)
+	}
+	dropped = hook.requeue(nil, failure)
+	if len(dropped) != 0 {
+		t.Fatalf("dropped %d entries of a full buffer with nothing added", len(dropped))
+	}
+
+	hook.mu.Lock()
+	hook.config.MaxBufferSize = 4
+	hook.mu.Unlock()
+	dropped = hook.requeue(nil, failure)
+	if got, want := messagesOf(dropped), messagesOf(fieldEntries(8)); !slices.Equal(got, want) {
+		t.Fatalf("dropped %v, want the oldest %v", got, want)
+	}
+	if got := hook.Stats().Buffered; got != 4 {
+		t.Fatalf("%d entries buffered, want 4", got)
+	}
+}
+
+func TestUnpackCountsCorruptChunks(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithInMemoryCompression(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.mu.Lock()
+	hook.packed = append(hook.packed, packedChunk{data: []byte("not gzip"), n: 3})
+	hook.packedCount += 3
+	hook.mu.Unlock()
+	hook.Fire(testEntry(logrus.InfoLevel, "intact"))
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(sink.Entries()); got != 1 {
+		t.Fatalf("%d entries flushed, want the intact one", got)
+	}
+	if got := hook.Stats().DroppedEntries; got != 3 {
+		t.Fatalf("Stats.DroppedEntries = %d, want the 3 of the corrupt chunk", got)
+	}
+}
+
+// BenchmarkInMemoryCompression reports the heap held by a backlog of 100k
+// entries kept after a failed flush, with and without compression.
+func BenchmarkInMemoryCompression(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"off", nil},
+		{"on", []Option{WithInMemoryCompression(1000)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			const backlog = 100000
+			failure := errors.New("server down")
+			var held uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				hook := newTestHook(b, bc.opts...)
+				entries := fieldEntries(backlog)
+				b.StartTimer()
+
+				hook.requeue(entries, failure)
+
+				b.StopTimer()
+				entries = nil
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				held += after.HeapAlloc - min(before.HeapAlloc, after.HeapAlloc)
+				runtime.KeepAlive(hook)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(held)/float64(b.N)/backlog, "bytes/entry")
+		})
+	}
+}
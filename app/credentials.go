@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// credentialRefreshInterval is how often, at most, an authentication
+// failure reopens the pools with credentials from CredentialProvider.
+const credentialRefreshInterval = 30 * time.Second
+
+// authCodes are the ClickHouse error codes of rejected credentials.
+var authCodes = map[int32]bool{
+	192: true, // UNKNOWN_USER
+	193: true, // WRONG_PASSWORD
+	194: true, // REQUIRED_PASSWORD
+	516: true, // AUTHENTICATION_FAILED
+}
+
+// isAuthError reports whether err means the server rejected the
+// credentials.
+func isAuthError(err error) bool {
+	code, ok := errorCode(err)
+	return ok && authCodes[code]
+}
+
+// refreshCredentials reopens the pools of a database/sql sink, so that
+// their connections authenticate with credentials freshly returned by
+// CredentialProvider. It reports whether it did, which it doesn't without
+// a provider or within credentialRefreshInterval of the last time.
+func (hook *ClickHouseHook) refreshCredentials() bool {
+	sink, ok := hook.sink.(*sqlSink)
+	if hook.config.CredentialProvider == nil || !ok {
+		return false
+	}
+	hook.refreshMu.Lock()
+	defer hook.refreshMu.Unlock()
+	now := hook.config.Clock.Now()
+	if !hook.refreshedAt.IsZero() && now.Sub(hook.refreshedAt) < credentialRefreshInterval {
+		return false
+	}
+	hook.refreshedAt = now
+
+	refreshed := true
+	for _, n := range sink.nodes {
+		if err := n.reopen(hook.currentConfig()); err != nil {
+			hook.logLimited(hook.log(), logrus.WarnLevel, err, "reconnecting with fresh credentials failed")
+			refreshed = false
+		}
+	}
+	if refreshed {
+		hook.log().Info("reconnected with fresh credentials")
+	}
+	return refreshed
+}
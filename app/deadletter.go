@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deadLetterColumns returns the columns of the dead letter table: the
+// hook's own plus error_reason, filled with reason.
+func (hook *ClickHouseHook) deadLetterColumns(reason string) []column {
+	columns := append([]column(nil), hook.columns...)
+	return append(columns, column{name: "error_reason", typ: "String", value: func(*logrus.Entry) interface{} {
+		return reason
+	}})
+}
+
+// writeDeadLetter writes entries, as Transform leaves them, to
+// DeadLetterTable with err as the reason.
+func (hook *ClickHouseHook) writeDeadLetter(ctx context.Context, sink columnSink, entries []logrus.Entry, err error) error {
+	if hook.config.Transform != nil {
+		var transformErr error
+		if entries, transformErr = hook.transform(entries); transformErr != nil || len(entries) == 0 {
+			return transformErr
+		}
+	}
+	return sink.writeColumns(ctx, hook.config.DeadLetterTable, hook.deadLetterColumns(err.Error()), entries)
+}
+
+// deadLetter handles entries whose flush failed with err by writing them to
+// DeadLetterTable. If that fails too they go to OnRowError when set, or are
+// kept by fail otherwise.
+func (hook *ClickHouseHook) deadLetter(ctx context.Context, entries []logrus.Entry, err error) error {
+	deadErr := errors.New("clickhouse hook: sink does not support a dead letter table")
+	if sink, ok := hook.sink.(columnSink); ok {
+		deadErr = hook.writeDeadLetter(ctx, sink, entries, err)
+	}
+	if deadErr == nil {
+		hook.mu.Lock()
+		hook.recordFailure(err, 0)
+		hook.mu.Unlock()
+		hook.logLimited(hook.log().WithField("entries", len(entries)), logrus.WarnLevel, err,
+			"flush failed, wrote entries to the dead letter table")
+		return err
+	}
+
+	err = errors.Join(err, fmt.Errorf("clickhouse hook: writing to dead letter table: %w", deadErr))
+	if hook.config.OnRowError == nil {
+		return hook.fail(entries, err)
+	}
+	for _, entry := range entries {
+		hook.config.OnRowError(entry, err)
+	}
+	hook.mu.Lock()
+	hook.recordFailure(err, len(entries))
+	hook.mu.Unlock()
+	hook.logFailure(len(entries), len(entries), err)
+	hook.emitDropped(entries)
+	return lostEntries(err, len(entries))
+}
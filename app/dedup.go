@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// countKey is the entry.Context key of the number of identical entries a
+// deduplicated row stands for.
+type countKey struct{}
+
+// dedupCount returns how many entries entry stands for: 1 unless dedup
+// collapsed others into it.
+func dedupCount(entry *logrus.Entry) uint64 {
+	if entry.Context != nil {
+		if n, ok := entry.Context.Value(countKey{}).(uint64); ok {
+			return n
+		}
+	}
+	return 1
+}
+
+// dedup collapses entries with the same level, message and fields into the
+// first of them, whose count column then holds how many there were. Entries
+// are bucketed by an FNV-1a hash of those three, with fields hashed in key
+// order by their fmt.Sprint form; entries sharing a hash are compared in
+// full, so collisions never merge different entries. Order of first
+// appearance is kept.
+func dedup(entries []logrus.Entry) []logrus.Entry {
+	if len(entries) < 2 {
+		return entries
+	}
+
+	unique := make([]logrus.Entry, 0, len(entries))
+	counts := make([]uint64, 0, len(entries))
+	buckets := make(map[uint64][]int, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		hash := dedupHash(entry)
+		merged := false
+		for _, j := range buckets[hash] {
+			if sameEntry(&unique[j], entry) {
+				counts[j] += dedupCount(entry)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			buckets[hash] = append(buckets[hash], len(unique))
+			unique = append(unique, *entry)
+			counts = append(counts, dedupCount(entry))
+		}
+	}
+
+	for i := range unique {
+		if counts[i] == dedupCount(&unique[i]) {
+			continue
+		}
+		ctx := unique[i].Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		unique[i].Context = context.WithValue(ctx, countKey{}, counts[i])
+	}
+	return unique
+}
+
+// tokenKey is the context key of the deduplication token of a batch.
+type tokenKey struct{}
+
+// withBatchToken returns ctx carrying the deduplication token of entries: a
+// SHA-256 of their times, levels, messages and fields, so that every
+// attempt at inserting the same batch sends the same token.
+func withBatchToken(ctx context.Context, entries []logrus.Entry) context.Context {
+	h := sha256.New()
+	for i := range entries {
+		fmt.Fprintf(h, "%d\x00%d\x00%s\x00", entries[i].Time.UnixNano(), entries[i].Level, entries[i].Message)
+		for _, key := range sortedKeys(entries[i].Data) {
+			fmt.Fprintf(h, "%s=%v\x00", key, entries[i].Data[key])
+		}
+		fmt.Fprintf(h, "\x01")
+	}
+	return context.WithValue(ctx, tokenKey{}, hex.EncodeToString(h.Sum(nil)))
+}
+
+// batchToken returns the deduplication token carried by ctx, or "".
+func batchToken(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// dedupHash hashes the level, message and fields of entry.
+func dedupHash(entry *logrus.Entry) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00", entry.Level, entry.Message)
+	for _, key := range sortedKeys(entry.Data) {
+		fmt.Fprintf(h, "%s=%v\x00", key, entry.Data[key])
+	}
+	return h.Sum64()
+}
+
+// sameEntry reports whether a and b have the same level, message and
+// fields, comparing field values by their fmt.Sprint form.
+func sameEntry(a, b *logrus.Entry) bool {
+	if a.Level != b.Level || a.Message != b.Message || len(a.Data) != len(b.Data) {
+		return false
+	}
+	for key, value := range a.Data {
+		other, ok := b.Data[key]
+		if !ok || fmt.Sprint(value) != fmt.Sprint(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of fields in order.
+func sortedKeys(fields logrus.Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeduplicateWithinBatch(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithClock(clock), WithFlushInterval(time.Second), WithDeduplication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	retrying := func() *logrus.Entry {
+		entry := testEntry(logrus.WarnLevel, "retrying")
+		entry.Data["attempt"] = 1
+		return entry
+	}
+	for i := 0; i < 3; i++ {
+		if err := hook.Fire(retrying()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hook.Fire(testEntry(logrus.WarnLevel, "giving up")); err != nil {
+		t.Fatal(err)
+	}
+	advanceUntil(t, clock, time.Second, func() bool { return len(sink.Entries()) > 0 })
+	entries := sink.Entries()
+	if got, want := messagesOf(entries), []string{"retrying", "giving up"}; !slices.Equal(got, want) {
+		t.Fatalf("flushed %v, want %v", got, want)
+	}
+	if got := dedupCount(&entries[0]); got != 3 {
+		t.Errorf("count of the collapsed entry = %d, want 3", got)
+	}
+	if got := dedupCount(&entries[1]); got != 1 {
+		t.Errorf("count of the distinct entry = %d, want 1", got)
+	}
+
+	// The same entry in a later batch is outside the window and gets a
+	// row of its own.
+	if err := hook.Fire(retrying()); err != nil {
+		t.Fatal(err)
+	}
+	advanceUntil(t, clock, time.Second, func() bool { return len(sink.Entries()) > 2 })
+	entries = sink.Entries()
+	if len(entries) != 3 || entries[2].Message != "retrying" || dedupCount(&entries[2]) != 1 {
+		t.Fatalf("second batch flushed %v, want one retrying row with count 1", messagesOf(entries[2:]))
+	}
+}
+
+func TestDeduplicateKeepsHashCollisionsApart(t *testing.T) {
+	// Both hash as "a=b=c", sharing a bucket, but their fields differ.
+	a := logrus.Entry{Level: logrus.InfoLevel, Message: "m", Data: logrus.Fields{"a=b": "c"}}
+	b := logrus.Entry{Level: logrus.InfoLevel, Message: "m", Data: logrus.Fields{"a": "b=c"}}
+	if dedupHash(&a) != dedupHash(&b) {
+		t.Fatal("entries meant to collide hash differently")
+	}
+	entries := dedup([]logrus.Entry{a, b, a})
+	if len(entries) != 2 {
+		t.Fatalf("dedup returned %d entries, want 2", len(entries))
+	}
+	if _, ok := entries[0].Data["a=b"]; !ok || dedupCount(&entries[0]) != 2 {
+		t.Errorf("first entry %v with count %d, want a=b with count 2", entries[0].Data, dedupCount(&entries[0]))
+	}
+	if _, ok := entries[1].Data["a"]; !ok || dedupCount(&entries[1]) != 1 {
+		t.Errorf("second entry %v with count %d, want a with count 1", entries[1].Data, dedupCount(&entries[1]))
+	}
+}
+
+func TestDeduplicationTokenStableAcrossRetries(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		if len(queries) == 1 {
+			http.Error(w, "Code: 242. DB::Exception: Table is in readonly mode", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sink, err := newHTTPSink(server.URL, "logs", newTestHook(t).columns, settingsClause(map[string]string{"max_threads": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := NewHookWithSink(sink, 10, WithInsertDeduplicationToken(), WithRetries(1, time.Millisecond),
+		WithRetryable(func(error) bool { return true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, message := range []string{"one", "two"} {
+		hook.Fire(&logrus.Entry{Time: at, Level: logrus.InfoLevel, Message: message, Data: logrus.Fields{}})
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	hook.Fire(&logrus.Entry{Time: at, Level: logrus.InfoLevel, Message: "three", Data: logrus.Fields{}})
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queries) != 3 {
+		t.Fatalf("%d inserts, want a failed one, its retry and the next batch", len(queries))
+	}
+	token := regexp.MustCompile(` SETTINGS max_threads = 1, insert_deduplication_token = '([0-9a-f]{64})' FORMAT JSONEachRow$`)
+	var tokens []string
+	for _, query := range queries {
+		match := token.FindStringSubmatch(query)
+		if match == nil {
+			t.Fatalf("insert %q lacks the deduplication token", query)
+		}
+		tokens = append(tokens, match[1])
+	}
+	if tokens[0] != tokens[1] {
+		t.Errorf("retry sent token %s, want the first attempt's %s", tokens[1], tokens[0])
+	}
+	if tokens[2] == tokens[0] {
+		t.Error("a different batch sent the same token")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diagnosticField tags the hook's own diagnostic entries so that Fire can
+// ignore them if the diagnostic logger turns out to have the hook attached.
+const diagnosticField = "component"
+
+// diagnosticSource is the value of diagnosticField on diagnostic entries.
+// Fire matches on the type, so applications logging a component field
+// of their own are unaffected.
+type diagnosticSource struct{}
+
+func (diagnosticSource) String() string { return "clickhouse_hook" }
+
+// discardLogger is the default diagnostic logger. It drops everything.
+func discardLogger() logrus.FieldLogger {
+	return &logrus.Logger{
+		Out:       io.Discard,
+		Formatter: new(logrus.TextFormatter),
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.PanicLevel,
+	}
+}
+
+// log returns the diagnostic logger with the entries tagged as the hook's own.
+func (hook *ClickHouseHook) log() *logrus.Entry {
+	return hook.config.Logger.WithField(diagnosticField, diagnosticSource{})
+}
+
+// diagnosticWindow is how long repeats of a rate-limited diagnostic are
+// collapsed for.
+const diagnosticWindow = time.Minute
+
+// logLimited logs msg with err at level, but only once per
+// diagnosticWindow for the same message and error. The next one logged
+// after the window carries the number of repeats collapsed meanwhile, so an
+// outage produces one line a minute instead of one per flush.
+func (hook *ClickHouseHook) logLimited(diag *logrus.Entry, level logrus.Level, err error, msg string) {
+	key := msg
+	if err != nil {
+		key += "\x00" + err.Error()
+		diag = diag.WithError(err)
+	}
+	log, repeats := hook.limiter.allow(key, hook.config.Clock.Now())
+	if !log {
+		return
+	}
+	if repeats > 0 {
+		diag = diag.WithField("repeats", repeats)
+		msg = fmt.Sprintf("%s (%d more in the last %s)", msg, repeats, diagnosticWindow)
+	}
+	diag.Log(level, msg)
+}
+
+// logLimiter tracks rate-limited diagnostics by key.
+type logLimiter struct {
+	mu   sync.Mutex
+	seen map[string]*limitedMessage
+}
+
+// limitedMessage is the state of one rate-limited diagnostic.
+type limitedMessage struct {
+	logged  time.Time
+	repeats int
+}
+
+// allow reports whether the diagnostic key may be logged at now and, if so,
+// how many repeats were suppressed since it last was.
+func (l *logLimiter) allow(key string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen == nil {
+		l.seen = make(map[string]*limitedMessage)
+	}
+	for k, m := range l.seen {
+		if now.Sub(m.logged) >= diagnosticWindow && m.repeats == 0 {
+			delete(l.seen, k)
+		}
+	}
+
+	m, ok := l.seen[key]
+	if !ok {
+		l.seen[key] = &limitedMessage{logged: now}
+		return true, 0
+	}
+	if now.Sub(m.logged) < diagnosticWindow {
+		m.repeats++
+		return false, 0
+	}
+	repeats := m.repeats
+	m.logged, m.repeats = now, 0
+	return true, repeats
+}
+
+// isDiagnostic reports whether entry was emitted by a hook's diagnostic
+// logger.
+func isDiagnostic(entry *logrus.Entry) bool {
+	_, ok := entry.Data[diagnosticField].(diagnosticSource)
+	return ok
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	diskBufferFile = "buffer.jsonl"
+
+	// segmentPrefix and segmentSuffix frame the sequence number of rotated,
+	// gzip-compressed segments. Sequence numbers are zero padded so that
+	// name order is age order.
+	segmentPrefix = "buffer-"
+	segmentSuffix = ".jsonl.gz"
+)
+
+// diskBuffer is an append-only JSON lines file holding entries that could
+// not be inserted, so an extended outage doesn't exhaust the in-memory
+// buffer. Replayed entries keep their time, level, message and fields; the
+// caller and logger are not preserved. With rotation the file is compressed
+// into numbered segments as it fills up.
+type diskBuffer struct {
+	dir          string
+	path         string
+	maxBytes     int64
+	maxFileBytes int64
+	maxFiles     int
+
+	// mu serialises access to the files and guards seq, the number of the
+	// newest segment, and draining, set while drain replays records.
+	mu       sync.Mutex
+	seq      uint64
+	draining bool
+}
+
+// diskRecord is the on-disk form of an entry.
+type diskRecord struct {
+	Time    time.Time                  `json:"time"`
+	Level   string                     `json:"level"`
+	Message string                     `json:"message"`
+	Data    map[string]json.RawMessage `json:"data,omitempty"`
+}
+
+func newDiskBuffer(dir string, maxBytes, maxFileBytes int64, maxFiles int) (*diskBuffer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("clickhouse hook: creating disk buffer: %w", err)
+	}
+	b := &diskBuffer{
+		dir:          dir,
+		path:         filepath.Join(dir, diskBufferFile),
+		maxBytes:     maxBytes,
+		maxFileBytes: maxFileBytes,
+		maxFiles:     maxFiles,
+	}
+	segments, err := b.segments()
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse hook: reading disk buffer: %w", err)
+	}
+	if len(segments) > 0 {
+		last := filepath.Base(segments[len(segments)-1])
+		b.seq, _ = strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(last, segmentPrefix), segmentSuffix), 10, 64)
+	}
+	return b, nil
+}
+
+// append writes entries to the end of the file, then drops the oldest
+// records if it grew past maxBytes, or rotates it if it reached
+// maxFileBytes. It reports whether entries were written, and returns the
+// records dropped; an error with written set is one of trimming or
+// rotating. Both are put off while drain replays records, so the limits
+// may be exceeded until the next append after it.
+func (b *diskBuffer) append(entries []logrus.Entry) (dropped [][]byte, written bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var buf bytes.Buffer
+	for i := range entries {
+		line, err := encodeRecord(&entries[i])
+		if err != nil {
+			return nil, false, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if b.draining {
+		return nil, true, nil
+	}
+	dropped, err = b.trim()
+	if err != nil {
+		return dropped, true, err
+	}
+	pruned, err := b.rotate()
+	return append(dropped, pruned...), true, err
+}
+
+// empty reports whether there is nothing to replay.
+func (b *diskBuffer) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if segments, err := b.segments(); err != nil || len(segments) > 0 {
+		return false
+	}
+	info, err := os.Stat(b.path)
+	return errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0)
+}
+
+// rotate compresses the file into a new segment once it reaches
+// maxFileBytes, then deletes the oldest segments beyond maxFiles. It
+// returns the records deleted. Callers must hold b.mu.
+func (b *diskBuffer) rotate() ([][]byte, error) {
+	if b.maxFileBytes <= 0 {
+		return nil, nil
+	}
+	info, err := os.Stat(b.path)
+	if err != nil || info.Size() < b.maxFileBytes {
+		return nil, err
+	}
+
+	lines, err := b.readLines()
+	if err != nil {
+		return nil, err
+	}
+	segment := filepath.Join(b.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, b.seq+1, segmentSuffix))
+	if err := writeSegment(segment, lines); err != nil {
+		return nil, err
+	}
+	b.seq++
+	if err := b.writeLines(nil); err != nil {
+		return nil, err
+	}
+
+	if b.maxFiles <= 0 {
+		return nil, nil
+	}
+	segments, err := b.segments()
+	if err != nil {
+		return nil, err
+	}
+	var dropped [][]byte
+	for len(segments) > b.maxFiles {
+		if lines, err := readSegment(segments[0]); err == nil {
+			dropped = append(dropped, lines...)
+		}
+		if err := os.Remove(segments[0]); err != nil {
+			return dropped, err
+		}
+		segments = segments[1:]
+	}
+	return dropped, nil
+}
+
+// trim rewrites the file without its oldest records until it fits in
+// maxBytes, returning the records it removed. Callers must hold b.mu.
+func (b *diskBuffer) trim() ([][]byte, error) {
+	if b.maxBytes <= 0 {
+		return nil, nil
+	}
+	info, err := os.Stat(b.path)
+	if err != nil || info.Size() <= b.maxBytes {
+		return nil, err
+	}
+
+	lines, err := b.readLines()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	dropped := 0
+	for size > b.maxBytes && dropped < len(lines) {
+		size -= int64(len(lines[dropped]) + 1)
+		dropped++
+	}
+	return lines[:dropped], b.writeLines(lines[dropped:])
+}
+
+// drain replays buffered records oldest first through insert, batchSize at
+// a time: rotated segments in order, then the records the current file held
+// when drain got to it. Each file is rewritten without the batches that
+// were inserted if a later one fails. Records that fail to decode are
+// skipped. b.mu is only held while reading and rewriting files, so append
+// isn't blocked by the inserts; a drain started while another one runs
+// returns at once.
+func (b *diskBuffer) drain(batchSize int, insert func([]logrus.Entry) error) error {
+	b.mu.Lock()
+	if b.draining {
+		b.mu.Unlock()
+		return nil
+	}
+	b.draining = true
+	segments, err := b.segments()
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.draining = false
+		b.mu.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	// Only drain changes segments while it runs, as append doesn't rotate.
+	for _, segment := range segments {
+		lines, err := readSegment(segment)
+		if err != nil {
+			return err
+		}
+		if rest, err := replay(lines, batchSize, insert); err != nil {
+			if writeErr := writeSegment(segment, rest); writeErr != nil {
+				return errors.Join(err, writeErr)
+			}
+			return err
+		}
+		if err := os.Remove(segment); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	lines, err := b.readLines()
+	b.mu.Unlock()
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	rest, err := replay(lines, batchSize, insert)
+	inserted := len(lines) - len(rest)
+	if inserted == 0 {
+		return err
+	}
+
+	// append may have added records since, but not trimmed any, so the
+	// replayed ones are still the first in the file.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, readErr := b.readLines()
+	if readErr != nil {
+		return errors.Join(err, readErr)
+	}
+	if writeErr := b.writeLines(current[inserted:]); writeErr != nil {
+		return errors.Join(err, writeErr)
+	}
+	return err
+}
+
+// replay passes lines through insert batchSize at a time. If an insert
+// fails it returns the lines from that batch on along with the error.
+func replay(lines [][]byte, batchSize int, insert func([]logrus.Entry) error) ([][]byte, error) {
+	if batchSize <= 0 {
+		batchSize = len(lines)
+	}
+	for len(lines) > 0 {
+		n := batchSize
+		if n > len(lines) {
+			n = len(lines)
+		}
+		if entries := decodeRecords(lines[:n]); len(entries) > 0 {
+			if err := insert(entries); err != nil {
+				return lines, err
+			}
+		}
+		lines = lines[n:]
+	}
+	return nil, nil
+}
+
+// segments returns the paths of the rotated segments, oldest first.
+func (b *diskBuffer) segments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(b.dir, segmentPrefix+"*"+segmentSuffix))
+	sort.Strings(segments)
+	return segments, err
+}
+
+// readLines returns every record line in the file. Callers must hold b.mu.
+func (b *diskBuffer) readLines() ([][]byte, error) {
+	f, err := os.Open(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return scanLines(f)
+}
+
+// scanLines reads the non-empty lines of r.
+func scanLines(r io.Reader) ([][]byte, error) {
+	var lines [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readSegment returns every record line in a compressed segment.
+func readSegment(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return scanLines(gz)
+}
+
+// writeSegment atomically replaces the segment at path with lines,
+// compressed, removing it when there are none.
+func writeSegment(path string, lines [][]byte) error {
+	if len(lines) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		gz.Write(line)
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeLines atomically replaces the file with lines, removing it when there
+// are none. Callers must hold b.mu.
+func (b *diskBuffer) writeLines(lines [][]byte) error {
+	if len(lines) == 0 {
+		err := os.Remove(b.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func encodeRecord(entry *logrus.Entry) ([]byte, error) {
+	record := diskRecord{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	if len(entry.Data) > 0 {
+		record.Data = make(map[string]json.RawMessage, len(entry.Data))
+		for key, value := range entry.Data {
+			record.Data[key] = jsonValue(value)
+		}
+	}
+	return json.Marshal(record)
+}
+
+// decodeRecords decodes lines, skipping those that fail to decode.
+func decodeRecords(lines [][]byte) []logrus.Entry {
+	entries := make([]logrus.Entry, 0, len(lines))
+	for _, line := range lines {
+		if entry, err := decodeRecord(line); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func decodeRecord(line []byte) (logrus.Entry, error) {
+	var record diskRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return logrus.Entry{}, err
+	}
+	level, err := logrus.ParseLevel(record.Level)
+	if err != nil {
+		return logrus.Entry{}, err
+	}
+
+	data := make(logrus.Fields, len(record.Data))
+	for key, raw := range record.Data {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		data[key] = value
+	}
+	return logrus.Entry{Time: record.Time, Level: level, Message: record.Message, Data: data}, nil
+}
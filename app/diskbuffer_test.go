@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// numberedEntries returns n entries numbered from first on.
+func numberedEntries(first, n int) []logrus.Entry {
+	entries := make([]logrus.Entry, n)
+	for i := range entries {
+		entries[i] = logrus.Entry{Level: logrus.InfoLevel, Message: fmt.Sprintf("entry %03d", first+i)}
+	}
+	return entries
+}
+
+func messagesOf(entries []logrus.Entry) []string {
+	messages := make([]string, len(entries))
+	for i := range entries {
+		messages[i] = entries[i].Message
+	}
+	return messages
+}
+
+func TestDiskBufferKeepsRestOfFailedReplay(t *testing.T) {
+	b, err := newDiskBuffer(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		b.append(numberedEntries(i*5, 5))
+	}
+
+	var replayed []string
+	calls := 0
+	err = b.drain(4, func(entries []logrus.Entry) error {
+		if calls++; calls == 3 {
+			return errors.New("server down")
+		}
+		replayed = append(replayed, messagesOf(entries)...)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("drain with a failing insert returned nil")
+	}
+	if err := b.drain(4, func(entries []logrus.Entry) error {
+		replayed = append(replayed, messagesOf(entries)...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := messagesOf(numberedEntries(0, 30)); !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v, want each entry once in order %v", replayed, want)
+	}
+}
+
+func TestDiskBufferAppendDuringDrain(t *testing.T) {
+	b, err := newDiskBuffer(t.TempDir(), 150, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.append(numberedEntries(0, 1))
+
+	var replayed []string
+	insert := func(entries []logrus.Entry) error {
+		replayed = append(replayed, messagesOf(entries)...)
+		return nil
+	}
+	if err := b.drain(10, func(entries []logrus.Entry) error {
+		// Blocks forever if drain holds b.mu while inserting. The records
+		// exceed maxBytes, but trimming waits for the drain.
+		if dropped, written, err := b.append(numberedEntries(1, 3)); !written || err != nil || len(dropped) > 0 {
+			t.Errorf("append during drain: written %v, %d dropped, %v", written, len(dropped), err)
+		}
+		if err := b.drain(10, insert); err != nil {
+			t.Errorf("nested drain: %v", err)
+		}
+		return insert(entries)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"entry 000"}; !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v during the first drain, want %v", replayed, want)
+	}
+
+	replayed = nil
+	if err := b.drain(10, insert); err != nil {
+		t.Fatal(err)
+	}
+	if want := messagesOf(numberedEntries(1, 3)); !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v afterwards, want %v", replayed, want)
+	}
+}
+
+func TestDiskBufferAppendReportsTrimmedRecords(t *testing.T) {
+	b, err := newDiskBuffer(t.TempDir(), 100, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped, written, err := b.append(numberedEntries(0, 5))
+	if !written || err != nil {
+		t.Fatalf("append: written %v, %v", written, err)
+	}
+	if len(dropped) == 0 {
+		t.Fatal("no records dropped from a file past maxBytes")
+	}
+	if got := decodeRecords(dropped)[0].Message; got != "entry 000" {
+		t.Fatalf("first dropped record is %q, want the oldest", got)
+	}
+}
+
+func TestFlusherReplaysDiskBufferWhenIdle(t *testing.T) {
+	dir := t.TempDir()
+	spill, err := newDiskBuffer(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spill.append(numberedEntries(0, 3))
+
+	// A new process with nothing to log still replays the earlier spill.
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithClock(clock), WithFlushInterval(time.Second), WithDiskBuffer(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return len(sink.Entries()) == 3 })
+	if _, err := os.Stat(filepath.Join(dir, diskBufferFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("disk buffer file after the replay: %v", err)
+	}
+}
+
+func TestDiskBufferReplaysRotatedSegmentsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	b, err := newDiskBuffer(dir, 0, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, written, err := b.append(numberedEntries(i*5, 5)); !written || err != nil {
+			t.Fatalf("append: written %v, %v", written, err)
+		}
+	}
+	segments, err := b.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("%d segments after appending past the file size, want several", len(segments))
+	}
+
+	// A buffer reopened by a new process continues the numbering.
+	b, err = newDiskBuffer(dir, 0, 256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.append(numberedEntries(50, 5))
+
+	var replayed []string
+	if err := b.drain(4, func(entries []logrus.Entry) error {
+		replayed = append(replayed, messagesOf(entries)...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := messagesOf(numberedEntries(0, 55)); !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v, want %v", replayed, want)
+	}
+	if !b.empty() {
+		left, _ := filepath.Glob(filepath.Join(dir, "*"))
+		t.Fatalf("files left after a complete replay: %v", left)
+	}
+}
+
+// recordSize returns the bytes a numberedEntries entry takes in the file.
+func recordSize(t *testing.T) int64 {
+	t.Helper()
+	line, err := encodeRecord(&numberedEntries(0, 1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line) + 1)
+}
+
+// segmentMessages returns the messages of the records in each segment of b.
+func segmentMessages(t *testing.T, b *diskBuffer) [][]string {
+	t.Helper()
+	segments, err := b.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([][]string, len(segments))
+	for i, segment := range segments {
+		lines, err := readSegment(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[i] = messagesOf(decodeRecords(lines))
+	}
+	return messages
+}
+
+func TestDiskBufferRotatesAtMaxFileBytes(t *testing.T) {
+	b, err := newDiskBuffer(t.TempDir(), 0, 3*recordSize(t), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.append(numberedEntries(0, 2))
+	if got := segmentMessages(t, b); len(got) != 0 {
+		t.Fatalf("segments %v below maxFileBytes, want none", got)
+	}
+	if dropped, _, err := b.append(numberedEntries(2, 1)); err != nil || len(dropped) > 0 {
+		t.Fatalf("append reaching maxFileBytes: %d dropped, %v", len(dropped), err)
+	}
+	if got, want := segmentMessages(t, b), [][]string{messagesOf(numberedEntries(0, 3))}; !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("segments %v, want %v", got, want)
+	}
+	if lines, err := b.readLines(); err != nil || len(lines) > 0 {
+		t.Fatalf("%d records left in the current file after rotating, %v", len(lines), err)
+	}
+
+	// A third segment is one more than maxFiles, so the first is deleted.
+	b.append(numberedEntries(3, 3))
+	dropped, _, err := b.append(numberedEntries(6, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messagesOf(decodeRecords(dropped)), messagesOf(numberedEntries(0, 3)); !slices.Equal(got, want) {
+		t.Fatalf("dropped %v beyond maxFiles, want the oldest segment %v", got, want)
+	}
+	if got, want := segmentMessages(t, b), [][]string{messagesOf(numberedEntries(3, 3)), messagesOf(numberedEntries(6, 3))}; !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("segments %v, want %v", got, want)
+	}
+}
+
+func TestDiskBufferTrimsAtMaxBytes(t *testing.T) {
+	size := recordSize(t)
+	b, err := newDiskBuffer(t.TempDir(), 3*size+size/2, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped, _, err := b.append(numberedEntries(0, 3)); err != nil || len(dropped) > 0 {
+		t.Fatalf("append within maxBytes: %d dropped, %v", len(dropped), err)
+	}
+	dropped, _, err := b.append(numberedEntries(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messagesOf(decodeRecords(dropped)), messagesOf(numberedEntries(0, 2)); !slices.Equal(got, want) {
+		t.Fatalf("dropped %v, want the oldest %v", got, want)
+	}
+	info, err := os.Stat(b.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 3*size {
+		t.Fatalf("file of %d bytes after trimming, want the %d of 3 records", info.Size(), 3*size)
+	}
+	lines, err := b.readLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messagesOf(decodeRecords(lines)), messagesOf(numberedEntries(2, 3)); !slices.Equal(got, want) {
+		t.Fatalf("file holds %v, want the newest %v", got, want)
+	}
+}
+
+func TestDiskBufferReplayFailsInsideSecondSegment(t *testing.T) {
+	b, err := newDiskBuffer(t.TempDir(), 0, 3*recordSize(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 11; i++ {
+		b.append(numberedEntries(i, 1))
+	}
+	if got := len(segmentMessages(t, b)); got != 3 {
+		t.Fatalf("%d segments, want 3", got)
+	}
+
+	// Batches of 2 split each segment of 3 into [0 1] [2], [3 4] [5], ...;
+	// the insert of entry 005 fails.
+	var replayed []string
+	insert := func(entries []logrus.Entry) error {
+		replayed = append(replayed, messagesOf(entries)...)
+		return nil
+	}
+	err = b.drain(2, func(entries []logrus.Entry) error {
+		if entries[0].Message == "entry 005" {
+			return errors.New("server down")
+		}
+		return insert(entries)
+	})
+	if err == nil {
+		t.Fatal("drain with a failing insert returned nil")
+	}
+	if want := messagesOf(numberedEntries(0, 5)); !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v before the failure, want %v", replayed, want)
+	}
+	want := [][]string{messagesOf(numberedEntries(5, 1)), messagesOf(numberedEntries(6, 3))}
+	if got := segmentMessages(t, b); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("segments %v after the failure, want %v", got, want)
+	}
+
+	if err := b.drain(2, insert); err != nil {
+		t.Fatal(err)
+	}
+	if want := messagesOf(numberedEntries(0, 11)); !slices.Equal(replayed, want) {
+		t.Fatalf("replayed %v, want each entry once in order %v", replayed, want)
+	}
+	if !b.empty() {
+		t.Fatal("records left after a complete replay")
+	}
+}
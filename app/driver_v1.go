@@ -0,0 +1,69 @@
+//go:build !clickhouse_v2
+
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/sirupsen/logrus"
+)
+
+// openDB opens dsn with the v1 clickhouse-go driver. Build with the
+// clickhouse_v2 tag to use the v2 driver instead.
+func openDB(dsn string) (*sql.DB, error) {
+	return sql.Open("clickhouse", dsn)
+}
+
+// databaseInPath reports whether the driver reads the database from the DSN
+// path; v1 takes it from the database query parameter.
+const databaseInPath = false
+
+// multiValuesQuery returns the statement of FlushStrategyMultiValues for
+// entries and the arguments to run it with. v1 runs every statement that
+// starts with INSERT INTO in batch mode, which takes its rows from Exec
+// calls, and its client-side binding can't format arrays or maps, so the
+// rows are written into the query as literals, behind a comment.
+func multiValuesQuery(query string, columns []column, entries []logrus.Entry) (string, []interface{}, error) {
+	literals, err := literalValuesQuery(query, columns, entries)
+	if err != nil {
+		return "", nil, err
+	}
+	return "/* multi-values */ " + literals, nil, nil
+}
+
+// supportsNativeBatch reports whether the driver has a native batch API
+// for FlushStrategyBatch; v1 only batches through database/sql.
+const supportsNativeBatch = false
+
+// openBatchConn fails, v1 having no native batch API.
+func openBatchConn(dsn string, config Config) (batchConn, error) {
+	return nil, errors.New("clickhouse hook: FlushStrategyBatch requires the clickhouse_v2 build")
+}
+
+// registerTLSConfig makes config available to DSNs as tls_config=<key>.
+func registerTLSConfig(config *tls.Config) (string, error) {
+	key := nextTLSKey()
+	return key, clickhouse.RegisterTLSConfig(key, config)
+}
+
+// exceptionDetails returns the details of a ClickHouse exception carried by
+// err.
+func exceptionDetails(err error) (exception, bool) {
+	var e *clickhouse.Exception
+	if !errors.As(err, &e) {
+		return exception{}, false
+	}
+	return exception{code: e.Code, name: e.Name, message: e.Message, stack: e.StackTrace}, true
+}
+
+// exceptionCode returns the code of a ClickHouse exception carried by err.
+func exceptionCode(err error) (int32, bool) {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return 0, false
+	}
+	return exception.Code, true
+}
@@ -0,0 +1,66 @@
+//go:build !clickhouse_v2
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/binary"
+	chcolumn "github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+)
+
+// fakeException returns the driver's exception error for a server error.
+func fakeException(code int32, name, message, stack string) error {
+	return &clickhouse.Exception{Code: code, Name: name, Message: message, StackTrace: stack}
+}
+
+// driverInsertType returns the type the server describes a column of type
+// typ as in an insert block: the driver's protocol revision predates
+// LowCardinality, so the server sends the column it wraps.
+func driverInsertType(typ string) string {
+	if inner, ok := strings.CutPrefix(typ, "LowCardinality("); ok {
+		return strings.TrimSuffix(inner, ")")
+	}
+	return typ
+}
+
+// driverRoundTrip writes value as a column of type typ in a block, as the
+// driver sends inserts, and returns the value it reads back.
+func driverRoundTrip(t *testing.T, typ string, value interface{}) interface{} {
+	t.Helper()
+	col, err := chcolumn.Factory("value", typ, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := &data.Block{Columns: []chcolumn.Column{col}, NumColumns: 1}
+	if err := written.AppendRow([]driver.Value{value}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := written.Write(&data.ServerInfo{}, binary.NewEncoder(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	var read data.Block
+	if err := read.Read(&data.ServerInfo{Timezone: time.UTC}, binary.NewDecoder(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	return read.Values[0][0]
+}
+
+// driverAppend returns the error of the driver encoding value as a column
+// of type typ, if any.
+func driverAppend(t *testing.T, typ string, value interface{}) error {
+	t.Helper()
+	col, err := chcolumn.Factory("value", typ, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &data.Block{Columns: []chcolumn.Column{col}, NumColumns: 1}
+	return block.AppendRow([]driver.Value{value})
+}
@@ -0,0 +1,170 @@
+//go:build clickhouse_v2
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/sirupsen/logrus"
+)
+
+// databaseInPath reports whether the driver reads the database from the DSN
+// path; v2 treats unknown query parameters as server settings.
+const databaseInPath = true
+
+// multiValuesQuery returns the statement of FlushStrategyMultiValues for
+// entries and the arguments to run it with: query with its VALUES clause
+// extended by a tuple of placeholders for every row after the first, which
+// v2 binds.
+func multiValuesQuery(query string, columns []column, entries []logrus.Entry) (string, []interface{}, error) {
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	var b strings.Builder
+	b.Grow(len(query) + (len(entries)-1)*(len(tuple)+2))
+	b.WriteString(query)
+	for i := 1; i < len(entries); i++ {
+		b.WriteString(", ")
+		b.WriteString(tuple)
+	}
+
+	args := make([]interface{}, 0, len(entries)*len(columns))
+	for i := range entries {
+		for _, col := range columns {
+			args = append(args, col.value(&entries[i]))
+		}
+	}
+	return b.String(), args, nil
+}
+
+// supportsNativeBatch reports whether the driver has a native batch API
+// for FlushStrategyBatch.
+const supportsNativeBatch = true
+
+// tlsConfigs holds the configs registered by registerTLSConfig, since v2 has
+// no registry of its own.
+var tlsConfigs sync.Map
+
+// registerTLSConfig makes config available to DSNs as tls_config=<key>.
+func registerTLSConfig(config *tls.Config) (string, error) {
+	key := nextTLSKey()
+	tlsConfigs.Store(key, config)
+	return key, nil
+}
+
+// openDB opens dsn with the v2 clickhouse-go driver over its native protocol.
+// The v1 tcp:// DSN format is accepted, as are clickhouse:// and http(s)://.
+func openDB(dsn string) (*sql.DB, error) {
+	options, err := parseOptions(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return clickhouse.OpenDB(options), nil
+}
+
+// openBatchConn opens a native connection to dsn for FlushStrategyBatch,
+// with the configured pool settings.
+func openBatchConn(dsn string, config Config) (batchConn, error) {
+	options, err := parseOptions(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxOpenConns > 0 {
+		options.MaxOpenConns = config.MaxOpenConns
+	}
+	if config.MaxIdleConns > 0 {
+		options.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.ConnMaxLifetime > 0 {
+		options.ConnMaxLifetime = config.ConnMaxLifetime
+	}
+	conn, err := clickhouse.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	return nativeBatch{conn}, nil
+}
+
+// parseOptions parses dsn as openDB accepts it.
+func parseOptions(dsn string) (*clickhouse.Options, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	query := parsed.Query()
+	key := query.Get("tls_config")
+	query.Del("tls_config")
+	parsed.RawQuery = query.Encode()
+
+	options, err := clickhouse.ParseDSN(parsed.String())
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		config, ok := tlsConfigs.Load(key)
+		if !ok {
+			return nil, fmt.Errorf("clickhouse hook: no TLS config registered as %q", key)
+		}
+		options.TLS = config.(*tls.Config)
+	}
+	return options, nil
+}
+
+// nativeBatch is the batchConn of the v2 driver.
+type nativeBatch struct {
+	conn driver.Conn
+}
+
+func (b nativeBatch) send(ctx context.Context, query string, n int, row func(i int) []interface{}) (int, error) {
+	batch, err := b.conn.PrepareBatch(ctx, query)
+	if err != nil {
+		return -1, &FlushError{Stage: StagePrepare, Err: err}
+	}
+	// Abort also releases the connection when a column value panics.
+	sent := false
+	defer func() {
+		if !sent {
+			batch.Abort()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if err := batch.Append(row(i)...); err != nil {
+			return i, &FlushError{Stage: StageExec, Err: err}
+		}
+	}
+	sent = true
+	if err := batch.Send(); err != nil {
+		return -1, &FlushError{Stage: StageCommit, Err: err}
+	}
+	return -1, nil
+}
+
+func (b nativeBatch) Close() error {
+	return b.conn.Close()
+}
+
+// exceptionDetails returns the details of a ClickHouse exception carried by
+// err.
+func exceptionDetails(err error) (exception, bool) {
+	var e *clickhouse.Exception
+	if !errors.As(err, &e) {
+		return exception{}, false
+	}
+	return exception{code: e.Code, name: e.Name, message: e.Message, stack: e.StackTrace}, true
+}
+
+// exceptionCode returns the code of a ClickHouse exception carried by err.
+func exceptionCode(err error) (int32, bool) {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return 0, false
+	}
+	return exception.Code, true
+}
@@ -0,0 +1,58 @@
+//go:build clickhouse_v2
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	chcolumn "github.com/ClickHouse/clickhouse-go/v2/lib/column"
+)
+
+// fakeException returns the driver's exception error for a server error.
+func fakeException(code int32, name, message, stack string) error {
+	return &clickhouse.Exception{Code: code, Name: name, Message: message, StackTrace: stack}
+}
+
+// driverInsertType returns the type the server describes a column of type
+// typ as in an insert block, which for this driver is typ itself.
+func driverInsertType(typ string) string {
+	return typ
+}
+
+// driverRoundTrip encodes value as a column of type typ with the driver's
+// encoding and returns the value it decodes.
+func driverRoundTrip(t *testing.T, typ string, value interface{}) interface{} {
+	t.Helper()
+	written, err := chcolumn.Type(typ).Column("event_time", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := written.AppendRow(value); err != nil {
+		t.Fatal(err)
+	}
+	var buf proto.Buffer
+	written.Encode(&buf)
+	read, err := chcolumn.Type(typ).Column("event_time", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read.Decode(proto.NewReader(bytes.NewReader(buf.Buf)), 1); err != nil {
+		t.Fatal(err)
+	}
+	return read.Row(0, false)
+}
+
+// driverAppend returns the error of the driver encoding value as a column
+// of type typ, if any.
+func driverAppend(t *testing.T, typ string, value interface{}) error {
+	t.Helper()
+	col, err := chcolumn.Type(typ).Column("value", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return col.AppendRow(value)
+}
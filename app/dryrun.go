@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dryRunSink logs the INSERT each batch would run, and the arguments of
+// every row, to the diagnostic logger instead of executing it.
+type dryRunSink struct {
+	log      logrus.FieldLogger
+	table    string
+	columns  []column
+	settings string
+
+	// query and args, when set, are CustomInsert and CustomInsertArgs.
+	query string
+	args  func(entry *logrus.Entry) []interface{}
+}
+
+// newDryRunHook builds a hook for config that never connects to ClickHouse.
+func newDryRunHook(config Config) (*ClickHouseHook, error) {
+	hook, err := newHook(config)
+	if err != nil {
+		return nil, err
+	}
+	hook.sink = &dryRunSink{
+		log:      hook.log(),
+		table:    config.insertTable(),
+		columns:  hook.columns,
+		settings: settingsClause(config.QuerySettings),
+		query:    config.CustomInsert,
+		args:     config.CustomInsertArgs,
+	}
+	if err := hook.start(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// WriteBatch logs the insert into the sink's table.
+func (s *dryRunSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	return s.WriteTable(ctx, s.table, entries)
+}
+
+// WriteTable logs the insert into table.
+func (s *dryRunSink) WriteTable(ctx context.Context, table string, entries []logrus.Entry) error {
+	query := s.query
+	if query == "" {
+		query = insertQuery(table, s.columns, batchSettings(ctx, s.settings))
+	}
+	s.log.WithField("rows", len(entries)).Info(query)
+	for i := range entries {
+		var args []interface{}
+		if s.args != nil {
+			args = s.args(&entries[i])
+		}
+		for _, col := range s.columns {
+			args = append(args, col.value(&entries[i]))
+		}
+		s.log.WithField("args", args).Info("dry run row")
+	}
+	return nil
+}
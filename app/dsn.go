@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultPort       = 9000
+	defaultSecurePort = 9440
+)
+
+// DSNBuilder assembles a native protocol DSN for the configured driver, so
+// credentials are escaped correctly and TLS is set up without hand-editing
+// query parameters.
+type DSNBuilder struct {
+	Host string
+	// Port defaults to 9000, or 9440 when TLSConfig is set.
+	Port     int
+	Database string
+	Username string
+	Password string
+
+	// TLSConfig enables a secure connection. Its InsecureSkipVerify field
+	// maps to the driver's skip_verify parameter.
+	TLSConfig *tls.Config
+
+	// Params are extra DSN query parameters, such as debug or compress.
+	Params map[string]string
+}
+
+var tlsConfigKeys atomic.Uint64
+
+// setDSNParam returns dsn with its query parameter key set to value.
+func setDSNParam(dsn, key, value string) (string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", fmt.Errorf("clickhouse hook: parsing DSN: %w", err)
+	}
+	params := parsed.Query()
+	params.Set(key, value)
+	parsed.RawQuery = params.Encode()
+	return parsed.String(), nil
+}
+
+// withCredentials returns dsn with the username and password read from
+// UsernameFile and PasswordFile, when set, or returned by
+// CredentialProvider, in its query parameters. User info in the DSN is
+// moved to the parameters too, as it would otherwise take precedence.
+// Errors never quote the DSN, the file contents or the credentials.
+func withCredentials(dsn string, config Config) (string, error) {
+	if config.UsernameFile == "" && config.PasswordFile == "" && config.CredentialProvider == nil {
+		return dsn, nil
+	}
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", errors.New("clickhouse hook: parsing DSN failed")
+	}
+	params := parsed.Query()
+	if parsed.User != nil {
+		params.Set("username", parsed.User.Username())
+		if password, ok := parsed.User.Password(); ok {
+			params.Set("password", password)
+		}
+		parsed.User = nil
+	}
+	for _, credential := range []struct{ param, file string }{
+		{"username", config.UsernameFile},
+		{"password", config.PasswordFile},
+	} {
+		if credential.file == "" {
+			continue
+		}
+		contents, err := os.ReadFile(credential.file)
+		if err != nil {
+			return "", fmt.Errorf("clickhouse hook: reading %s file: %w", credential.param, err)
+		}
+		params.Set(credential.param, strings.TrimRight(string(contents), "\r\n"))
+	}
+	if config.CredentialProvider != nil {
+		username, password, err := config.CredentialProvider()
+		if err != nil {
+			return "", fmt.Errorf("clickhouse hook: getting credentials: %w", err)
+		}
+		params.Set("username", username)
+		params.Set("password", password)
+	}
+	parsed.RawQuery = params.Encode()
+	return parsed.String(), nil
+}
+
+// nextTLSKey returns a unique name to register a tls.Config under.
+func nextTLSKey() string {
+	return "clickhouse-hook-" + strconv.FormatUint(tlsConfigKeys.Add(1), 10)
+}
+
+// DSN returns the DSN described by b. Each call with a TLSConfig registers
+// it with the driver, so build the DSN once and reuse it.
+func (b DSNBuilder) DSN() (string, error) {
+	if b.Host == "" {
+		return "", fmt.Errorf("clickhouse hook: DSN needs a host")
+	}
+	port := b.Port
+	if port == 0 {
+		port = defaultPort
+		if b.TLSConfig != nil {
+			port = defaultSecurePort
+		}
+	}
+
+	dsn := url.URL{Scheme: "tcp", Host: net.JoinHostPort(b.Host, strconv.Itoa(port))}
+	query := url.Values{}
+	for key, value := range b.Params {
+		query.Set(key, value)
+	}
+	if b.Database != "" {
+		if databaseInPath {
+			dsn.Path = "/" + b.Database
+		} else {
+			query.Set("database", b.Database)
+		}
+	}
+	if b.Username != "" {
+		query.Set("username", b.Username)
+	}
+	if b.Password != "" {
+		query.Set("password", b.Password)
+	}
+	if b.TLSConfig != nil {
+		key, err := registerTLSConfig(b.TLSConfig)
+		if err != nil {
+			return "", err
+		}
+		query.Set("secure", "true")
+		query.Set("tls_config", key)
+		if b.TLSConfig.InsecureSkipVerify {
+			query.Set("skip_verify", "true")
+		}
+	}
+	dsn.RawQuery = query.Encode()
+	return dsn.String(), nil
+}
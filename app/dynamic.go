@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDynamicConfigInterval is how often DynamicConfigTable is read when
+// DynamicConfigInterval isn't set.
+const defaultDynamicConfigInterval = time.Minute
+
+// unknownTableCode is ClickHouse's UNKNOWN_TABLE error code.
+const unknownTableCode = 60
+
+// dynamicConfig is what one read of DynamicConfigTable changes. Zero values
+// and nil maps leave the setting as it is.
+type dynamicConfig struct {
+	batchSize     int
+	flushInterval time.Duration
+	sampleRate    map[logrus.Level]float64
+}
+
+// runConfigPoller reads DynamicConfigTable on start and on every tick of
+// ticker, until Stop is called.
+func (hook *ClickHouseHook) runConfigPoller(ticker Ticker) {
+	defer hook.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		hook.pollConfig()
+		select {
+		case <-ticker.C():
+		case <-hook.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollConfig reads DynamicConfigTable and applies what it sets. A missing
+// table is reported at Debug and leaves the configuration as it is.
+func (hook *ClickHouseHook) pollConfig() {
+	ctx, cancel := context.WithTimeout(hook.ctx, hook.config.DynamicConfigInterval)
+	defer cancel()
+
+	var rows map[string]string
+	err := hook.withSchemaDB(func(db *sql.DB) error {
+		var err error
+		rows, err = readConfigTable(ctx, db, hook.config.DynamicConfigTable)
+		return err
+	})
+	diag := hook.log().WithField("table", hook.config.DynamicConfigTable)
+	if err != nil {
+		if code, ok := errorCode(err); ok && code == unknownTableCode {
+			hook.logLimited(diag, logrus.DebugLevel, nil, "dynamic config table doesn't exist, keeping the configuration")
+			return
+		}
+		hook.logLimited(diag, logrus.WarnLevel, err, "reading dynamic config failed")
+		return
+	}
+	hook.applyConfig(hook.parseConfig(diag, rows))
+}
+
+// readConfigTable returns the name and value columns of the rows of table.
+func readConfigTable(ctx context.Context, db *sql.DB, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT name, toString(value) FROM %s", quoteTable(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		settings[name] = value
+	}
+	return settings, rows.Err()
+}
+
+// parseConfig parses the rows of DynamicConfigTable, reporting and skipping
+// those with an unknown name or an invalid value.
+func (hook *ClickHouseHook) parseConfig(diag *logrus.Entry, rows map[string]string) dynamicConfig {
+	var parsed dynamicConfig
+	for name, value := range rows {
+		var err error
+		switch {
+		case name == "batch_size":
+			parsed.batchSize, err = strconv.Atoi(value)
+			if err == nil && parsed.batchSize <= 0 {
+				err = fmt.Errorf("batch size %d isn't positive", parsed.batchSize)
+			}
+		case name == "flush_interval":
+			parsed.flushInterval, err = time.ParseDuration(value)
+			if err == nil && parsed.flushInterval <= 0 {
+				err = fmt.Errorf("flush interval %s isn't positive", parsed.flushInterval)
+			}
+		case strings.HasPrefix(name, "sample_rate."):
+			var level logrus.Level
+			var rate float64
+			if level, err = logrus.ParseLevel(strings.TrimPrefix(name, "sample_rate.")); err != nil {
+				break
+			}
+			if rate, err = strconv.ParseFloat(value, 64); err == nil && (rate < 0 || rate > 1) {
+				err = fmt.Errorf("sample rate %v out of range 0-1", rate)
+			}
+			if err == nil {
+				if parsed.sampleRate == nil {
+					parsed.sampleRate = make(map[logrus.Level]float64)
+				}
+				parsed.sampleRate[level] = rate
+			}
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			hook.logLimited(diag.WithFields(logrus.Fields{"setting": name, "value": value}), logrus.WarnLevel, err,
+				"invalid dynamic config setting "+name+", skipping it")
+		}
+	}
+	return parsed
+}
+
+// applyConfig applies parsed under hook.mu. A new flush interval only
+// takes effect on hooks started with one.
+func (hook *ClickHouseHook) applyConfig(parsed dynamicConfig) {
+	hook.mu.Lock()
+	if parsed.batchSize > 0 {
+		hook.config.BatchSize = parsed.batchSize
+	}
+	if parsed.sampleRate != nil {
+		rates := maps.Clone(hook.config.SampleRate)
+		if rates == nil {
+			rates = make(map[logrus.Level]float64, len(parsed.sampleRate))
+		}
+		maps.Copy(rates, parsed.sampleRate)
+		hook.config.SampleRate = rates
+	}
+	retick := parsed.flushInterval > 0 && parsed.flushInterval != hook.config.FlushInterval && hook.intervals != nil
+	if retick {
+		hook.config.FlushInterval = parsed.flushInterval
+	}
+	hook.mu.Unlock()
+
+	if retick {
+		// Replace an interval the flusher hasn't picked up yet.
+		select {
+		case <-hook.intervals:
+		default:
+		}
+		hook.intervals <- parsed.flushInterval
+	}
+}
+
+// currentConfig returns a copy of the configuration, for use without
+// hook.mu while DynamicConfigTable may change it.
+func (hook *ClickHouseHook) currentConfig() Config {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	return hook.config
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultEnvBatchSize is the batch size used when CLICKHOUSE_BATCH_SIZE is
+// unset.
+const defaultEnvBatchSize = 100
+
+// NewClickHouseHookFromEnv builds a hook configured by environment
+// variables, with opts applied on top:
+//
+//	CLICKHOUSE_DSN              server DSN (required)
+//	CLICKHOUSE_BATCH_SIZE       entries per batch (default 100)
+//	CLICKHOUSE_TABLE            target table (default tiered_logs)
+//	CLICKHOUSE_FLUSH_INTERVAL   flush timer, e.g. 5s (default off)
+//	CLICKHOUSE_FLUSH_TIMEOUT    bound on each flush (default none)
+//	CLICKHOUSE_MAX_RETRIES      retries per failed insert (default 0)
+//	CLICKHOUSE_RETRY_DELAY      first retry backoff (default 100ms)
+//	CLICKHOUSE_MAX_BUFFER_SIZE  entries kept after failures (default no cap)
+//	CLICKHOUSE_INCLUDE_FIELDS   write entry fields, true or false
+//
+// Every missing or malformed variable is listed in the returned error.
+func NewClickHouseHookFromEnv(opts ...Option) (*ClickHouseHook, error) {
+	dsn, config, err := configFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewClickHouseHookWithConfig(dsn, config, opts...)
+}
+
+// configFromEnv reads the variables documented on NewClickHouseHookFromEnv.
+func configFromEnv() (string, Config, error) {
+	var problems []string
+	config := Config{
+		BatchSize: defaultEnvBatchSize,
+		TableName: os.Getenv("CLICKHOUSE_TABLE"),
+	}
+
+	dsn := os.Getenv("CLICKHOUSE_DSN")
+	if dsn == "" {
+		problems = append(problems, "CLICKHOUSE_DSN is not set")
+	}
+
+	ints := []struct {
+		name   string
+		target *int
+		min    int
+	}{
+		{"CLICKHOUSE_BATCH_SIZE", &config.BatchSize, 1},
+		{"CLICKHOUSE_MAX_RETRIES", &config.MaxRetries, 0},
+		{"CLICKHOUSE_MAX_BUFFER_SIZE", &config.MaxBufferSize, 0},
+	}
+	for _, v := range ints {
+		value, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < v.min {
+			problems = append(problems, fmt.Sprintf("%s=%q is not an integer >= %d", v.name, value, v.min))
+			continue
+		}
+		*v.target = n
+	}
+
+	durations := []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"CLICKHOUSE_FLUSH_INTERVAL", &config.FlushInterval},
+		{"CLICKHOUSE_FLUSH_TIMEOUT", &config.FlushTimeout},
+		{"CLICKHOUSE_RETRY_DELAY", &config.RetryDelay},
+	}
+	for _, v := range durations {
+		value, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("%s=%q is not a duration", v.name, value))
+			continue
+		}
+		*v.target = d
+	}
+
+	if value, ok := os.LookupEnv("CLICKHOUSE_INCLUDE_FIELDS"); ok {
+		include, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("CLICKHOUSE_INCLUDE_FIELDS=%q is not a boolean", value))
+		}
+		config.IncludeFields = include
+	}
+
+	if len(problems) > 0 {
+		return "", config, fmt.Errorf("clickhouse hook: environment: %s", strings.Join(problems, "; "))
+	}
+	return dsn, config, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotConnected is the error of flushes and pings on a hook without a
+// sink, or after Close. The entries of such a flush are kept as for any
+// failed one.
+var ErrNotConnected = errors.New("clickhouse hook: not connected")
+
+// DroppedEntriesError is returned by flush when a failed insert left more
+// than MaxBufferSize entries buffered and the oldest had to be discarded.
+type DroppedEntriesError struct {
+	Dropped int
+	Err     error
+}
+
+func (e *DroppedEntriesError) Error() string {
+	return fmt.Sprintf("clickhouse hook: dropped %d buffered entries: %v", e.Dropped, e.Err)
+}
+
+func (e *DroppedEntriesError) Unwrap() error {
+	return e.Err
+}
+
+// Stages of an insert reported in FlushError.
+const (
+	StageBegin   = "begin"
+	StagePrepare = "prepare"
+	StageExec    = "exec"
+	StageCommit  = "commit"
+
+	// StageTransform is a Transform that panicked.
+	StageTransform = "transform"
+)
+
+// FlushError reports which stage of an insert failed, so callers can tell a
+// connection failure at begin from a schema error at prepare or a rejected
+// row at exec. EntriesLost is the number of buffered entries discarded as a
+// consequence.
+type FlushError struct {
+	Stage       string
+	Err         error
+	EntriesLost int
+}
+
+func (e *FlushError) Error() string {
+	msg := fmt.Sprintf("clickhouse hook: %s failed: %v", e.Stage, e.Err)
+	if e.EntriesLost > 0 {
+		msg += fmt.Sprintf(" (%d entries lost)", e.EntriesLost)
+	}
+	return msg
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// lostEntries returns err, wrapped in a DroppedEntriesError and with the
+// FlushError's EntriesLost set when the failure dropped entries.
+func lostEntries(err error, dropped int) error {
+	if dropped == 0 {
+		return err
+	}
+	var flushErr *FlushError
+	if errors.As(err, &flushErr) {
+		flushErr.EntriesLost = dropped
+	}
+	return &DroppedEntriesError{Dropped: dropped, Err: err}
+}
+
+// exception holds the details of a ClickHouse exception, whichever driver
+// returned it.
+type exception struct {
+	code    int32
+	name    string
+	message string
+	stack   string
+}
+
+// detailedException is an error carrying a ClickHouse exception, rendered with
+// all of its details.
+type detailedException struct {
+	exception
+	err error
+}
+
+func (e *detailedException) Error() string {
+	text := fmt.Sprintf("%s (code %d): %s", e.name, e.code, strings.TrimSpace(e.message))
+	if e.stack != "" {
+		text += "\n" + strings.TrimRight(e.stack, "\n")
+	}
+	return text
+}
+
+func (e *detailedException) Unwrap() error {
+	return e.err
+}
+
+// describeException returns err with the ClickHouse exception it carries, if
+// any, spelled out as its name, code, message and server-side stack trace.
+// The driver's own rendering only has the code and message. Other errors are
+// returned as they are.
+func describeException(err error) error {
+	e, ok := exceptionDetails(err)
+	if !ok {
+		return err
+	}
+	return &detailedException{exception: e, err: err}
+}
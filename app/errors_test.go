@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDescribeException(t *testing.T) {
+	exception := fakeException(unknownTableCode, "DB::Exception", "Table default.logs doesn't exist. ",
+		"0. DB::Exception::Exception()\n1. DB::Context::getTable()\n")
+	err := describeException(fmt.Errorf("inserting: %w", exception))
+
+	want := "DB::Exception (code 60): Table default.logs doesn't exist.\n" +
+		"0. DB::Exception::Exception()\n1. DB::Context::getTable()"
+	if got := err.Error(); got != want {
+		t.Fatalf("describeException() =\n%s\nwant\n%s", got, want)
+	}
+	if !errors.Is(err, exception) {
+		t.Fatal("described error doesn't unwrap to the driver's exception")
+	}
+	if code, ok := errorCode(err); !ok || code != unknownTableCode {
+		t.Fatalf("errorCode() = %d, %v, want %d", code, ok, unknownTableCode)
+	}
+}
+
+func TestDescribeExceptionWithoutStack(t *testing.T) {
+	err := describeException(fakeException(241, "DB::Exception", "Memory limit exceeded", ""))
+	if got, want := err.Error(), "DB::Exception (code 241): Memory limit exceeded"; got != want {
+		t.Fatalf("describeException() = %q, want %q", got, want)
+	}
+}
+
+func TestDescribeExceptionKeepsOtherErrors(t *testing.T) {
+	other := errors.New("connection refused")
+	if err := describeException(other); err != other {
+		t.Fatalf("describeException() = %v, want the error unchanged", err)
+	}
+	if got, want := pingError(other).Error(), "clickhouse hook: ping: connection refused"; got != want {
+		t.Fatalf("pingError() = %q, want %q", got, want)
+	}
+}
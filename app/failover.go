@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// nodeCooldown is how long a node that failed with a connection error is
+// skipped while other nodes are healthy.
+const nodeCooldown = 30 * time.Second
+
+// node is one ClickHouse server the hook can insert into.
+type node struct {
+	dsn string
+
+	// poolMu guards db and batch, which reopen replaces. It is held for
+	// reading while they are in use, so reopen waits for the work in
+	// flight. batch is the native connection of FlushStrategyBatch, nil
+	// with other strategies.
+	poolMu sync.RWMutex
+	db     *sql.DB
+	batch  batchConn
+
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+// openNode opens the pool of dsn and, for FlushStrategyBatch, its native
+// batch connection.
+func openNode(dsn string, config Config) (*node, error) {
+	db, batch, err := openConns(dsn, config)
+	if err != nil {
+		return nil, err
+	}
+	return &node{dsn: dsn, db: db, batch: batch}, nil
+}
+
+// openConns opens what a node for dsn holds: the pool and, for
+// FlushStrategyBatch, the native batch connection.
+func openConns(dsn string, config Config) (*sql.DB, batchConn, error) {
+	db, err := openPool(dsn, config)
+	if err != nil || config.FlushStrategy != FlushStrategyBatch {
+		return db, nil, err
+	}
+	batch, err := openBatch(dsn, config)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, batch, nil
+}
+
+// withDB runs fn with the node's current pool.
+func (n *node) withDB(fn func(db *sql.DB) error) error {
+	return n.withConns(func(db *sql.DB, _ batchConn) error { return fn(db) })
+}
+
+// withConns runs fn with the node's current pool and batch connection.
+func (n *node) withConns(fn func(db *sql.DB, batch batchConn) error) error {
+	n.poolMu.RLock()
+	defer n.poolMu.RUnlock()
+	return fn(n.db, n.batch)
+}
+
+// reopen replaces the node's pool and batch connection with freshly opened
+// ones, so that new connections are spread by whatever balances the
+// cluster, and closes the old ones once the work in flight on them is done.
+func (n *node) reopen(config Config) error {
+	db, batch, err := openConns(n.dsn, config)
+	if err != nil {
+		return err
+	}
+	n.poolMu.Lock()
+	oldDB, oldBatch := n.db, n.batch
+	n.db, n.batch = db, batch
+	n.poolMu.Unlock()
+	return closeConns(oldDB, oldBatch)
+}
+
+// close closes the node's pool and batch connection.
+func (n *node) close() error {
+	n.poolMu.Lock()
+	defer n.poolMu.Unlock()
+	return closeConns(n.db, n.batch)
+}
+
+// closeConns closes db and batch, which may be nil.
+func closeConns(db *sql.DB, batch batchConn) error {
+	err := db.Close()
+	if batch != nil {
+		err = errors.Join(err, batch.Close())
+	}
+	return err
+}
+
+func (n *node) markFailed() {
+	n.mu.Lock()
+	n.failedAt = time.Now()
+	n.mu.Unlock()
+}
+
+func (n *node) markHealthy() {
+	n.mu.Lock()
+	n.failedAt = time.Time{}
+	n.mu.Unlock()
+}
+
+// lastFailure returns when the node last failed, or the zero time.
+func (n *node) lastFailure() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.failedAt
+}
+
+// candidates returns the nodes to try for an insert: every healthy node in
+// configured order, or when all of them failed recently, the least recently
+// failed one.
+func candidates(nodes []*node) []*node {
+	if len(nodes) == 1 {
+		return nodes
+	}
+
+	var healthy []*node
+	var fallback *node
+	var fallbackAt time.Time
+	now := time.Now()
+	for _, n := range nodes {
+		failedAt := n.lastFailure()
+		if failedAt.IsZero() || now.Sub(failedAt) >= nodeCooldown {
+			healthy = append(healthy, n)
+			continue
+		}
+		if fallback == nil || failedAt.Before(fallbackAt) {
+			fallback, fallbackAt = n, failedAt
+		}
+	}
+	if len(healthy) == 0 {
+		return []*node{fallback}
+	}
+	return healthy
+}
+
+// isTooLarge reports whether err means the server refused a batch for its
+// size, so that a smaller one may go through.
+func isTooLarge(err error) bool {
+	if code, ok := exceptionCode(err); ok {
+		switch code {
+		case 241, // MEMORY_LIMIT_EXCEEDED
+			396: // TOO_MANY_ROWS_OR_BYTES
+			return true
+		}
+	}
+	message := err.Error()
+	return strings.Contains(message, "Max query size exceeded") ||
+		strings.Contains(message, "MEMORY_LIMIT_EXCEEDED") ||
+		strings.Contains(message, "TOO_MANY_ROWS_OR_BYTES") ||
+		strings.Contains(message, "HTTP 413")
+}
+
+// transientCodes are the ClickHouse error codes of failures that may not
+// happen again.
+var transientCodes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	159: true, // TIMEOUT_EXCEEDED
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	203: true, // NO_FREE_CONNECTION
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	425: true, // SYSTEM_ERROR
+	999: true, // KEEPER_EXCEPTION
+}
+
+// codePattern finds the code of an exception in the text of an error, as
+// the HTTP interface reports it.
+var codePattern = regexp.MustCompile(`Code: (\d+)\b`)
+
+// IsTransient reports whether err may go away on retry, and is the default
+// Retryable: connection errors, timeouts and ClickHouse errors such as
+// TOO_MANY_SIMULTANEOUS_QUERIES are, while other ClickHouse errors, such
+// as UNKNOWN_TABLE or TYPE_MISMATCH, are not. Errors that carry no
+// ClickHouse code, such as those of a custom Sink, are treated as
+// transient, except for a canceled context and a failed Transform.
+func IsTransient(err error) bool {
+	var flushErr *FlushError
+	if errors.Is(err, context.Canceled) || (errors.As(err, &flushErr) && flushErr.Stage == StageTransform) {
+		return false
+	}
+	if isConnectionError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if code, ok := errorCode(err); ok {
+		return transientCodes[code]
+	}
+	return true
+}
+
+// errorCode returns the ClickHouse error code carried by err, whether as an
+// exception of the driver or in its text.
+func errorCode(err error) (int32, bool) {
+	if code, ok := exceptionCode(err); ok {
+		return code, true
+	}
+	match := codePattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	code, err := strconv.ParseInt(match[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(code), true
+}
+
+// isConnectionError reports whether err means the server could not be
+// reached, as opposed to the server rejecting the insert.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// droppedChanSize is the capacity of the channel DroppedChan returns.
+const droppedChanSize = 1024
+
+// DroppedChan returns a channel receiving the entries the hook drops: those
+// discarded by OverflowDrop, MaxBufferSize or Reset, left out by SampleRate,
+// or lost to a flush that failed for good. Sending never blocks the hook:
+// once the channel holds droppedChanSize entries no one has received, further
+// ones are discarded without notice, so it is a best-effort view for
+// shipping drops elsewhere, not an exact account, which Stats keeps. Nothing
+// is sent before the first call, and the channel is never closed.
+func (hook *ClickHouseHook) DroppedChan() <-chan logrus.Entry {
+	hook.droppedOnce.Do(func() {
+		ch := make(chan logrus.Entry, droppedChanSize)
+		hook.droppedCh.Store(&ch)
+	})
+	return *hook.droppedCh.Load()
+}
+
+// emitDropped sends entries to the DroppedChan channel, if any, as far as it
+// has room.
+func (hook *ClickHouseHook) emitDropped(entries []logrus.Entry) {
+	ch := hook.droppedCh.Load()
+	if ch == nil {
+		return
+	}
+	for _, entry := range entries {
+		select {
+		case *ch <- entry:
+		default:
+			return
+		}
+	}
+}
+
+// fallback writes entries the hook is dropping to FallbackWriter, one text
+// line each, and passes them to emitDropped.
+func (hook *ClickHouseHook) fallback(entries []logrus.Entry) {
+	hook.emitDropped(entries)
+	if hook.config.FallbackWriter == nil || len(entries) == 0 {
+		return
+	}
+
+	formatter := &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	hook.fallbackMu.Lock()
+	defer hook.fallbackMu.Unlock()
+	for i := range entries {
+		if line, err := formatter.Format(&entries[i]); err == nil {
+			hook.config.FallbackWriter.Write(line)
+		}
+	}
+}
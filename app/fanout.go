@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FanOutPolicy decides how a failure of one of the AdditionalSinks affects
+// the flush.
+type FanOutPolicy int
+
+const (
+	// FanOutBestEffort counts and logs additional sink failures without
+	// failing the flush, so a flaky secondary can't hold the primary back.
+	FanOutBestEffort FanOutPolicy = iota
+	// FanOutFailFast fails the flush when an additional sink fails, after
+	// retrying the write to that sink alone as a failed insert would be.
+	// The batch is then kept for that sink only, up to MaxBufferSize
+	// entries, and written to it ahead of its next batch, so neither the
+	// primary nor the sinks the batch reached receive it twice.
+	FanOutFailFast
+)
+
+// sinkError reports additional sinks that failed to store a batch the
+// primary sink stored, which retrying or keeping the batch must not write
+// again.
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string { return e.err.Error() }
+
+func (e *sinkError) Unwrap() error { return e.err }
+
+// storedByPrimary reports whether err leaves its batch stored by the
+// primary sink, only additional sinks having failed.
+func storedByPrimary(err error) bool {
+	var sinkErr *sinkError
+	return errors.As(err, &sinkErr)
+}
+
+// sinkBatch is a batch kept for an additional sink under FanOutFailFast.
+type sinkBatch struct {
+	table   string
+	entries []logrus.Entry
+}
+
+// fanOut writes a batch the primary sink stored to every AdditionalSink in
+// turn, counting failures per sink. Under FanOutFailFast it returns the
+// failures as a *sinkError.
+func (hook *ClickHouseHook) fanOut(ctx context.Context, table string, entries []logrus.Entry) error {
+	var errs []error
+	for i, sink := range hook.config.AdditionalSinks {
+		var err error
+		if hook.config.FanOutPolicy == FanOutFailFast {
+			err = hook.writeKept(ctx, i, sink, sinkBatch{table: table, entries: entries})
+		} else {
+			err = writeTo(ctx, sink, table, entries)
+		}
+		if err == nil {
+			continue
+		}
+		hook.mu.Lock()
+		hook.sinkErrors[i]++
+		hook.mu.Unlock()
+		err = fmt.Errorf("clickhouse hook: additional sink %d: %w", i, err)
+		if hook.config.FanOutPolicy == FanOutFailFast {
+			errs = append(errs, err)
+			continue
+		}
+		hook.logLimited(hook.log().WithField("sink", i), logrus.WarnLevel, err, "writing to additional sink failed")
+	}
+	if len(errs) > 0 {
+		return &sinkError{err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// writeKept writes the batches kept for additional sink i, then batch, each
+// retried like an insert. Those it can't write stay kept.
+func (hook *ClickHouseHook) writeKept(ctx context.Context, i int, sink Sink, batch sinkBatch) error {
+	hook.mu.Lock()
+	batches := append(hook.sinkKept[i], batch)
+	hook.sinkKept[i] = nil
+	hook.mu.Unlock()
+
+	for n, b := range batches {
+		if err := hook.writeSinkWithRetry(ctx, sink, b); err != nil {
+			hook.keepForSink(i, batches[n:])
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSinkWithRetry writes b to sink, retrying with backoff like
+// insertWithRetry.
+func (hook *ClickHouseHook) writeSinkWithRetry(ctx context.Context, sink Sink, b sinkBatch) error {
+	err := writeTo(ctx, sink, b.table, b.entries)
+	for attempt := 0; err != nil && hook.config.Retryable(err) && attempt < hook.config.MaxRetries; attempt++ {
+		if hook.sleep(ctx, hook.retryDelay(attempt)) != nil {
+			break
+		}
+		err = writeTo(ctx, sink, b.table, b.entries)
+	}
+	return err
+}
+
+// keepForSink puts batches in front of those kept for additional sink i
+// in the meantime, dropping the oldest beyond MaxBufferSize entries as a
+// full buffer does: counted in Stats.DroppedEntries and the dropped metric,
+// and passed to DroppedChan and FallbackWriter.
+func (hook *ClickHouseHook) keepForSink(i int, batches []sinkBatch) {
+	hook.mu.Lock()
+	kept := append(batches, hook.sinkKept[i]...)
+	var dropped []logrus.Entry
+	if limit := hook.config.MaxBufferSize; limit > 0 {
+		total := 0
+		for _, b := range kept {
+			total += len(b.entries)
+		}
+		for len(kept) > 1 && total > limit {
+			total -= len(kept[0].entries)
+			dropped = append(dropped, kept[0].entries...)
+			kept = kept[1:]
+		}
+	}
+	hook.sinkKept[i] = kept
+	hook.dropped += uint64(len(dropped))
+	hook.metrics.dropped.Add(float64(len(dropped)))
+	hook.mu.Unlock()
+
+	if len(dropped) > 0 {
+		hook.logLimited(hook.log().WithFields(logrus.Fields{"sink": i, "dropped": len(dropped)}), logrus.WarnLevel, nil,
+			"additional sink kept too many entries, dropped the oldest")
+		hook.fallback(dropped)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFanOutFailFastRetriesOnlyTheFailedSink(t *testing.T) {
+	primary := &countingSink{}
+	reached := &countingSink{}
+	failing := &countingSink{}
+	failing.SetError(errors.New("secondary down"))
+	hook, err := NewHookWithSink(primary, 100, WithRetries(2, time.Millisecond),
+		WithAdditionalSink(reached), WithAdditionalSink(failing), WithFanOutPolicy(FanOutFailFast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	if err := hook.Flush(); err == nil {
+		t.Fatal("Flush with a failing additional sink returned nil under FanOutFailFast")
+	}
+	if got := primary.Attempts(); got != 1 {
+		t.Errorf("primary written %d times, want 1", got)
+	}
+	if got := reached.Attempts(); got != 1 {
+		t.Errorf("healthy additional sink written %d times, want 1", got)
+	}
+	if got := failing.Attempts(); got != 3 {
+		t.Errorf("failing additional sink written %d times, want 3", got)
+	}
+	stats := hook.Stats()
+	if stats.Buffered != 0 {
+		t.Errorf("%d entries requeued for the primary, want 0", stats.Buffered)
+	}
+	if stats.AdditionalSinkErrors[1] != 1 || stats.AdditionalSinkErrors[0] != 0 {
+		t.Errorf("AdditionalSinkErrors = %v, want [0 1]", stats.AdditionalSinkErrors)
+	}
+
+	failing.SetError(nil)
+	hook.Fire(testEntry(logrus.InfoLevel, "three"))
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush after the sink recovered: %v", err)
+	}
+	if got := len(primary.Entries()); got != 3 {
+		t.Errorf("primary has %d entries, want 3", got)
+	}
+	if got := len(reached.Entries()); got != 3 {
+		t.Errorf("healthy additional sink has %d entries, want 3", got)
+	}
+	if got := len(failing.Entries()); got != 3 {
+		t.Errorf("recovered additional sink has %d entries, want the 2 kept and 1 new", got)
+	}
+}
+
+func TestFanOutBestEffortIgnoresSinkFailures(t *testing.T) {
+	primary := &MemorySink{}
+	failing := &countingSink{}
+	failing.SetError(errors.New("secondary down"))
+	hook, err := NewMemoryHook(primary, 100, WithRetries(2, time.Millisecond), WithAdditionalSink(failing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush with a failing best-effort sink: %v", err)
+	}
+	if got := failing.Attempts(); got != 1 {
+		t.Errorf("best-effort sink written %d times, want 1", got)
+	}
+	failing.SetError(nil)
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(failing.Entries()); got != 1 {
+		t.Errorf("best-effort sink has %d entries, want only the new one", got)
+	}
+}
+
+func TestFanOutFailFastCountsEntriesDroppedForSink(t *testing.T) {
+	failing := &MemorySink{}
+	failing.SetError(errors.New("secondary down"))
+	var fallback bytes.Buffer
+	hook, err := NewMemoryHook(&MemorySink{}, 100, WithRetries(0, time.Millisecond), WithMaxBufferSize(2),
+		WithAdditionalSink(failing), WithFanOutPolicy(FanOutFailFast), WithFallbackWriter(&fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+	dropped := hook.DroppedChan()
+
+	for _, message := range []string{"one", "two", "three", "four"} {
+		hook.Fire(testEntry(logrus.InfoLevel, message))
+		if message == "two" || message == "four" {
+			hook.Flush()
+		}
+	}
+	if got := hook.Stats().DroppedEntries; got != 2 {
+		t.Fatalf("Stats.DroppedEntries = %d, want the 2 entries the sink couldn't keep", got)
+	}
+	for _, want := range []string{"one", "two"} {
+		select {
+		case entry := <-dropped:
+			if entry.Message != want {
+				t.Errorf("DroppedChan sent %q, want %q", entry.Message, want)
+			}
+		default:
+			t.Fatalf("DroppedChan is missing %q", want)
+		}
+	}
+	if got := strings.Count(fallback.String(), "\n"); got != 2 {
+		t.Errorf("FallbackWriter got %d lines, want 2", got)
+	}
+
+	failing.SetError(nil)
+	hook.Fire(testEntry(logrus.InfoLevel, "five"))
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(failing.Entries()); got != 3 {
+		t.Errorf("recovered sink has %d entries, want the 2 kept and 1 new", got)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FieldEncoding selects how entry fields are stored when IncludeFields is set.
+type FieldEncoding int
+
+const (
+	// FieldsAsMap writes fields to a Map(String, String) column named fields.
+	FieldsAsMap FieldEncoding = iota
+	// FieldsAsJSON writes fields as a JSON object to a String column named
+	// fields_json, for use with ClickHouse's JSON functions.
+	FieldsAsJSON
+)
+
+// otherFieldsKey is the field counting the keys AllowedFields left out.
+const otherFieldsKey = "other"
+
+// fields renders entry.Data, merged over the context fields and
+// DefaultFields, as a string map for a Map(String, String) column. Fields
+// with a column of their own are left out unless RemoveExtractedFields is
+// false, and those beyond MaxFieldsPerEntry are dropped.
+func (hook *ClickHouseHook) fields(entry *logrus.Entry) map[string]string {
+	fields := hook.fieldMap(entry)
+	capFields(fields, hook.config.MaxFieldsPerEntry)
+	return fields
+}
+
+// fieldMap is fields without MaxFieldsPerEntry.
+func (hook *ClickHouseHook) fieldMap(entry *logrus.Entry) map[string]string {
+	fields := make(map[string]string, len(hook.config.DefaultFields)+len(entry.Data))
+	for key, value := range hook.config.DefaultFields {
+		fields[key] = value
+	}
+	for key, value := range hook.contextFields(entry) {
+		fields[key] = hook.truncateField(value)
+	}
+	var other int
+	for key, value := range entry.Data {
+		if hook.extracted[key] {
+			continue
+		}
+		if hook.allowed != nil && !hook.allowed[key] {
+			other++
+			continue
+		}
+		hook.flatten(fields, key, value, 0)
+	}
+	if other > 0 {
+		fields[otherFieldsKey] = strconv.Itoa(other)
+	}
+	return fields
+}
+
+// extractedFields returns the set of fields columns are filled from, or nil
+// if there are none.
+func extractedFields(columns []column) map[string]bool {
+	var extracted map[string]bool
+	for _, col := range columns {
+		if col.field == "" {
+			continue
+		}
+		if extracted == nil {
+			extracted = make(map[string]bool)
+		}
+		extracted[col.field] = true
+	}
+	return extracted
+}
+
+// flatten stores value under key in fields, expanding its members under
+// dotted keys while depth is below FlattenDepth.
+func (hook *ClickHouseHook) flatten(fields map[string]string, key string, value interface{}, depth int) {
+	if depth >= hook.config.FlattenDepth || !isNested(value) {
+		fields[key] = hook.truncateField(hook.fieldValue(key, value))
+		return
+	}
+	v := reflect.Indirect(reflect.ValueOf(value))
+	if v.Kind() == reflect.Map {
+		iter := v.MapRange()
+		for iter.Next() {
+			hook.flatten(fields, key+"."+iter.Key().String(), iter.Value().Interface(), depth+1)
+		}
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.IsExported() {
+			hook.flatten(fields, key+"."+field.Name, v.Field(i).Interface(), depth+1)
+		}
+	}
+}
+
+// isNested reports whether flatten can expand value: a map with string
+// keys or a struct, or a non-nil pointer to one, that doesn't render
+// itself.
+func isNested(value interface{}) bool {
+	switch value.(type) {
+	case fmt.Stringer, error:
+		return false
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		return v.Type().Key().Kind() == reflect.String
+	case reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// fieldValue renders a field value for the fields map with
+// FieldValueEncoder, or fmt.Sprint when none is set.
+func (hook *ClickHouseHook) fieldValue(key string, value interface{}) string {
+	if hook.config.FieldValueEncoder != nil {
+		return hook.config.FieldValueEncoder(key, value)
+	}
+	if err, ok := value.(error); ok {
+		return hook.errorText(err)
+	}
+	return fmt.Sprint(value)
+}
+
+// errorText renders err for a field or the error column: with %+v when
+// DetailedErrors is set, else as its Error string.
+func (hook *ClickHouseHook) errorText(err error) string {
+	if hook.config.DetailedErrors {
+		return fmt.Sprintf("%+v", err)
+	}
+	return err.Error()
+}
+
+// contextFields returns what ContextExtractor pulls from entry.Context, or
+// nil when either is missing.
+func (hook *ClickHouseHook) contextFields(entry *logrus.Entry) map[string]string {
+	if hook.config.ContextExtractor == nil || entry.Context == nil {
+		return nil
+	}
+	return hook.config.ContextExtractor(entry.Context)
+}
+
+// truncateField applies MaxMessageBytes to a field value if TruncateFields
+// is set.
+func (hook *ClickHouseHook) truncateField(value string) string {
+	if !hook.config.TruncateFields {
+		return value
+	}
+	return truncate(value, hook.config.MaxMessageBytes)
+}
+
+// fieldsJSON renders entry.Data, merged over the context fields and
+// DefaultFields, as a JSON object. Values that can't be marshaled, such as
+// channels or funcs, are stored as their fmt.Sprint string so one bad field
+// doesn't fail the batch. Extracted fields and those beyond
+// MaxFieldsPerEntry are left out as by fields.
+func (hook *ClickHouseHook) fieldsJSON(entry *logrus.Entry) string {
+	fields := hook.jsonFields(entry)
+	capFields(fields, hook.config.MaxFieldsPerEntry)
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// jsonFields returns the members of the fieldsJSON object, without
+// MaxFieldsPerEntry.
+func (hook *ClickHouseHook) jsonFields(entry *logrus.Entry) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage, len(hook.config.DefaultFields)+len(entry.Data))
+	for key, value := range hook.config.DefaultFields {
+		fields[key] = jsonValue(value)
+	}
+	for key, value := range hook.contextFields(entry) {
+		fields[key] = jsonValue(hook.truncateField(value))
+	}
+	var other int
+	for key, value := range entry.Data {
+		if hook.extracted[key] {
+			continue
+		}
+		if hook.allowed != nil && !hook.allowed[key] {
+			other++
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			value = hook.truncateField(v)
+		case error:
+			value = hook.truncateField(hook.errorText(v))
+		}
+		fields[key] = jsonValue(value)
+	}
+	if other > 0 {
+		fields[otherFieldsKey] = jsonValue(other)
+	}
+	return fields
+}
+
+// capFields deletes the keys of fields beyond the first limit in sorted
+// order, if limit is positive, and returns how many it deleted.
+func capFields[V any](fields map[string]V, limit int) int {
+	if limit <= 0 || len(fields) <= limit {
+		return 0
+	}
+	keys := slices.Sorted(maps.Keys(fields))
+	for _, key := range keys[limit:] {
+		delete(fields, key)
+	}
+	return len(keys) - limit
+}
+
+// droppedFields returns how many fields MaxFieldsPerEntry drops from the
+// fields column of entry.
+func (hook *ClickHouseHook) droppedFields(entry *logrus.Entry) uint32 {
+	var n int
+	if hook.config.FieldEncoding == FieldsAsJSON {
+		n = len(hook.jsonFields(entry))
+	} else {
+		n = len(hook.fieldMap(entry))
+	}
+	return uint32(max(n-hook.config.MaxFieldsPerEntry, 0))
+}
+
+// jsonValue marshals value, falling back to its string form. Errors are
+// stored as their message, matching logrus.JSONFormatter.
+func jsonValue(value interface{}) json.RawMessage {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return encoded
+}
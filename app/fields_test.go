@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestHook builds a hook from opts without starting it.
+func newTestHook(t testing.TB, opts ...Option) *ClickHouseHook {
+	t.Helper()
+	config, err := prepareConfig(Config{BatchSize: 10}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+type request struct {
+	Method string
+	path   string
+}
+
+func TestFlattenFields(t *testing.T) {
+	hook := newTestHook(t, WithFields(), WithFlattenFields(2))
+	entry := &logrus.Entry{Data: logrus.Fields{
+		"user": map[string]interface{}{"id": 7, "geo": map[string]string{"city": "Oslo"}},
+		"req":  &request{Method: "GET", path: "/"},
+		"err":  errors.New("boom"),
+		"deep": map[string]interface{}{"a": map[string]interface{}{"b": map[string]int{"c": 1}}},
+		"ids":  map[int]string{1: "one"},
+	}}
+	want := map[string]string{
+		"user.id":       "7",
+		"user.geo.city": "Oslo",
+		"req.Method":    "GET",
+		"err":           "boom",
+		"deep.a.b":      "map[c:1]",
+		"ids":           "map[1:one]",
+	}
+	if got := hook.fields(entry); !maps.Equal(got, want) {
+		t.Fatalf("fields() = %v, want %v", got, want)
+	}
+}
+
+func TestFlattenFieldsDisabled(t *testing.T) {
+	hook := newTestHook(t, WithFields())
+	entry := &logrus.Entry{Data: logrus.Fields{"user": map[string]int{"id": 7}}}
+	if got, want := hook.fields(entry), map[string]string{"user": "map[id:7]"}; !maps.Equal(got, want) {
+		t.Fatalf("fields() = %v, want %v", got, want)
+	}
+}
+
+func TestCapFields(t *testing.T) {
+	for _, tc := range []struct {
+		limit   int
+		deleted int
+		want    []string
+	}{
+		{0, 0, []string{"a", "b", "c", "d"}},
+		{2, 2, []string{"a", "b"}},
+		{4, 0, []string{"a", "b", "c", "d"}},
+		{10, 0, []string{"a", "b", "c", "d"}},
+	} {
+		fields := map[string]int{"d": 4, "b": 2, "a": 1, "c": 3}
+		if deleted := capFields(fields, tc.limit); deleted != tc.deleted {
+			t.Errorf("capFields(limit %d) deleted %d, want %d", tc.limit, deleted, tc.deleted)
+		}
+		if got := slices.Sorted(maps.Keys(fields)); !slices.Equal(got, tc.want) {
+			t.Errorf("capFields(limit %d) kept %v, want %v", tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestDroppedFields(t *testing.T) {
+	entry := &logrus.Entry{Data: logrus.Fields{"a": 1, "b": 2, "c": 3}}
+	for _, encoding := range []FieldEncoding{FieldsAsMap, FieldsAsJSON} {
+		hook := newTestHook(t, WithFields(), WithFieldEncoding(encoding), WithMaxFieldsPerEntry(2),
+			WithDefaultFields(map[string]string{"host": "web-1"}))
+		if got := hook.droppedFields(entry); got != 2 {
+			t.Errorf("droppedFields() with encoding %v = %d, want 2", encoding, got)
+		}
+		var kept int
+		if encoding == FieldsAsJSON {
+			var object map[string]interface{}
+			if err := json.Unmarshal([]byte(hook.fieldsJSON(entry)), &object); err != nil {
+				t.Fatal(err)
+			}
+			kept = len(object)
+		} else {
+			kept = len(hook.fields(entry))
+		}
+		if kept != 2 {
+			t.Errorf("%d fields kept with encoding %v, want 2", kept, encoding)
+		}
+	}
+}
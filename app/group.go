@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// holdKey marks the context of a flush that may hold back groups smaller
+// than MinGroupSize.
+type holdKey struct{}
+
+// withHold lets the flush running under ctx hold back small groups.
+func withHold(ctx context.Context) context.Context {
+	return context.WithValue(ctx, holdKey{}, true)
+}
+
+// mayHold reports whether the flush running under ctx may hold back small
+// groups.
+func (hook *ClickHouseHook) mayHold(ctx context.Context) bool {
+	return hook.config.MinGroupSize > 0 && ctx.Value(holdKey{}) != nil
+}
+
+// holdBack sets aside the groups of entries with fewer than MinGroupSize
+// entries that have been waiting for less than MaxGroupDelay, and returns
+// the rest, to insert now. Held entries are picked up again by the next
+// flush. Without MaxGroupDelay the delay follows FlushInterval, including
+// changes from DynamicConfigTable.
+func (hook *ClickHouseHook) holdBack(entries []logrus.Entry) []logrus.Entry {
+	now := hook.config.Clock.Now()
+	send := make([]logrus.Entry, 0, len(entries))
+	config := hook.currentConfig()
+	maxDelay := config.MaxGroupDelay
+	if maxDelay <= 0 {
+		maxDelay = config.FlushInterval
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	for _, s := range hook.shards(entries) {
+		since, ok := hook.heldSince[s.key]
+		if !ok {
+			since = now
+		}
+		if len(s.entries) < hook.config.MinGroupSize && now.Sub(since) < maxDelay {
+			hook.held = append(hook.held, s.entries...)
+			hook.heldSince[s.key] = since
+			continue
+		}
+		delete(hook.heldSince, s.key)
+		send = append(send, s.entries...)
+	}
+	return send
+}
+
+// takeHeld returns the entries holdBack set aside and forgets them.
+// Callers must hold hook.mu.
+func (hook *ClickHouseHook) takeHeld() []logrus.Entry {
+	held := hook.held
+	hook.held = nil
+	return held
+}
+
+// insertGroups inserts every group, one after the other or, with
+// GroupConcurrency, up to that many at a time, and returns the entries
+// that could not be inserted and the errors of the groups they belong to,
+// in group order.
+func (hook *ClickHouseHook) insertGroups(ctx context.Context, groups []shard) ([]logrus.Entry, []error) {
+	rejected := make([][]logrus.Entry, len(groups))
+	errs := make([]error, len(groups))
+	if limit := hook.config.GroupConcurrency; limit > 1 && len(groups) > 1 {
+		slots := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for i, group := range groups {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				rejected[i], errs[i] = hook.insertGroup(ctx, group)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i, group := range groups {
+			rejected[i], errs[i] = hook.insertGroup(ctx, group)
+		}
+	}
+
+	var failed []logrus.Entry
+	var failures []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, rejected[i]...)
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) > 0 {
+		hook.mu.Lock()
+		hook.groupErrs += uint64(len(failures))
+		hook.mu.Unlock()
+	}
+	return failed, failures
+}
+
+// insertGroup is insertSplitting for group, turning a panic into the
+// group's error with all its entries rejected.
+func (hook *ClickHouseHook) insertGroup(ctx context.Context, group shard) (rejected []logrus.Entry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rejected, err = group.entries, hook.recovered("group insert", r)
+		}
+	}()
+	return hook.insertSplitting(ctx, group.table, group.entries)
+}
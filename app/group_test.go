@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHoldBackFollowsDynamicFlushInterval(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	config, err := prepareConfig(Config{BatchSize: 100}, []Option{
+		WithClock(clock),
+		WithFlushInterval(time.Minute),
+		WithMinGroupSize(10, 0),
+		WithLevelTables(map[logrus.Level]string{logrus.ErrorLevel: "errors"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.intervals = make(chan time.Duration, 1)
+
+	entries := []logrus.Entry{{Level: logrus.ErrorLevel, Time: clock.Now(), Message: "held"}}
+	if sent := hook.holdBack(entries); len(sent) != 0 {
+		t.Fatalf("holdBack sent %d entries of a small group, want 0", len(sent))
+	}
+	clock.Advance(2 * time.Second)
+	if sent := hook.holdBack(hook.takeHeld()); len(sent) != 0 {
+		t.Fatalf("holdBack sent %d entries before FlushInterval, want 0", len(sent))
+	}
+
+	hook.applyConfig(dynamicConfig{flushInterval: time.Second})
+	if sent := hook.holdBack(hook.takeHeld()); len(sent) != 1 {
+		t.Fatalf("holdBack sent %d entries after FlushInterval dropped to 1s, want 1", len(sent))
+	}
+}
+
+func TestOnFlushCallsDontOverlapWithGroupConcurrency(t *testing.T) {
+	// Plain counters: the race detector fails the test if two calls of
+	// OnFlush overlap.
+	var calls, rows int
+	levels := []logrus.Level{logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel, logrus.TraceLevel}
+	tables := make(map[logrus.Level]string, len(levels))
+	for _, level := range levels {
+		tables[level] = level.String() + "_logs"
+	}
+	hook, err := NewMemoryHook(&MemorySink{}, 100, WithGroupConcurrency(len(levels)), WithLevelTables(tables),
+		WithOnFlush(func(count int, _ time.Duration) {
+			calls++
+			rows += count
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	for i := 0; i < 20; i++ {
+		for _, level := range levels {
+			hook.Fire(testEntry(level, "entry"))
+		}
+		if err := hook.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 80 || rows != 80 {
+		t.Fatalf("OnFlush called %d times for %d rows, want 80 for 80", calls, rows)
+	}
+}
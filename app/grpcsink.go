@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// defaultGRPCPort is the port ClickHouse's gRPC interface is usually
+// configured on.
+const defaultGRPCPort = "9100"
+
+// executeQueryMethod is the unary call of ClickHouse's gRPC service.
+const executeQueryMethod = "/clickhouse.grpc.ClickHouse/ExecuteQuery"
+
+// grpcSink inserts batches through ClickHouse's gRPC interface as
+// INSERT ... FORMAT JSONEachRow, with the rows as the query's input data.
+// The server only offers it when grpc_port is set in its configuration:
+//
+//	<grpc_port>9100</grpc_port>
+//
+// The messages of ClickHouse's clickhouse_grpc.proto are encoded by hand,
+// for the few fields the sink uses, so no generated code is needed.
+type grpcSink struct {
+	conn     *grpc.ClientConn
+	username string
+	password string
+	database string
+	params   map[string]string
+	table    string
+	columns  []column
+	settings string
+}
+
+// isGRPCDSN reports whether dsn selects the gRPC transport.
+func isGRPCDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "grpc://") || strings.HasPrefix(dsn, "grpcs://")
+}
+
+// newGRPCSink parses a grpc:// or grpcs:// DSN, the latter connecting over
+// TLS. The port defaults to 9100 and the path names the database.
+// Credentials are taken from the URL's user info or the username and
+// password parameters; other parameters are passed to ClickHouse as
+// settings.
+func newGRPCSink(dsn, table string, columns []column, settings string) (*grpcSink, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse hook: parsing DSN: %w", err)
+	}
+	host := parsed.Host
+	if parsed.Port() == "" {
+		host = net.JoinHostPort(parsed.Hostname(), defaultGRPCPort)
+	}
+	creds := insecure.NewCredentials()
+	if parsed.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{ServerName: parsed.Hostname()})
+	}
+	conn, err := grpc.NewClient(host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse hook: connecting over gRPC: %w", err)
+	}
+
+	params := parsed.Query()
+	s := &grpcSink{
+		conn:     conn,
+		username: params.Get("username"),
+		password: params.Get("password"),
+		database: strings.TrimPrefix(parsed.Path, "/"),
+		params:   make(map[string]string, len(params)),
+		table:    table,
+		columns:  columns,
+		settings: settings,
+	}
+	if parsed.User != nil {
+		s.username = parsed.User.Username()
+		s.password, _ = parsed.User.Password()
+	}
+	for key := range params {
+		if key != "username" && key != "password" {
+			s.params[key] = params.Get(key)
+		}
+	}
+	return s, nil
+}
+
+// WriteBatch sends entries as one JSONEachRow insert.
+func (s *grpcSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	return s.WriteTable(ctx, s.table, entries)
+}
+
+// WriteTable is WriteBatch for table instead of the sink's own table.
+func (s *grpcSink) WriteTable(ctx context.Context, table string, entries []logrus.Entry) error {
+	return s.writeColumns(ctx, table, s.columns, entries)
+}
+
+// writeColumns is WriteBatch for columns of table.
+func (s *grpcSink) writeColumns(ctx context.Context, table string, columns []column, entries []logrus.Entry) error {
+	body, err := encodeJSONEachRow(columns, entries)
+	if err != nil {
+		return err
+	}
+	if err := s.exec(ctx, jsonInsertQuery(table, columns, batchSettings(ctx, s.settings)), body); err != nil {
+		return &FlushError{Stage: StageExec, Err: err}
+	}
+	return nil
+}
+
+// exec runs query with body, if any, as its input data. Timestamps are sent
+// as RFC 3339, so best effort date parsing is enabled.
+func (s *grpcSink) exec(ctx context.Context, query string, body io.Reader) error {
+	var input []byte
+	if body != nil {
+		var err error
+		if input, err = io.ReadAll(body); err != nil {
+			return err
+		}
+	}
+	settings := map[string]string{"date_time_input_format": "best_effort"}
+	for key, value := range s.params {
+		settings[key] = value
+	}
+
+	request := s.queryInfo(query, settings, input)
+	var response []byte
+	if err := s.conn.Invoke(ctx, executeQueryMethod, &request, &response, grpc.ForceCodec(rawCodec{})); err != nil {
+		return err
+	}
+	return resultError(response)
+}
+
+// queryInfo encodes a QueryInfo message for query.
+func (s *grpcSink) queryInfo(query string, settings map[string]string, input []byte) []byte {
+	var b []byte
+	b = appendString(b, 1, query)
+	for key, value := range settings {
+		entry := appendString(appendString(nil, 1, key), 2, value)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendString(b, 4, s.database)
+	if len(input) > 0 {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, input)
+	}
+	b = appendString(b, 9, s.username)
+	return appendString(b, 10, s.password)
+}
+
+// appendString appends field num holding value to b, unless value is empty.
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// resultError returns the exception carried by an encoded Result message,
+// or nil if it has none.
+func resultError(result []byte) error {
+	for len(result) > 0 {
+		num, typ, n := protowire.ConsumeTag(result)
+		if n < 0 {
+			return fmt.Errorf("clickhouse hook: decoding gRPC result: %w", protowire.ParseError(n))
+		}
+		result = result[n:]
+		if num == 7 && typ == protowire.BytesType {
+			exception, n := protowire.ConsumeBytes(result)
+			if n < 0 {
+				return fmt.Errorf("clickhouse hook: decoding gRPC result: %w", protowire.ParseError(n))
+			}
+			return exceptionError(exception)
+		}
+		n = protowire.ConsumeFieldValue(num, typ, result)
+		if n < 0 {
+			return fmt.Errorf("clickhouse hook: decoding gRPC result: %w", protowire.ParseError(n))
+		}
+		result = result[n:]
+	}
+	return nil
+}
+
+// exceptionError turns an encoded Exception message into an error with the
+// text ClickHouse displays for it, which starts with its code.
+func exceptionError(exception []byte) error {
+	var code uint64
+	var text string
+	for len(exception) > 0 {
+		num, typ, n := protowire.ConsumeTag(exception)
+		if n < 0 {
+			break
+		}
+		exception = exception[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			code, n = protowire.ConsumeVarint(exception)
+		case num == 3 && typ == protowire.BytesType:
+			text, n = protowire.ConsumeString(exception)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, exception)
+		}
+		if n < 0 {
+			break
+		}
+		exception = exception[n:]
+	}
+	if text == "" {
+		text = fmt.Sprintf("Code: %d", int32(code))
+	}
+	return fmt.Errorf("clickhouse hook: %s", text)
+}
+
+// ping runs SELECT 1. A server without a gRPC interface is reported as
+// such, since the error gRPC gives for it is not obvious.
+func (s *grpcSink) ping(ctx context.Context) error {
+	err := s.exec(ctx, "SELECT 1", nil)
+	switch status.Code(err) {
+	case codes.Unimplemented, codes.Unavailable:
+		return fmt.Errorf("clickhouse hook: no gRPC interface reachable, check grpc_port in the server configuration: %w", err)
+	}
+	return err
+}
+
+// Close closes the gRPC connection.
+func (s *grpcSink) Close() error {
+	return s.conn.Close()
+}
+
+// rawCodec passes messages already encoded as protobuf through gRPC.
+type rawCodec struct{}
+
+// Marshal returns the bytes v points to.
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("clickhouse hook: cannot encode %T", v)
+	}
+	return *b, nil
+}
+
+// Unmarshal stores a copy of data where v points.
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("clickhouse hook: cannot decode into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// Name is the content subtype ClickHouse expects.
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// newGRPCHook builds a hook that writes through ClickHouse's gRPC interface.
+func newGRPCHook(dsn string, config Config) (*ClickHouseHook, error) {
+	if config.CustomInsert != "" {
+		return nil, fmt.Errorf("clickhouse hook: custom inserts are not supported over gRPC")
+	}
+	if config.VerifySchema {
+		return nil, fmt.Errorf("clickhouse hook: schema verification is not supported over gRPC")
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err = withCredentials(dsn, config)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newGRPCSink(dsn, config.insertTable(), hook.columns, settingsClause(config.QuerySettings))
+	if err != nil {
+		return nil, err
+	}
+	hook.sink = sink
+
+	if err := hook.connect(context.Background(), func(ctx context.Context) error {
+		return hook.setupRemote(ctx, sink)
+	}); err != nil {
+		sink.Close()
+		return nil, err
+	}
+	if err := hook.start(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestNewGRPCSink(t *testing.T) {
+	for _, tc := range []struct {
+		dsn                          string
+		target, database, user, pass string
+		params                       map[string]string
+	}{
+		{"grpc://host", "host:9100", "", "", "", map[string]string{}},
+		{"grpcs://host:9200/logs", "host:9200", "logs", "", "", map[string]string{}},
+		{"grpc://u:p@host/logs?max_threads=2", "host:9100", "logs", "u", "p", map[string]string{"max_threads": "2"}},
+		{"grpc://host?username=u&password=p&async_insert=1", "host:9100", "", "u", "p", map[string]string{"async_insert": "1"}},
+	} {
+		t.Run(tc.dsn, func(t *testing.T) {
+			sink, err := newGRPCSink(tc.dsn, "logs", nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			if got := sink.conn.Target(); got != tc.target {
+				t.Errorf("target %q, want %q", got, tc.target)
+			}
+			if sink.database != tc.database || sink.username != tc.user || sink.password != tc.pass {
+				t.Errorf("database %q, username %q, password %q, want %q, %q, %q",
+					sink.database, sink.username, sink.password, tc.database, tc.user, tc.pass)
+			}
+			if len(sink.params) != len(tc.params) {
+				t.Errorf("params %v, want %v", sink.params, tc.params)
+			}
+			for key, value := range tc.params {
+				if sink.params[key] != value {
+					t.Errorf("params %v, want %v", sink.params, tc.params)
+				}
+			}
+		})
+	}
+}
+
+// queryInfo holds the QueryInfo fields the sink sends.
+type queryInfo struct {
+	query, database, input, username, password string
+	settings                                   map[string]string
+}
+
+// decodeFields calls fn with every length-delimited field of message b.
+func decodeFields(t *testing.T, b []byte, fn func(num protowire.Number, value []byte)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("decoding field %d of type %d: %v", num, typ, protowire.ParseError(n))
+		}
+		b = b[n:]
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("decoding field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		fn(num, value)
+	}
+}
+
+// decodeQueryInfo decodes a QueryInfo message encoded by the sink.
+func decodeQueryInfo(t *testing.T, b []byte) queryInfo {
+	t.Helper()
+	info := queryInfo{settings: make(map[string]string)}
+	decodeFields(t, b, func(num protowire.Number, value []byte) {
+		switch num {
+		case 1:
+			info.query = string(value)
+		case 3:
+			var key, setting string
+			decodeFields(t, value, func(num protowire.Number, value []byte) {
+				if num == 1 {
+					key = string(value)
+				} else {
+					setting = string(value)
+				}
+			})
+			info.settings[key] = setting
+		case 4:
+			info.database = string(value)
+		case 5:
+			info.input = string(value)
+		case 9:
+			info.username = string(value)
+		case 10:
+			info.password = string(value)
+		}
+	})
+	return info
+}
+
+// fakeGRPCServer answers ExecuteQuery with result, recording the requests.
+type fakeGRPCServer struct {
+	mu       sync.Mutex
+	requests [][]byte
+	result   []byte
+}
+
+func (f *fakeGRPCServer) handle(_ interface{}, stream grpc.ServerStream) error {
+	var request []byte
+	if err := stream.RecvMsg(&request); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	result := f.result
+	f.mu.Unlock()
+	return stream.SendMsg(&result)
+}
+
+// startGRPCServer serves handler, or no service at all when it is nil, and
+// returns its address.
+func startGRPCServer(t *testing.T, handler grpc.StreamHandler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(rawCodec{})}
+	if handler != nil {
+		opts = append(opts, grpc.UnknownServiceHandler(handler))
+	}
+	server := grpc.NewServer(opts...)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestGRPCSinkWritesBatch(t *testing.T) {
+	fake := &fakeGRPCServer{}
+	addr := startGRPCServer(t, fake.handle)
+	columns := []column{{name: "message", typ: "String", value: func(entry *logrus.Entry) interface{} { return entry.Message }}}
+	sink, err := newGRPCSink("grpc://u:p@"+addr+"/logs?max_threads=2", "app", columns, settingsClause(map[string]string{"async_insert": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteBatch(context.Background(), []logrus.Entry{{Message: "a"}, {Message: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	requests := fake.requests
+	fake.mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	info := decodeQueryInfo(t, requests[0])
+	if want := "INSERT INTO `app` (`message`) SETTINGS async_insert = 1 FORMAT JSONEachRow"; info.query != want {
+		t.Errorf("query %q, want %q", info.query, want)
+	}
+	if want := "{\"message\":\"a\"}\n{\"message\":\"b\"}\n"; info.input != want {
+		t.Errorf("input %q, want %q", info.input, want)
+	}
+	if info.database != "logs" || info.username != "u" || info.password != "p" {
+		t.Errorf("database %q, username %q, password %q, want logs, u, p", info.database, info.username, info.password)
+	}
+	if info.settings["max_threads"] != "2" || info.settings["date_time_input_format"] != "best_effort" {
+		t.Errorf("settings %v, want max_threads and best effort date parsing", info.settings)
+	}
+
+	// An exception in the result fails the batch with ClickHouse's text.
+	exception := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 60)
+	exception = appendString(exception, 3, "Code: 60. DB::Exception: Table logs.app doesn't exist")
+	fake.mu.Lock()
+	fake.result = protowire.AppendBytes(protowire.AppendTag(nil, 7, protowire.BytesType), exception)
+	fake.mu.Unlock()
+	err = sink.WriteBatch(context.Background(), []logrus.Entry{{Message: "c"}})
+	if err == nil || !strings.Contains(err.Error(), "Code: 60.") {
+		t.Fatalf("WriteBatch returned %v, want the server's exception", err)
+	}
+	if code, ok := errorCode(err); !ok || code != 60 {
+		t.Errorf("error code %d, %v, want 60", code, ok)
+	}
+}
+
+func TestGRPCPingWithoutInterface(t *testing.T) {
+	addr := startGRPCServer(t, nil)
+	sink, err := newGRPCSink("grpc://"+addr, "app", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.ping(context.Background()); err == nil || !strings.Contains(err.Error(), "grpc_port") {
+		t.Fatalf("ping returned %v, want an error pointing at grpc_port", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxErrorBody caps how much of a failed response is quoted in errors.
+const maxErrorBody = 4 << 10
+
+// httpSink inserts batches through ClickHouse's HTTP interface as
+// INSERT ... FORMAT JSONEachRow, or RowBinary when rowBinary is set, for
+// deployments that only expose port 8123. encoders are the RowBinary
+// encoders of columns, built once.
+type httpSink struct {
+	client    *http.Client
+	endpoint  url.URL
+	params    url.Values
+	username  string
+	password  string
+	table     string
+	columns   []column
+	settings  string
+	rowBinary bool
+	encoders  []rowBinaryEncoder
+}
+
+// isHTTPDSN reports whether dsn selects the HTTP transport.
+func isHTTPDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "http://") || strings.HasPrefix(dsn, "https://")
+}
+
+// newHTTPSink parses an http(s):// DSN. Credentials are taken from the URL's
+// user info or the username and password parameters; other parameters, such
+// as database, are passed through to ClickHouse.
+func newHTTPSink(dsn, table string, columns []column, settings string) (*httpSink, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse hook: parsing DSN: %w", err)
+	}
+	params := parsed.Query()
+	s := &httpSink{
+		client:   &http.Client{},
+		endpoint: url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: "/"},
+		params:   url.Values{},
+		username: params.Get("username"),
+		password: params.Get("password"),
+		table:    table,
+		columns:  columns,
+		settings: settings,
+	}
+	if parsed.User != nil {
+		s.username = parsed.User.Username()
+		s.password, _ = parsed.User.Password()
+	}
+	for key, values := range params {
+		if key != "username" && key != "password" {
+			s.params[key] = values
+		}
+	}
+	return s, nil
+}
+
+// WriteBatch posts entries as one JSONEachRow insert.
+func (s *httpSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	return s.WriteTable(ctx, s.table, entries)
+}
+
+// WriteTable is WriteBatch for table instead of the sink's own table.
+func (s *httpSink) WriteTable(ctx context.Context, table string, entries []logrus.Entry) error {
+	return s.write(ctx, table, s.columns, s.encoders, entries)
+}
+
+// writeColumns is WriteBatch for columns of table.
+func (s *httpSink) writeColumns(ctx context.Context, table string, columns []column, entries []logrus.Entry) error {
+	var encoders []rowBinaryEncoder
+	if s.rowBinary {
+		var err error
+		if encoders, err = rowBinaryEncoders(columns); err != nil {
+			return err
+		}
+	}
+	return s.write(ctx, table, columns, encoders, entries)
+}
+
+// write is writeColumns with the RowBinary encoders of columns.
+func (s *httpSink) write(ctx context.Context, table string, columns []column, encoders []rowBinaryEncoder, entries []logrus.Entry) error {
+	settings := batchSettings(ctx, s.settings)
+	var body *bytes.Buffer
+	var query string
+	var err error
+	if s.rowBinary {
+		query = rowBinaryInsertQuery(table, columns, settings)
+		body, err = encodeRowBinary(columns, encoders, entries)
+	} else {
+		query = jsonInsertQuery(table, columns, settings)
+		body, err = encodeJSONEachRow(columns, entries)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.exec(ctx, query, body); err != nil {
+		return &FlushError{Stage: StageExec, Err: err}
+	}
+	return nil
+}
+
+// encodeJSONEachRow encodes the columns of entries as JSONEachRow rows.
+func encodeJSONEachRow(columns []column, entries []logrus.Entry) (*bytes.Buffer, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	row := make(map[string]interface{}, len(columns))
+	for i := range entries {
+		for _, col := range columns {
+			row[col.name] = jsonColumnValue(col.value(&entries[i]))
+		}
+		if err := encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	return &body, nil
+}
+
+// jsonInsertQuery returns the INSERT of columns into table whose data
+// follows as JSONEachRow.
+func jsonInsertQuery(table string, columns []column, settings string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s)%s FORMAT JSONEachRow", quoteTable(table), columnList(columns), settings)
+}
+
+// exec runs query with body as its data. Timestamps are sent as RFC 3339,
+// so best effort date parsing is enabled.
+func (s *httpSink) exec(ctx context.Context, query string, body io.Reader) error {
+	params := url.Values{}
+	for key, values := range s.params {
+		params[key] = values
+	}
+	params.Set("query", query)
+	params.Set("date_time_input_format", "best_effort")
+
+	endpoint := s.endpoint
+	endpoint.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), body)
+	if err != nil {
+		return err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.do(req)
+}
+
+// ping checks that the server answers on its /ping endpoint.
+func (s *httpSink) ping(ctx context.Context) error {
+	endpoint := s.endpoint
+	endpoint.Path = "/ping"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req)
+}
+
+// do sends req and turns a non-200 response into an error carrying the
+// server's message.
+func (s *httpSink) do(req *http.Request) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("clickhouse hook: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// jsonColumnValue converts a column value into its JSONEachRow form.
+func jsonColumnValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// newHTTPHook builds a hook that writes through ClickHouse's HTTP interface.
+func newHTTPHook(dsn string, config Config) (*ClickHouseHook, error) {
+	if config.CustomInsert != "" {
+		return nil, fmt.Errorf("clickhouse hook: custom inserts are not supported over HTTP")
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err = withCredentials(dsn, config)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newHTTPSink(dsn, config.insertTable(), hook.columns, settingsClause(config.QuerySettings))
+	if err != nil {
+		return nil, err
+	}
+	if config.RowBinary {
+		encoders, err := rowBinaryEncoders(hook.columns)
+		if err != nil {
+			return nil, err
+		}
+		sink.rowBinary, sink.encoders = true, encoders
+	}
+	hook.sink = sink
+
+	if config.VerifySchema {
+		return nil, fmt.Errorf("clickhouse hook: schema verification is not supported over HTTP")
+	}
+	if err := hook.connect(context.Background(), func(ctx context.Context) error {
+		return hook.setupRemote(ctx, sink)
+	}); err != nil {
+		return nil, err
+	}
+	if err := hook.start(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// remoteSink is a sink that runs statements itself, over HTTP or gRPC.
+type remoteSink interface {
+	pinger
+	exec(ctx context.Context, query string, body io.Reader) error
+}
+
+// setupRemote pings the server through sink and creates the tables as
+// configured.
+func (hook *ClickHouseHook) setupRemote(ctx context.Context, sink remoteSink) error {
+	config := hook.currentConfig()
+	if err := sink.ping(ctx); err != nil {
+		return pingError(err)
+	}
+	if !config.CreateTableIfNotExists {
+		return nil
+	}
+	if err := sink.exec(ctx, createTableQuery(config, hook.columns), nil); err != nil {
+		return fmt.Errorf("clickhouse hook: creating table %s: %w", config.TableName, err)
+	}
+	if dead := config.DeadLetterTable; dead != "" {
+		deadConfig := config
+		deadConfig.TableName = dead
+		if err := sink.exec(ctx, createTableQuery(deadConfig, hook.deadLetterColumns("")), nil); err != nil {
+			return fmt.Errorf("clickhouse hook: creating table %s: %w", dead, err)
+		}
+	}
+	if config.DistributedTable != "" {
+		if err := sink.exec(ctx, createDistributedQuery(config), nil); err != nil {
+			return fmt.Errorf("clickhouse hook: creating table %s: %w", config.DistributedTable, err)
+		}
+	}
+	return nil
+}
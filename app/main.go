@@ -1,79 +1,2022 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+// Config holds the tunable settings of a ClickHouseHook.
+type Config struct {
+	// BatchSize is the number of buffered entries that triggers a flush.
+	BatchSize int
+
+	// FlushInterval, when non-zero, flushes the buffer on a timer so that
+	// entries are not held indefinitely on a quiet logger.
+	FlushInterval time.Duration
+
+	// MaxEntryAge, when set, bounds how long an entry stays buffered: the
+	// buffer is flushed once its oldest entry has waited this long, checked
+	// every quarter of it, whether or not the batch is full. Entries put
+	// back by a failed flush count from the failure.
+	MaxEntryAge time.Duration
+
+	// DynamicConfigTable, when set, is a table read on start and every
+	// DynamicConfigInterval, a minute by default, to tune the hook without
+	// redeploying. Its rows are selected as
+	//
+	//	SELECT name, toString(value) FROM <DynamicConfigTable>
+	//
+	// so any table with name and value columns will do. The names are
+	// batch_size, flush_interval, as a Go duration such as 10s, and
+	// sample_rate.<level>, such as sample_rate.debug. Changes apply under
+	// the hook's lock; settings missing from the table keep their value,
+	// and rows with other names or invalid values are skipped with a
+	// warning. flush_interval only applies to hooks with a FlushInterval.
+	// While the table doesn't exist the configuration is left as it is. It
+	// needs a native protocol connection.
+	DynamicConfigTable    string
+	DynamicConfigInterval time.Duration
+
+	// SchemaConnection runs table creation, schema verification and the
+	// reads of DynamicConfigTable of a native protocol hook on a pool of
+	// its own with a single connection to the primary server, so their
+	// latency doesn't hold up inserts. The pool is closed once startup is
+	// done, or by Close when DynamicConfigTable keeps using it.
+	SchemaConnection bool
+
+	// IdleFlushDelay, when set, flushes a partial batch once no entry has
+	// been buffered for this long, so the tail of a burst doesn't wait for
+	// FlushInterval. Its goroutine sleeps while the buffer is empty.
+	IdleFlushDelay time.Duration
+
+	// IncludeFields writes entry.Data to a fields column, encoded according
+	// to FieldEncoding. Leave it off for tables created with the original
+	// schema.
+	IncludeFields bool
+
+	// FieldEncoding selects how fields are stored. Defaults to FieldsAsMap.
+	FieldEncoding FieldEncoding
+
+	// MaxRetries is how many more times a failed batch insert is attempted
+	// before flush gives up and keeps the entries buffered.
+	MaxRetries int
+
+	// RetryDelay is the wait before the first retry; it doubles after every
+	// further failure. Defaults to 100ms. For that long after a failed
+	// flush, a full buffer doesn't make Fire flush, leaving the retry to
+	// the flush interval or a later entry.
+	RetryDelay time.Duration
+
+	// Retryable decides whether a failed insert is worth retrying; errors
+	// it rejects fail the flush at once. Defaults to IsTransient.
+	Retryable func(err error) bool
+
+	// MaxBufferSize caps how many entries are kept buffered after a failed
+	// flush. The oldest entries are dropped beyond it; zero means no cap.
+	MaxBufferSize int
+
+	// CompressThreshold, when positive, compresses the oldest entries kept
+	// after a failed flush once there are more than this many, trading CPU
+	// for memory during an outage. They are decompressed by the next flush.
+	// Like the disk buffer, compression only keeps the time, level, message
+	// and fields, the latter as they would be encoded in JSON: the Context,
+	// Caller and Logger of compressed entries are lost, so columns filled
+	// from them, such as caller or ContextExtractor fields, are left empty.
+	CompressThreshold int
+
+	// TableName is the table entries are inserted into, optionally qualified
+	// with a database. Defaults to tiered_logs.
+	TableName string
+
+	// FlushTimeout bounds a whole flush, retries included, so an unresponsive
+	// server cannot block it forever. Zero means no timeout.
+	FlushTimeout time.Duration
+
+	// StatementTimeout bounds each insert attempt on its own, so a hung
+	// statement is abandoned and retried while the FlushTimeout budget
+	// lasts. An attempt never outlives the flush: whichever deadline comes
+	// first applies. Zero means attempts are only bound by FlushTimeout.
+	StatementTimeout time.Duration
+
+	// AdditionalSinks also receive every batch the hook inserts, once the
+	// primary sink has stored it, for example to copy logs to a local file
+	// or a second cluster. FanOutPolicy decides whether their failures fail
+	// the flush. Those that implement io.Closer are closed by Close.
+	AdditionalSinks []Sink
+	FanOutPolicy    FanOutPolicy
+
+	// Registerer, when set, receives the hook's Prometheus metrics.
+	Registerer prometheus.Registerer
+
+	// DefaultFields are merged into the fields of every entry, which take
+	// precedence on conflicts. A value of AutoHostname is replaced with the
+	// result of os.Hostname when the hook is created.
+	DefaultFields map[string]string
+
+	// IncludeCaller writes the entry's call site as file:line to a String
+	// column named caller. It is empty unless the logger has ReportCaller
+	// enabled.
+	IncludeCaller bool
+
+	// IncludeCallerFunction appends the calling function's name to caller.
+	IncludeCallerFunction bool
+
+	// Levels restricts the hook to the given levels. Defaults to all levels.
+	Levels []logrus.Level
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime tune the connection
+	// pool. Zero leaves the database/sql default in place.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// TimePrecision is the number of fractional second digits kept in
+	// event_time: 0 for a DateTime column, 1 to 9 for DateTime64(n).
+	TimePrecision int
+
+	// TimeZone is the location the time column value carries. It changes
+	// how the time is rendered, in the RFC 3339 offsets of JSONEachRow rows
+	// and in dry runs, but never the instant stored: DateTime columns hold
+	// Unix time and both drivers, RowBinary and literals send that. Set the
+	// column's own zone, DateTime('Europe/Paris'), to change how ClickHouse
+	// displays it. Defaults to UTC.
+	TimeZone *time.Location
+
+	// FlushOnLevel, when set, flushes immediately after an entry at this
+	// level or a more severe one is fired, regardless of the batch size,
+	// and even while backing off after a failed flush. An open circuit
+	// breaker still skips the flush.
+	// Fatal and Panic entries are always flushed before Fire returns, even
+	// in async mode, since Logrus exits or panics right after.
+	FlushOnLevel *logrus.Level
+
+	// DeadlineFlushThreshold, when set, flushes an entry before Fire
+	// returns, even in async mode, when its entry.Context has a deadline
+	// less than this far away, so that what a request logs is stored
+	// before the request times out. Entries without a context or deadline
+	// are buffered as usual.
+	DeadlineFlushThreshold time.Duration
+
+	// VerifySchema checks on startup that the target table has every column
+	// the hook writes, with a compatible type.
+	VerifySchema bool
+
+	// CreateTableIfNotExists creates the target table on startup with the
+	// columns the hook writes. TableEngine and TableOrderBy default to
+	// MergeTree ordered by the time column.
+	CreateTableIfNotExists bool
+	TableEngine            string
+	TableOrderBy           string
+
+	// ClusterName, when set, adds ON CLUSTER to the generated DDL and makes
+	// TableEngine default to ReplicatedMergeTree. DistributedTable, which
+	// needs ClusterName, names a Distributed table over TableName that is
+	// created along with it and receives the inserts instead.
+	ClusterName      string
+	DistributedTable string
+
+	// VersionColumn, when set, writes a UInt64 version of every row to a
+	// column of this name, for re-ingested logs deduplicated by
+	// ReplacingMergeTree: when ClickHouse merges parts it collapses rows
+	// with the same sorting key into the one with the highest version, or
+	// the last inserted one among equal versions. Merges happen in the
+	// background at unspecified times, so queries see duplicates until
+	// then unless they use FINAL. VersionFunc computes the version, by
+	// default entry.Time in Unix nanoseconds. Without a TableEngine, the
+	// created table is a ReplacingMergeTree(version), replicated with a
+	// ClusterName; TableOrderBy must then be set to the key duplicates
+	// share, since the default, the time column, would collapse unrelated
+	// entries logged at the same time.
+	VersionColumn string
+	VersionFunc   func(entry *logrus.Entry) uint64
+
+	// TableTTL is an optional TTL clause for the created table, for example
+	// "event_time + INTERVAL 30 DAY TO VOLUME 'cold'". It is only checked
+	// superficially; ClickHouse rejects invalid expressions.
+	TableTTL string
+
+	// MessageCodec is an optional compression codec for the created
+	// message column, for example "ZSTD" or "ZSTD(3)".
+	MessageCodec string
+
+	// DiskBufferDir, when set, spills batches that still fail after all
+	// retries to a JSON lines file in this directory instead of keeping
+	// them in memory. They are replayed after the next successful flush,
+	// and by flushes that find nothing buffered, such as the ticks of
+	// FlushInterval.
+	// DiskBufferMaxBytes caps the file, dropping the oldest entries.
+	DiskBufferDir      string
+	DiskBufferMaxBytes int64
+
+	// DiskBufferMaxFileBytes, when set, rotates the disk buffer once the
+	// file reaches this size: it is gzip-compressed into a numbered
+	// segment and a new file is started. Only the newest
+	// DiskBufferMaxFiles segments are kept (all of them if zero). Replay
+	// reads segments oldest first, then the current file.
+	DiskBufferMaxFileBytes int64
+	DiskBufferMaxFiles     int
+
+	// FailoverDSNs are further servers to insert into when the primary DSN
+	// fails with a connection error. Nodes that fail are skipped for a
+	// while as long as another node is healthy. For the v1 driver, the
+	// alt_hosts DSN parameter is a lighter alternative.
+	FailoverDSNs []string
+
+	// OnRowError, when set, isolates rows the driver rejects: the offending
+	// entry is passed to it with the error and the rest of the batch is
+	// inserted without it. Without it a bad row fails the whole batch.
+	OnRowError func(entry logrus.Entry, err error)
+
+	// MaxMessageBytes truncates longer messages, on a UTF-8 boundary, to
+	// that many bytes ending in a truncation marker, left out when the
+	// limit is too small for it. Zero disables truncation. With
+	// TruncateFields, string field values are truncated the same way.
+	MaxMessageBytes int
+	TruncateFields  bool
+
+	// TraceIDField and SpanIDField name entry fields copied into dedicated
+	// trace_id and span_id String columns for log-to-trace correlation.
+	TraceIDField string
+	SpanIDField  string
+
+	// SourceField names an entry field copied into a source String column,
+	// to tell apart loggers sharing the hook. Named hooks set it.
+	SourceField string
+
+	// RequestIDField names an entry field copied into a request_id String
+	// column, to look logs up by request. Entries without it get "", or
+	// NULL when request_id is in NullableColumns.
+	RequestIDField string
+
+	// SkipInvalid makes ReplayJSONLines skip lines it can't parse instead
+	// of stopping at them.
+	SkipInvalid bool
+
+	// MaxBatchBytes, when set, also flushes once the estimated size of the
+	// buffered entries reaches this many bytes, whichever of it and
+	// BatchSize is hit first.
+	MaxBatchBytes int
+
+	// Logger receives the hook's own diagnostics: retries at Debug, failed
+	// flushes and dropped entries at Warn. It must not have the hook
+	// attached; entries the hook logs are ignored by its Fire regardless.
+	// Nil discards them.
+	Logger logrus.FieldLogger
+
+	// ColumnMap renames the columns the hook writes to match an existing
+	// table. Keys are the logical columns "time", "level", "message" and
+	// "fields"; values are the physical column names. Unmapped columns keep
+	// their default names (event_time, level, message, and fields or
+	// fields_json).
+	ColumnMap map[string]string
+
+	// AsyncQueueSize, when set, makes Fire hand entries to a writer
+	// goroutine through a queue of this capacity instead of buffering and
+	// flushing on the caller's goroutine. OverflowPolicy decides what Fire
+	// does when the queue is full.
+	AsyncQueueSize int
+	OverflowPolicy OverflowPolicy
+
+	// IncludePID writes the process ID to a pid column, and
+	// IncludeGoroutines the number of goroutines when the entry was fired to
+	// a goroutines column. Neither is evaluated when off.
+	IncludePID        bool
+	IncludeGoroutines bool
+
+	// BuildVersion and BuildCommit, when set, are written to
+	// build_version and build_commit LowCardinality(String) columns of
+	// every row, to tell which release logged an entry. WithBuildInfo
+	// fills them in from the binary's build information.
+	BuildVersion string
+	BuildCommit  string
+
+	// IncludeIngestLag writes how long ago, by Clock, the entry was logged
+	// when its batch is inserted to an ingest_lag_ms Int64 column. Retried
+	// and replayed batches are measured when they finally go in.
+	IncludeIngestLag bool
+
+	// SampleRate keeps only the given fraction, from 0 to 1, of the entries
+	// at each level, chosen at random. Levels without a rate keep every
+	// entry. Sampled-out entries are counted in Stats.SampledOut.
+	SampleRate map[logrus.Level]float64
+
+	// ContextExtractor, when set, is called with the Context of entries
+	// that have one, and the fields it returns are merged into the row's
+	// fields between DefaultFields and entry.Data. It runs at flush time,
+	// so entries replayed from the disk buffer, which don't keep their
+	// Context, come back without them.
+	ContextExtractor func(ctx context.Context) map[string]string
+
+	// ShardKeyField and ShardTableFunc split each flush by table: entries
+	// are grouped by ShardTableFunc of their ShardKeyField value and each
+	// group is inserted into that table on its own, so one failing shard
+	// doesn't hold back the others. Entries without the field, or for which
+	// ShardTableFunc returns "", go to TableName. Sinks passed to
+	// NewHookWithSink receive every group through WriteBatch.
+	ShardKeyField  string
+	ShardTableFunc func(key string) string
+
+	// IncludeStackTrace writes the stack trace of the error field of
+	// entries at Error level and above to a stack_trace column, if the error
+	// carries one: either through a StackTrace method, as pkg/errors
+	// provides, or by formatting itself with %+v. Other entries get "".
+	IncludeStackTrace bool
+
+	// DetailedErrors formats error field values, such as the one
+	// logger.WithError stores, with %+v instead of their Error string, so
+	// wrapped chains and stacks that errors print that way are kept.
+	// IncludeErrorColumn also writes the error field to a dedicated error
+	// String column, formatted the same way; entries without one get "".
+	DetailedErrors     bool
+	IncludeErrorColumn bool
+
+	// DryRun logs each INSERT and its row arguments at Info to Logger
+	// instead of running it. The hook never connects to ClickHouse, so
+	// table creation and schema verification are skipped too.
+	DryRun bool
+
+	// Compression, when set, overrides the compress parameter of native
+	// protocol DSNs, failover DSNs included, turning LZ4 compression of
+	// inserted blocks on or off. Nil keeps whatever the DSN says.
+	Compression *bool
+
+	// RemoveExtractedFields controls whether fields that are written to a
+	// column of their own, such as TraceIDField, ArrayColumns or
+	// NumericFields, are left out of the fields column. Nil removes them;
+	// point it at false to store them in both places.
+	RemoveExtractedFields *bool
+
+	// Clock drives the flush timer and retry backoff. Nil uses the system
+	// clock.
+	Clock Clock
+
+	// QuerySettings are appended to every INSERT as a SETTINGS clause, for
+	// example {"async_insert": "1"}. Keys must be plain identifiers; values
+	// that aren't numbers are sent as quoted strings.
+	QuerySettings map[string]string
+
+	// InsertSettingsFunc, when set, is called with every batch, as
+	// Transform leaves it, right before it is inserted, and the settings it
+	// returns are added to the batch's SETTINGS clause, overriding
+	// QuerySettings of the same name. Settings whose names aren't plain
+	// identifiers are skipped with a warning. It doesn't apply to
+	// CustomInsert or to custom Sinks.
+	InsertSettingsFunc func(entries []logrus.Entry) map[string]string
+
+	// Deduplicate collapses entries with the same level, message and fields
+	// within a batch into one row, the first of them, and writes how many
+	// there were to a count column. Counts of entries spilled to the disk
+	// buffer are not preserved.
+	Deduplicate bool
+
+	// OnBackpressure, when set, is called from Fire with BufferPressure
+	// each time it rises to BackpressureThreshold (0.8 if zero) after
+	// having been below it.
+	OnBackpressure        func(ratio float64)
+	BackpressureThreshold float64
+
+	// FieldValueEncoder, when set, renders entry field values for the
+	// fields Map column in place of fmt.Sprint, for example to format
+	// times as RFC 3339 or JSON-encode maps. FieldsAsJSON is unaffected.
+	FieldValueEncoder func(key string, value interface{}) string
+
+	// FlattenDepth, when set, expands field values that are maps with string
+	// keys or structs into one fields Map key per member, joined with dots,
+	// as in user.id, down to this many levels; deeper values are rendered
+	// whole. Structs that implement fmt.Stringer or error are kept as one
+	// value, as are the values of FieldsAsJSON, which keeps nesting anyway.
+	FlattenDepth int
+
+	// DeadLetterTable, when set, receives batches that still fail after
+	// all retries instead of them being kept for the next flush. It has
+	// the columns of the main table plus an error_reason String column
+	// and is created along with it by CreateTableIfNotExists. If the dead
+	// letter insert fails too, the entries are passed to OnRowError when
+	// set, and kept as usual otherwise.
+	DeadLetterTable string
+
+	// FallbackWriter, when set, receives every entry the hook drops because
+	// its buffers are full, as one line of logrus text format, so that it
+	// is at least captured by, say, the container's stderr.
+	FallbackWriter io.Writer
+
+	// RowType, when set, is a struct (or pointer to one) whose exported
+	// fields tagged ch:"column" become extra typed columns. Fields are
+	// filled from entry.Data by column name, converting numbers and parsing
+	// strings, unless the pointer type implements EntryRow. Unsupported
+	// field types are rejected when the hook is built.
+	RowType interface{}
+
+	// PreserveZeroTime writes entries whose Time is unset as the zero time
+	// (1970 once stored). By default Fire stamps them with Clock's current
+	// time instead.
+	PreserveZeroTime bool
+
+	// LevelTableMap routes entries at a level to another table, grouped
+	// and inserted per table like shards. Unmapped levels go to TableName;
+	// ShardKeyField takes precedence for entries that have it.
+	LevelTableMap map[logrus.Level]string
+
+	// DatabaseField routes each entry to the database named by this field,
+	// for a database per tenant: the table picked for it, by sharding or
+	// TableName, is inserted into as <database>.<table>, grouped per
+	// database like shards. Entries without the field, or whose value
+	// isn't a plain identifier, keep the table's own database, or the
+	// connection's default one.
+	DatabaseField string
+
+	// PartitionBucket, when positive, splits every flush into one insert
+	// per bucket of this length the entries' event time falls in, such as
+	// time.Hour for a table partitioned by hour, so that no insert writes
+	// to more than one partition. Buckets are aligned on the Unix epoch;
+	// they combine with sharding into an insert per table and bucket.
+	PartitionBucket time.Duration
+
+	// MinGroupSize, when set, holds back the tables, databases and
+	// partition buckets a flush would insert fewer entries than this into,
+	// so entries spread thin across many of them make fewer, larger
+	// inserts. A group is held at most MaxGroupDelay, which defaults to
+	// the current FlushInterval, and only by flushes due to a full batch or
+	// the flush interval: Flush, Close and Fatal or Panic entries insert
+	// everything. It requires FlushInterval, whose ticks insert the groups
+	// that waited long enough.
+	MinGroupSize  int
+	MaxGroupDelay time.Duration
+
+	// GroupConcurrency, when above 1, runs the inserts of a flush into
+	// different tables, databases or partition buckets concurrently, at
+	// most this many at a time, instead of one after the other. Either
+	// way every group is attempted: the flush fails with the errors of all
+	// groups that failed, joined in group order, and keeps only their
+	// entries. Stats.FailedGroups counts the failed group inserts.
+	GroupConcurrency int
+
+	// NullableColumns lists columns filled from an entry field, trace_id,
+	// span_id or RowType fields without EntryRow, that are created as
+	// Nullable and written as NULL when the entry lacks the field, instead
+	// of as an empty or zero value.
+	NullableColumns []string
+
+	// OnFlush, when set, is called after every batch is inserted, replayed
+	// ones included, with its number of rows and how long the insert took,
+	// retries included. It runs on the goroutine that inserted the batch,
+	// which with GroupConcurrency is one of several, without the hook's
+	// lock held, and must not log through a logger the hook is attached
+	// to. Calls never overlap, so it needn't be safe for concurrent use.
+	OnFlush func(count int, duration time.Duration)
+
+	// BreakerThreshold, when set, opens a circuit breaker after this many
+	// consecutive failed flushes: for BreakerCooldown, 30s by default,
+	// flushes are skipped and their entries kept or dropped as for a failed
+	// flush, with ErrCircuitOpen. The next flush after that is a probe that
+	// closes the breaker if it succeeds and opens it again otherwise.
+	// OnBreakerChange, when set, is called with every new state.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	OnBreakerChange  func(state BreakerState)
+
+	// FlushStrategy selects how the native protocol sink inserts a batch.
+	// FlushStrategyBatch needs the v2 driver.
+	FlushStrategy FlushStrategy
+
+	// IncludeSeverityCode writes a numeric level to a severity UInt8
+	// column, for range queries such as WHERE severity >= 4. logrus numbers
+	// its levels from Panic (0) down to Trace (6); SeverityCode reverses
+	// that so more severe entries have higher codes. SeverityCodes, when
+	// set, replaces the mapping for the levels it lists.
+	IncludeSeverityCode bool
+	SeverityCodes       map[logrus.Level]uint8
+
+	// ArrayColumns lists entry fields written to an Array(String) column of
+	// the same name. A slice or array value becomes one element per item
+	// and any other value a single element; entries without the field get
+	// an empty array.
+	ArrayColumns []string
+
+	// NumericFields maps entry fields to the numeric type, such as UInt64
+	// or Float64, of a column of the same name they are written to, for
+	// aggregating them in ClickHouse. Values are parsed from their string
+	// form; entries without the field, or with one that doesn't parse or
+	// fit, get zero, or NULL for absent fields of NullableColumns.
+	NumericFields map[string]string
+
+	// ColumnTypes maps column names to the ClickHouse type they are
+	// created, verified and, with RowBinary, encoded with, in place of the
+	// one the hook picks, such as UInt32 for a NumericFields column or
+	// LowCardinality(String) for a field column. It applies after
+	// NullableColumns, so a nullable column's type must include Nullable.
+	// Types are only checked to look like one; ClickHouse rejects those
+	// that aren't.
+	ColumnTypes map[string]string
+
+	// TracerProvider, when set, traces every batch insert as a
+	// clickhouse.flush span. Nil uses a no-op provider.
+	TracerProvider trace.TracerProvider
+
+	// Filter, when set, is called with every entry at the start of Fire,
+	// before sampling. Entries it returns false for are skipped and counted
+	// in Stats.Filtered. It runs on the logging goroutine, so it should be
+	// cheap.
+	Filter func(entry *logrus.Entry) bool
+
+	// Transform, when set, is called with every batch right before it is
+	// inserted, retries and disk buffer replays included, to redact,
+	// enrich or filter entries; the entries it returns are inserted. It
+	// gets a copy, Data maps included, so changes don't reach the buffered
+	// entries kept if the insert fails. Entries it leaves out count as
+	// flushed. A panic in it fails the batch, which is kept as for any
+	// failed flush, without retries. With RowMarshaler the rows are
+	// already built, so it can only filter.
+	Transform func(entries []logrus.Entry) []logrus.Entry
+
+	// RowMarshaler, when set, replaces every built-in column: each row is
+	// the values it returns, written to the MarshalColumns in order. It
+	// runs at flush time; entries it fails on are passed to OnRowError, or
+	// dropped. The hook can't know the column types, so
+	// CreateTableIfNotExists and VerifySchema are not available with it.
+	RowMarshaler   RowMarshaler
+	MarshalColumns []string
+
+	// CustomInsert, when set, is the whole INSERT statement the hook runs
+	// for every batch, with CustomInsertArgs returning the bound arguments
+	// of each entry. It bypasses the built-in columns entirely, along with
+	// everything that depends on them: the fields column, table creation,
+	// schema verification, sharding, the dead letter table, deduplication
+	// tokens and FlushStrategyMultiValues. It needs the native protocol.
+	CustomInsert     string
+	CustomInsertArgs func(entry *logrus.Entry) []interface{}
+
+	// TimeField, when set, names an entry field holding the time to write
+	// to the time column instead of entry.Time, for replayed or ingested
+	// logs. It may be a time.Time, an RFC 3339 string or Unix seconds, as a
+	// number or a string. Entries without the field, or with a value that
+	// doesn't parse, fall back to entry.Time, the latter with a warning.
+	TimeField string
+
+	// LazyConnect skips the startup ping, table creation and schema
+	// verification, so the application starts even while ClickHouse is
+	// down. They run before the first flush instead, and again before every
+	// later one until they succeed; entries are kept, or spilled to the
+	// disk buffer, meanwhile, as for any failed flush.
+	LazyConnect bool
+
+	// LevelEnum types the level column as an Enum8 of the logrus level
+	// names, numbered by logrus level, instead of LowCardinality(String).
+	// Levels are still written by name, so an entry at a level logrus
+	// doesn't define, written as "unknown", is rejected by the driver.
+	LevelEnum bool
+
+	// RowBinary sends the inserts of an http:// or https:// DSN in
+	// ClickHouse's RowBinary format instead of JSONEachRow, which is
+	// cheaper for the server to parse and for the hook to encode. Every
+	// column must have a type it can encode: String, DateTime, DateTime64,
+	// integers, floats, Array(String) and Map(String, String), possibly
+	// LowCardinality or Nullable. LevelEnum and RowMarshaler columns can't
+	// be sent this way.
+	RowBinary bool
+
+	// LevelNames overrides the name stored in the level column for the
+	// levels it lists, for example "warn" rather than logrus's "warning",
+	// or syslog's "err" and "crit". Other levels keep logrus's names. The
+	// LevelEnum labels follow it, so names must then be distinct.
+	LevelNames map[logrus.Level]string
+
+	// MaxFieldsPerEntry, when positive, caps the keys stored in the
+	// fields column of an entry, keeping the first ones in sorted order,
+	// so that an entry with hundreds of fields can't blow up the column.
+	// With IncludeFields, how many were dropped is written to a
+	// dropped_fields UInt32 column.
+	MaxFieldsPerEntry int
+
+	// AllowedFields, when set, limits the entry.Data keys stored in the
+	// fields column to those listed, to bound the key cardinality of the
+	// table. The number of keys left out of an entry is stored under
+	// "other". DefaultFields and context fields are not affected.
+	AllowedFields []string
+
+	// IncludeFormatted writes the entry as its logger's formatter renders
+	// it to a formatted column, next to the structured columns. It runs at
+	// flush time; entries without a logger or formatter, such as those
+	// replayed from the disk buffer, are rendered by a plain TextFormatter.
+	IncludeFormatted bool
+
+	// MaxInFlightBatches, when positive, caps how many flushes run at
+	// once, whether started by the writer goroutine, by Fire or by Flush.
+	// Further flushes wait for a slot, leaving their entries buffered
+	// meanwhile, or give up when their context ends.
+	MaxInFlightBatches int
+
+	// ReconnectInterval, when set, periodically replaces the connection
+	// pool of every native protocol node with a new one, so that the
+	// connections of a long-lived process are spread again by a load
+	// balancer in front of the cluster. ConnMaxLifetime does the same one
+	// connection at a time.
+	ReconnectInterval time.Duration
+
+	// MessageTemplate, when set, is a text/template rendering the message
+	// column from the entry, for example
+	// "{{.Message}} status={{.Data.status}}". The template sees the
+	// entry's Message, Level, Time and Data; the fields are still stored as
+	// usual. A missing field renders as "<no value>" unless guarded with
+	// {{with}}. An entry the template fails on keeps its plain message.
+	MessageTemplate string
+
+	// DeduplicationToken sends every batch insert with an
+	// insert_deduplication_token derived from the batch's contents, so an
+	// insert retried after an ambiguous failure is dropped by the server if
+	// the first attempt made it. ClickHouse only deduplicates replicated
+	// tables, and others with non_replicated_deduplication_window set. It
+	// also drops a batch identical to any recent one, entry times included.
+	DeduplicationToken bool
+
+	// TTLField, when set, names an entry field holding the number of days
+	// to keep the entry, written to a retention_days UInt16 column for the
+	// table's TTL to use. Entries without it, or with a value that isn't a
+	// whole number of days, get DefaultRetentionDays. Without a TableTTL,
+	// created tables expire rows retention_days after their time.
+	TTLField             string
+	DefaultRetentionDays uint16
+
+	// UsernameFile and PasswordFile, when set, name files, such as mounted
+	// secrets, holding the username and password to connect with. They are
+	// read once when the hook is created, trailing newlines trimmed, and
+	// override any credentials in the DSN and failover DSNs.
+	UsernameFile string
+	PasswordFile string
+
+	// CredentialProvider, when set, is called for the username and password
+	// every time a connection pool is opened, and overrides the other
+	// credentials. When an insert over the native protocol fails
+	// authentication, as it does once short-lived credentials expire, the
+	// pools are reopened with fresh ones and the insert tried again, at
+	// most once every 30 seconds. Over HTTP and gRPC it is only called
+	// when the hook is created.
+	CredentialProvider func() (username, password string, err error)
+}
+
+// AutoHostname is a DefaultFields value standing for the local host name.
+const AutoHostname = "$hostname"
+
+const (
+	defaultRetryDelay = 100 * time.Millisecond
+	defaultTableName  = "tiered_logs"
+	defaultEngine     = "MergeTree"
+
+	// replicaParams are the ZooKeeper path and replica name of the
+	// replicated engines the hook creates tables with. The macros are
+	// expanded by each server from its configuration.
+	replicaParams = "'/clickhouse/tables/{shard}/{database}/{table}', '{replica}'"
+
+	// defaultReplicatedEngine is the TableEngine default with a ClusterName.
+	defaultReplicatedEngine = "ReplicatedMergeTree(" + replicaParams + ")"
+
+	defaultBackpressureThreshold = 0.8
+	defaultFinalFlushTimeout     = 5 * time.Second
+)
+
+// identifierPattern matches the table names accepted in generated SQL: a plain
+// identifier, optionally qualified by a database identifier.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// namePattern matches the plain identifiers accepted as column names in
+// ColumnMap and as setting names in QuerySettings.
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// typePattern matches what looks like a ClickHouse type: a name, optionally
+// followed by parenthesized arguments.
+var typePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*(\(.*\))?$`)
+
+// codecPattern matches codec specifications such as ZSTD(3) or Delta, ZSTD.
+var codecPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\([0-9, ]*\))?(, *[A-Za-z0-9_]+(\([0-9, ]*\))?)*$`)
+
 type ClickHouseHook struct {
-	db        *sql.DB
+	// primary is the first node of a database/sql hook, where tables are
+	// created; nil with other sinks.
+	primary *node
+	sink    Sink
+	config  Config
+	columns []column
+	rowType *rowType
+	disk    *diskBuffer
+	tracer  trace.Tracer
+
+	// breaker is the BreakerThreshold circuit breaker, nil without one.
+	breaker *breaker
+
+	// random returns the numbers SampleRate is compared with, uniform in
+	// [0, 1). Tests replace it with a seeded source.
+	random func() float64
+
+	// allowed is the set of AllowedFields, nil when every field is kept.
+	allowed map[string]bool
+
+	// extracted is the set of fields left out of the fields column because
+	// they have a column of their own, nil when none are.
+	extracted map[string]bool
+
+	// message is the parsed MessageTemplate, nil without one.
+	message *template.Template
+
+	// mu guards entries, the counters and the metrics. It is never held
+	// while talking to ClickHouse. oldest and newest are when the oldest
+	// and newest entries were buffered, oldest zero while entries is empty.
+	// failedAt is when the last flush failed.
+	mu        sync.Mutex
 	entries   []logrus.Entry
-	batchSize int
+	bytes     int
+	oldest    time.Time
+	newest    time.Time
+	accepted  uint64
+	flushed   uint64
+	batches   uint64
+	failures  uint64
+	dropped   uint64
+	sampled   uint64
+	filtered  uint64
+	panics    uint64
+	groupErrs uint64
+	lastError error
+	failedAt  time.Time
+	latencies latencyRing
+	metrics   *metrics
+
+	// intervals passes flush intervals read from DynamicConfigTable to the
+	// goroutine ticking every FlushInterval; nil without either.
+	intervals chan time.Duration
+
+	// queue feeds the writer goroutine in async mode; nil otherwise.
+	queue chan logrus.Entry
+
+	// idle wakes the IdleFlushDelay goroutine when the buffer stops being
+	// empty; nil without one.
+	idle chan struct{}
+
+	// slots is the MaxInFlightBatches semaphore, nil without a limit.
+	// inFlight counts the flushes running. settled, guarded by mu, is
+	// closed and replaced whenever inFlight drops to zero.
+	slots    chan struct{}
+	inFlight atomic.Int64
+	settled  chan struct{}
+
+	// pressured records whether BufferPressure was last seen at or above
+	// BackpressureThreshold.
+	pressured atomic.Bool
+
+	// ctx is cancelled by Stop. The background goroutines, registered with
+	// wg, flush under it, so Stop aborts a flush in flight, retry backoff
+	// included, instead of waiting it out; the aborted batch is kept for
+	// the final flush.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// limiter rate-limits repeated diagnostics.
+	limiter logLimiter
+
+	// fallbackMu serialises writes to FallbackWriter.
+	fallbackMu sync.Mutex
+	// onFlushMu serialises calls to OnFlush, which the group inserts of
+	// GroupConcurrency would otherwise make concurrently.
+	onFlushMu sync.Mutex
+
+	// held are entries of small groups set aside by holdBack, and
+	// heldSince when each group was first held. Both are guarded by mu.
+	held      []logrus.Entry
+	heldSince map[string]time.Time
+
+	// packed are the gzip-compressed chunks of entries pack set aside, oldest
+	// first, and packedCount how many entries they hold. compressionIn and
+	// compressionOut count the bytes pack compressed and what they came to.
+	// All are guarded by mu.
+	packed         []packedChunk
+	packedCount    int
+	compressionIn  uint64
+	compressionOut uint64
+
+	// sinkErrors counts the failed writes of each of the AdditionalSinks,
+	// and sinkKept holds the batches FanOutFailFast keeps for each of them.
+	// Both are guarded by mu.
+	sinkErrors []uint64
+	sinkKept   [][]sinkBatch
+
+	// droppedCh is the channel DroppedChan returns, made on its first call.
+	droppedOnce sync.Once
+	droppedCh   atomic.Pointer[chan logrus.Entry]
+
+	// setup is the startup work LazyConnect deferred, set until it
+	// succeeds. setupMu serialises attempts at it.
+	setupMu sync.Mutex
+	setup   func(ctx context.Context) error
+
+	// schemaMu guards schema, the pool of the SchemaConnection while it is
+	// open, and is held while it is in use.
+	schemaMu sync.Mutex
+	schema   *sql.DB
+
+	// refreshMu guards refreshedAt, when the pools were last reopened for
+	// CredentialProvider.
+	refreshMu   sync.Mutex
+	refreshedAt time.Time
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// closed is set once Close has closed the sink.
+	closed atomic.Bool
 }
 
 // NewClickHouseHook establishes a connection to ClickHouse using the provided DSN.
-func NewClickHouseHook(dsn string, batchSize int) (*ClickHouseHook, error) {
-	db, err := sql.Open("clickhouse", dsn)
+func NewClickHouseHook(dsn string, batchSize int, opts ...Option) (*ClickHouseHook, error) {
+	return NewClickHouseHookWithConfig(dsn, Config{BatchSize: batchSize}, opts...)
+}
+
+// NewClickHouseHookWithConfig establishes a connection to ClickHouse using the
+// provided DSN and starts the background flusher if config asks for one.
+// A tcp:// DSN uses the native protocol; http:// and https:// use the HTTP
+// interface instead, and grpc:// and grpcs:// the gRPC interface.
+func NewClickHouseHookWithConfig(dsn string, config Config, opts ...Option) (*ClickHouseHook, error) {
+	config, err := prepareConfig(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	if config.DryRun {
+		return newDryRunHook(config)
+	}
+	if isHTTPDSN(dsn) {
+		return newHTTPHook(dsn, config)
+	}
+	if config.RowBinary {
+		return nil, fmt.Errorf("clickhouse hook: RowBinary inserts need an HTTP DSN")
+	}
+	if isGRPCDSN(dsn) {
+		return newGRPCHook(dsn, config)
+	}
+
+	primary, err := openNode(dsn, config)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
-		if exception, ok := err.(*clickhouse.Exception); ok {
-			log.Fatalf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace)
-		} else {
-			log.Fatal(err)
+	nodes := []*node{primary}
+	for _, failover := range config.FailoverDSNs {
+		n, err := openNode(failover, config)
+		if err != nil {
+			closeNodes(nodes)
+			return nil, err
 		}
+		nodes = append(nodes, n)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		closeNodes(nodes)
+		return nil, err
+	}
+	hook.primary = nodes[0]
+	sink := newSQLSink(nodes, config.insertTable(), hook.columns, settingsClause(config.QuerySettings), config.OnRowError, config.FlushStrategy)
+	if config.CustomInsert != "" {
+		sink.query, sink.args = config.CustomInsert, config.CustomInsertArgs
 	}
-	return &ClickHouseHook{db: db, batchSize: batchSize}, nil
+	hook.sink = sink
+	if err := hook.connect(context.Background(), hook.setupSQL); err != nil {
+		closeNodes(nodes)
+		return nil, err
+	}
+	if err := hook.start(); err != nil {
+		closeNodes(nodes)
+		return nil, err
+	}
+	if config.ReconnectInterval > 0 {
+		hook.wg.Add(1)
+		go hook.runReconnect(nodes, config.Clock.NewTicker(config.ReconnectInterval))
+	}
+	return hook, nil
 }
 
-// Fire is triggered by Logrus to log entries to ClickHouse.
-func (hook *ClickHouseHook) Fire(entry *logrus.Entry) error {
-	hook.entries = append(hook.entries, *entry)
-	if len(hook.entries) >= hook.batchSize {
-		if err := hook.flush(); err != nil {
+// setupSQL pings the primary node and creates or verifies the tables as
+// configured, on the SchemaConnection if there is one.
+func (hook *ClickHouseHook) setupSQL(ctx context.Context) error {
+	if err := hook.primary.withDB(func(db *sql.DB) error {
+		return db.PingContext(ctx)
+	}); err != nil {
+		return pingError(err)
+	}
+	return hook.withSchemaDB(func(db *sql.DB) error {
+		config := hook.currentConfig()
+		if config.CreateTableIfNotExists {
+			if err := createTable(ctx, db, config, hook.columns); err != nil {
+				return err
+			}
+			if dead := config.DeadLetterTable; dead != "" {
+				deadConfig := config
+				deadConfig.TableName = dead
+				if err := createTable(ctx, db, deadConfig, hook.deadLetterColumns("")); err != nil {
+					return err
+				}
+			}
+			if config.DistributedTable != "" {
+				if _, err := db.ExecContext(ctx, createDistributedQuery(config)); err != nil {
+					return fmt.Errorf("clickhouse hook: creating table %s: %w", config.DistributedTable, err)
+				}
+			}
+		}
+		if config.VerifySchema {
+			return verifySchema(ctx, db, config.TableName, hook.columns)
+		}
+		return nil
+	})
+}
+
+// runReconnect reopens the pool of every node on each tick until Stop is
+// called. Buffered entries are unaffected, and flushes in progress finish
+// on the old pools first.
+func (hook *ClickHouseHook) runReconnect(nodes []*node, ticker Ticker) {
+	defer hook.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			for _, n := range nodes {
+				if err := n.reopen(hook.currentConfig()); err != nil {
+					hook.logLimited(hook.log(), logrus.WarnLevel, err, "reconnecting failed")
+				}
+			}
+		case <-hook.ctx.Done():
+			return
+		}
+	}
+}
+
+// connect runs setup, or with LazyConnect defers it to the first flush.
+func (hook *ClickHouseHook) connect(ctx context.Context, setup func(ctx context.Context) error) error {
+	if !hook.config.LazyConnect {
+		return setup(ctx)
+	}
+	hook.setup = setup
+	return nil
+}
+
+// ready runs the setup deferred by LazyConnect, if it hasn't succeeded yet.
+// It fails with ErrNotConnected when there is no sink to flush to, or it
+// was closed.
+func (hook *ClickHouseHook) ready(ctx context.Context) error {
+	if hook.sink == nil || hook.closed.Load() {
+		return ErrNotConnected
+	}
+	hook.setupMu.Lock()
+	defer hook.setupMu.Unlock()
+
+	if hook.setup == nil {
+		return nil
+	}
+	if err := hook.setup(ctx); err != nil {
+		return err
+	}
+	hook.setup = nil
+	return nil
+}
+
+// NewClickHouseHookContext is NewClickHouseHook with the hook's lifetime
+// tied to ctx: once ctx is done the hook is closed as by Close. The final
+// flush runs with a fresh context bounded by FlushTimeout, or
+// defaultFinalFlushTimeout if unset, so the cancellation doesn't abort it.
+// Close may still be called; it returns the final flush's error.
+func NewClickHouseHookContext(ctx context.Context, dsn string, batchSize int, opts ...Option) (*ClickHouseHook, error) {
+	hook, err := NewClickHouseHook(dsn, batchSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			err := hook.close(func() error {
+				timeout := hook.config.FlushTimeout
+				if timeout <= 0 {
+					timeout = defaultFinalFlushTimeout
+				}
+				flushCtx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				return hook.flushContext(flushCtx)
+			})
+			if err != nil {
+				hook.log().WithError(err).Warn("closing on context cancellation failed")
+			}
+		case <-hook.ctx.Done():
+		}
+	}()
+	return hook, nil
+}
+
+// prepareConfig applies opts to config, rejects it if Validate finds
+// problems and fills in defaults.
+func prepareConfig(config Config, opts []Option) (Config, error) {
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+	if config.TableName == "" {
+		config.TableName = defaultTableName
+	}
+	if config.DynamicConfigTable != "" && config.DynamicConfigInterval == 0 {
+		config.DynamicConfigInterval = defaultDynamicConfigInterval
+	}
+	if config.BackpressureThreshold == 0 {
+		config.BackpressureThreshold = defaultBackpressureThreshold
+	}
+
+	defaults, err := resolveDefaultFields(config.DefaultFields)
+	if err != nil {
+		return config, err
+	}
+	config.DefaultFields = defaults
+	if config.Logger == nil {
+		config.Logger = discardLogger()
+	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	if config.BreakerThreshold > 0 && config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = defaultBreakerCooldown
+	}
+	if config.TimeZone == nil {
+		config.TimeZone = time.UTC
+	}
+	if config.Retryable == nil {
+		config.Retryable = IsTransient
+	}
+	if config.TracerProvider == nil {
+		config.TracerProvider = noop.NewTracerProvider()
+	}
+	return config, nil
+}
+
+// newHook builds a hook for config without a Sink. The caller sets the sink
+// and then calls start.
+func newHook(config Config) (*ClickHouseHook, error) {
+	hook := &ClickHouseHook{
+		config:  config,
+		metrics: newMetrics(),
+		tracer:  config.TracerProvider.Tracer(tracerName),
+		random:  rand.Float64,
+
+		heldSince: make(map[string]time.Time),
+		settled:   make(chan struct{}),
+
+		sinkErrors: make([]uint64, len(config.AdditionalSinks)),
+		sinkKept:   make([][]sinkBatch, len(config.AdditionalSinks)),
+	}
+	hook.ctx, hook.cancel = context.WithCancel(context.Background())
+	if config.DiskBufferDir != "" {
+		disk, err := newDiskBuffer(config.DiskBufferDir, config.DiskBufferMaxBytes,
+			config.DiskBufferMaxFileBytes, config.DiskBufferMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		hook.disk = disk
+	}
+	if config.IdleFlushDelay > 0 {
+		hook.idle = make(chan struct{}, 1)
+	}
+	if config.BreakerThreshold > 0 {
+		hook.breaker = &breaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown}
+	}
+	if config.RowType != nil {
+		rowType, err := newRowType(config.RowType)
+		if err != nil {
+			return nil, err
+		}
+		hook.rowType = rowType
+	}
+	if config.AsyncQueueSize > 0 {
+		hook.queue = make(chan logrus.Entry, config.AsyncQueueSize)
+	}
+	if config.MessageTemplate != "" {
+		message, err := template.New("message").Parse(config.MessageTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("clickhouse hook: parsing message template: %w", err)
+		}
+		hook.message = message
+	}
+	if config.MaxInFlightBatches > 0 {
+		hook.slots = make(chan struct{}, config.MaxInFlightBatches)
+	}
+	if len(config.AllowedFields) > 0 {
+		hook.allowed = make(map[string]bool, len(config.AllowedFields))
+		for _, key := range config.AllowedFields {
+			hook.allowed[key] = true
+		}
+	}
+	hook.columns = hook.buildColumns()
+	if err := makeNullable(hook.columns, config.NullableColumns); err != nil {
+		return nil, err
+	}
+	if err := setColumnTypes(hook.columns, config.ColumnTypes); err != nil {
+		return nil, err
+	}
+	if config.RemoveExtractedFields == nil || *config.RemoveExtractedFields {
+		hook.extracted = extractedFields(hook.columns)
+	}
+	return hook, nil
+}
+
+// start registers the metrics and starts the background flusher, or the
+// writer in async mode, if configured.
+func (hook *ClickHouseHook) start() error {
+	if hook.config.DynamicConfigTable != "" && hook.primary == nil {
+		return errors.New("clickhouse hook: DynamicConfigTable needs a native protocol connection")
+	}
+	if hook.config.Registerer != nil {
+		if err := hook.metrics.register(hook.config.Registerer); err != nil {
 			return err
 		}
 	}
+	var ticker Ticker
+	if hook.config.FlushInterval > 0 {
+		// Created here rather than by the goroutine so that a FakeClock
+		// advanced right after construction already drives it.
+		ticker = hook.config.Clock.NewTicker(hook.config.FlushInterval)
+		if hook.config.DynamicConfigTable != "" {
+			hook.intervals = make(chan time.Duration, 1)
+		}
+	}
+	switch {
+	case hook.queue != nil:
+		hook.wg.Add(1)
+		go hook.runWriter(ticker)
+	case ticker != nil:
+		hook.wg.Add(1)
+		go hook.runFlusher(ticker)
+	}
+	if hook.idle != nil {
+		hook.wg.Add(1)
+		go hook.runIdleFlusher()
+	}
+	if hook.config.MaxEntryAge > 0 {
+		hook.wg.Add(1)
+		go hook.runAgeFlusher(hook.config.Clock.NewTicker(max(hook.config.MaxEntryAge/ageChecks, 1)))
+	}
+	if hook.config.DynamicConfigTable != "" {
+		hook.wg.Add(1)
+		go hook.runConfigPoller(hook.config.Clock.NewTicker(hook.config.DynamicConfigInterval))
+	}
 	return nil
 }
 
-// flush sends the collected log entries to ClickHouse in a batch.
-func (hook *ClickHouseHook) flush() error {
-	tx, err := hook.db.Begin()
+// pingError wraps a failed startup ping, with the details of the exception
+// when ClickHouse returned one.
+func pingError(err error) error {
+	return fmt.Errorf("clickhouse hook: ping: %w", describeException(err))
+}
+
+// openPool opens dsn and applies the configured pool settings.
+func openPool(dsn string, config Config) (*sql.DB, error) {
+	dsn, err := connDSN(dsn, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	db, err := openDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	return db, nil
+}
 
-	stmt, err := tx.Prepare("INSERT INTO tiered_logs (event_time, level, message) VALUES (?, ?, ?)")
+// openBatch opens the native batch connection of FlushStrategyBatch to dsn.
+func openBatch(dsn string, config Config) (batchConn, error) {
+	dsn, err := connDSN(dsn, config)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return openBatchConn(dsn, config)
+}
+
+// connDSN returns dsn with the configured credentials and compression.
+func connDSN(dsn string, config Config) (string, error) {
+	dsn, err := withCredentials(dsn, config)
+	if err != nil {
+		return "", err
+	}
+	if config.Compression != nil {
+		return setDSNParam(dsn, "compress", strconv.FormatBool(*config.Compression))
+	}
+	return dsn, nil
+}
+
+// closeNodes closes every node's pool and returns the first error.
+func closeNodes(nodes []*node) error {
+	var first error
+	for _, n := range nodes {
+		if err := n.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// resolveDefaultFields copies defaults, substituting the host name for
+// AutoHostname values.
+func resolveDefaultFields(defaults map[string]string) (map[string]string, error) {
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+	resolved := make(map[string]string, len(defaults))
+	for key, value := range defaults {
+		if value == AutoHostname {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("clickhouse hook: resolving hostname for field %q: %w", key, err)
+			}
+			value = hostname
+		}
+		resolved[key] = value
+	}
+	return resolved, nil
+}
+
+// runFlusher flushes the buffer on every tick until Stop is called.
+func (hook *ClickHouseHook) runFlusher(ticker Ticker) {
+	defer hook.wg.Done()
+	defer func() { ticker.Stop() }()
+
+	for {
+		select {
+		case <-ticker.C():
+			// A failed flush keeps its entries buffered, so the next
+			// tick (or a full batch) retries them.
+			hook.backgroundFlush()
+		case interval := <-hook.intervals:
+			ticker.Stop()
+			ticker = hook.config.Clock.NewTicker(interval)
+		case <-hook.ctx.Done():
+			return
+		}
+	}
+}
+
+// ageChecks is how many times per MaxEntryAge the age of the oldest entry
+// is checked.
+const ageChecks = 4
+
+// runAgeFlusher flushes the buffer on ticks where its oldest entry has
+// reached MaxEntryAge, until Stop is called.
+func (hook *ClickHouseHook) runAgeFlusher(ticker Ticker) {
+	defer hook.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			hook.mu.Lock()
+			oldest := hook.oldest
+			hook.mu.Unlock()
+			if !oldest.IsZero() && hook.config.Clock.Now().Sub(oldest) >= hook.config.MaxEntryAge {
+				hook.backgroundFlush()
+			}
+		case <-hook.ctx.Done():
+			return
+		}
+	}
+}
+
+// runIdleFlusher flushes the buffer once IdleFlushDelay has passed since
+// the last entry was buffered, sleeping while it is empty, until Stop is
+// called.
+func (hook *ClickHouseHook) runIdleFlusher() {
+	defer hook.wg.Done()
+
+	for {
+		select {
+		case <-hook.idle:
+		case <-hook.ctx.Done():
+			return
+		}
+		for {
+			hook.mu.Lock()
+			empty, newest := len(hook.entries) == 0, hook.newest
+			hook.mu.Unlock()
+			if empty {
+				break
+			}
+			wait := hook.config.IdleFlushDelay - hook.config.Clock.Now().Sub(newest)
+			if wait <= 0 {
+				hook.backgroundFlush()
+				break
+			}
+			timer := hook.config.Clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+				timer.Stop()
+			case <-hook.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
 	}
-	defer stmt.Close()
+}
+
+// backgroundFlush is flush for the background goroutines, cancelled by Stop.
+// It may hold back small groups.
+func (hook *ClickHouseHook) backgroundFlush() error {
+	return hook.boundedFlush(withHold(hook.ctx))
+}
+
+// Stop terminates the background flusher, aborting a flush it has in
+// flight, and waits for it to exit. Buffered entries, including those still
+// queued in async mode and those of the aborted flush, are left in place.
+// It is safe to call more than once.
+func (hook *ClickHouseHook) Stop() {
+	hook.cancel()
+	hook.wg.Wait()
+	hook.drainQueue()
+}
 
-	for _, entry := range hook.entries {
-		if _, err := stmt.Exec(entry.Time, entry.Level.String(), entry.Message); err != nil {
+// Close stops the background flusher, flushes any buffered entries and
+// closes the database connection, then logs a summary of the hook's
+// lifetime counters to Logger. It is safe to call more than once; every
+// call returns the first error encountered by the first one. Entries fired
+// afterwards are still buffered, but flushing them fails with
+// ErrNotConnected.
+func (hook *ClickHouseHook) Close() error {
+	return hook.close(hook.flush)
+}
+
+// DB returns the connection pool of the primary server, for running other
+// queries on it instead of opening a second pool, or nil when the hook
+// doesn't write through database/sql. Use it at your own risk: the pool
+// belongs to the hook, which closes it in Close, the only safe way to close
+// it. With ReconnectInterval the pool is replaced, and the old one closed,
+// periodically, so call DB for every use rather than keeping the result.
+func (hook *ClickHouseHook) DB() *sql.DB {
+	if hook.primary == nil {
+		return nil
+	}
+	var pool *sql.DB
+	hook.primary.withDB(func(db *sql.DB) error {
+		pool = db
+		return nil
+	})
+	return pool
+}
+
+// close is Close with flush doing the final flush.
+func (hook *ClickHouseHook) close(flush func() error) error {
+	hook.closeOnce.Do(func() {
+		hook.Stop()
+		hook.closeErr = flush()
+		for _, sink := range append([]Sink{hook.sink}, hook.config.AdditionalSinks...) {
+			if closer, ok := sink.(io.Closer); ok {
+				if err := closer.Close(); err != nil && hook.closeErr == nil {
+					hook.closeErr = err
+				}
+			}
+		}
+		if err := hook.closeSchemaPool(); err != nil && hook.closeErr == nil {
+			hook.closeErr = err
+		}
+		hook.closed.Store(true)
+		hook.logSummary()
+	})
+	return hook.closeErr
+}
+
+// logSummary logs the lifetime counters at Info, once the hook is closed.
+func (hook *ClickHouseHook) logSummary() {
+	stats := hook.Stats()
+	hook.log().WithFields(logrus.Fields{
+		"entries":      stats.TotalEntries,
+		"flushed":      stats.TotalFlushed,
+		"batches":      stats.Batches,
+		"dropped":      stats.DroppedEntries,
+		"flush_errors": stats.FlushErrors,
+		"unflushed":    stats.Buffered,
+	}).Info("hook closed")
+}
+
+// Flush inserts everything buffered now, including entries still queued in
+// async mode, instead of waiting for a full batch or the flush interval. It
+// is safe to call concurrently with logging; entries fired meanwhile go into
+// the next batch.
+func (hook *ClickHouseHook) Flush() error {
+	hook.drainQueue()
+	return hook.flush()
+}
+
+// Drain flushes everything buffered, like Flush, then waits for flushes
+// running on other goroutines to finish, repeating until nothing is
+// buffered or in flight. Unlike Close it leaves the hook usable. It returns
+// the error of a failed flush, or, when ctx expires first, an error
+// wrapping ctx's. Under constant logging it may only return with ctx.
+func (hook *ClickHouseHook) Drain(ctx context.Context) error {
+	for {
+		hook.drainQueue()
+		if err := hook.boundedFlush(ctx); err != nil {
 			return err
 		}
+
+		hook.mu.Lock()
+		pending := len(hook.entries) + len(hook.held) + hook.packedCount
+		busy := hook.inFlight.Load() > 0
+		settled := hook.settled
+		hook.mu.Unlock()
+		switch {
+		case !busy && pending == 0:
+			return nil
+		case busy:
+			select {
+			case <-settled:
+			case <-ctx.Done():
+				return fmt.Errorf("clickhouse hook: draining with %d entries buffered and flushes in flight: %w", pending, ctx.Err())
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("clickhouse hook: draining with %d entries buffered: %w", pending, err)
+		}
 	}
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// flushDone counts a flush as finished, waking Drain once none are left.
+func (hook *ClickHouseHook) flushDone() {
+	if hook.inFlight.Add(-1) > 0 {
+		return
 	}
+	hook.mu.Lock()
+	close(hook.settled)
+	hook.settled = make(chan struct{})
+	hook.mu.Unlock()
+}
 
-	// Clear the entries after flushing
+// Reset discards everything buffered, and entries still queued in async
+// mode, without inserting it, counting it as dropped. The entries are lost:
+// it is meant for controlled cases such as a forked child or a fast exit on
+// a fatal error, not as a way to shed load. A flush already in progress is
+// not affected.
+func (hook *ClickHouseHook) Reset() {
+	hook.drainQueue()
+
+	hook.mu.Lock()
+	unpacked, lossErr := hook.unpack()
+	entries := slices.Concat(unpacked, hook.takeHeld(), hook.entries)
+	discarded := len(entries)
 	hook.entries = nil
+	hook.bytes = 0
+	hook.oldest = time.Time{}
+	hook.dropped += uint64(discarded)
+	hook.metrics.dropped.Add(float64(discarded))
+	hook.metrics.buffered.Set(0)
+	hook.mu.Unlock()
+	hook.reportLost(lossErr)
+	hook.emitDropped(entries)
+}
+
+// Fire is triggered by Logrus to log entries to ClickHouse.
+// It is safe to call from multiple goroutines. In async mode it only queues
+// the entry, until the hook is stopped. A panic in it is recovered, counted
+// in Stats.Panics and returned as an error. An entry whose Filter or
+// sampling panicked is dropped; one that passed them is buffered as it was
+// passed in, unless it already was.
+func (hook *ClickHouseHook) Fire(entry *logrus.Entry) (err error) {
+	var state fireState
+	defer func() {
+		if r := recover(); r != nil {
+			err = hook.recoverFire(entry, state, r)
+		}
+	}()
+	return hook.fire(entry, &state)
+}
+
+// fireState records how far fire got with an entry.
+type fireState struct {
+	// kept is set once the entry passed Filter and SampleRate.
+	kept bool
+	// buffered is set once the entry is queued or buffered.
+	buffered bool
+}
+
+// recoverFire handles a panic r recovered from fire, buffering entry if it
+// was kept but not buffered yet.
+func (hook *ClickHouseHook) recoverFire(entry *logrus.Entry, state fireState, r interface{}) error {
+	err := hook.recovered("Fire", r)
+	if state.kept && !state.buffered {
+		hook.buffer(entry)
+	}
+	return err
+}
+
+// recovered counts and reports a panic r recovered in where, returning it
+// as an error.
+func (hook *ClickHouseHook) recovered(where string, r interface{}) error {
+	err := fmt.Errorf("clickhouse hook: recovered panic in %s: %v", where, r)
+	hook.mu.Lock()
+	hook.panics++
+	hook.mu.Unlock()
+	hook.logLimited(hook.log(), logrus.ErrorLevel, err, "recovered panic in "+where)
+	return err
+}
+
+// fire is Fire, recording its progress with entry in state.
+func (hook *ClickHouseHook) fire(entry *logrus.Entry, state *fireState) error {
+	if isDiagnostic(entry) {
+		return nil
+	}
+	if hook.config.Filter != nil && !hook.config.Filter(entry) {
+		hook.mu.Lock()
+		hook.filtered++
+		hook.mu.Unlock()
+		return nil
+	}
+	if !hook.sample(entry.Level) {
+		hook.mu.Lock()
+		hook.sampled++
+		hook.mu.Unlock()
+		hook.emitDropped([]logrus.Entry{*entry})
+		return nil
+	}
+	state.kept = true
+	if entry.Time.IsZero() && !hook.config.PreserveZeroTime {
+		stamped := *entry
+		stamped.Time = hook.config.Clock.Now()
+		entry = &stamped
+	}
+	if hook.config.IncludeGoroutines {
+		entry = withGoroutines(entry)
+	}
+	terminal := entry.Level <= logrus.FatalLevel
+	due := hook.nearDeadline(entry)
+	if hook.config.OnBackpressure != nil {
+		defer hook.checkPressure()
+	}
+	if hook.queue != nil && !hook.stopped() && !terminal && !due {
+		hook.enqueue(entry)
+		state.buffered = true
+		return nil
+	}
+	if terminal || due {
+		// Keep what was queued ahead of this entry ahead of it.
+		hook.drainQueue()
+	}
+	full := hook.buffer(entry)
+	state.buffered = true
+	if full || due {
+		if terminal || due {
+			return hook.flush()
+		}
+		if hook.backingOff() && !hook.flushOnLevel(entry.Level) {
+			return nil
+		}
+		return hook.boundedFlush(withHold(context.Background()))
+	}
 	return nil
 }
 
+// buffer appends entry to the buffer and reports whether a flush is due.
+func (hook *ClickHouseHook) buffer(entry *logrus.Entry) bool {
+	hook.mu.Lock()
+	now := hook.config.Clock.Now()
+	if len(hook.entries) == 0 {
+		hook.oldest = now
+		if hook.idle != nil {
+			select {
+			case hook.idle <- struct{}{}:
+			default:
+			}
+		}
+	}
+	hook.newest = now
+	hook.entries = append(hook.entries, *entry)
+	hook.bytes += entrySize(entry)
+	full := len(hook.entries) >= hook.config.BatchSize ||
+		(hook.config.MaxBatchBytes > 0 && hook.bytes >= hook.config.MaxBatchBytes) ||
+		hook.urgent(entry.Level)
+	hook.accepted++
+	hook.metrics.entries.Inc()
+	hook.metrics.buffered.Set(float64(len(hook.entries)))
+	hook.mu.Unlock()
+	return full
+}
+
+// backingOff reports whether the last flush failed less than RetryDelay
+// ago, so that a buffer left full by it isn't flushed, with retries, on
+// the goroutine of every Fire that follows.
+func (hook *ClickHouseHook) backingOff() bool {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	return !hook.failedAt.IsZero() && hook.config.Clock.Now().Sub(hook.failedAt) < hook.retryDelay(0)
+}
+
+// nearDeadline reports whether the deadline of entry.Context is within
+// DeadlineFlushThreshold.
+func (hook *ClickHouseHook) nearDeadline(entry *logrus.Entry) bool {
+	if hook.config.DeadlineFlushThreshold <= 0 || entry.Context == nil {
+		return false
+	}
+	deadline, ok := entry.Context.Deadline()
+	return ok && deadline.Sub(hook.config.Clock.Now()) < hook.config.DeadlineFlushThreshold
+}
+
+// sample reports whether an entry at level survives SampleRate.
+func (hook *ClickHouseHook) sample(level logrus.Level) bool {
+	hook.mu.Lock()
+	rate, ok := hook.config.SampleRate[level]
+	hook.mu.Unlock()
+	return !ok || rate >= 1 || hook.random() < rate
+}
+
+// entrySize estimates the bytes an entry occupies in a batch. It avoids
+// formatting field values, so non-string values count as a fixed size.
+func entrySize(entry *logrus.Entry) int {
+	const fixed = 32 // event_time, level and per-row overhead
+	size := fixed + len(entry.Message)
+	for key, value := range entry.Data {
+		size += len(key)
+		switch v := value.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// urgent reports whether entries at level must be flushed straight away.
+// Logrus orders levels from most severe (Panic) to least (Trace).
+func (hook *ClickHouseHook) urgent(level logrus.Level) bool {
+	return level <= logrus.FatalLevel || hook.flushOnLevel(level)
+}
+
+// flushOnLevel reports whether FlushOnLevel covers entries at level, which
+// are flushed even while backingOff.
+func (hook *ClickHouseHook) flushOnLevel(level logrus.Level) bool {
+	return hook.config.FlushOnLevel != nil && level <= *hook.config.FlushOnLevel
+}
+
+// flush sends the collected log entries to ClickHouse in a batch, bounded
+// by FlushTimeout.
+func (hook *ClickHouseHook) flush() error {
+	return hook.boundedFlush(context.Background())
+}
+
+// boundedFlush is flushContext under ctx, bounded by FlushTimeout.
+func (hook *ClickHouseHook) boundedFlush(ctx context.Context) error {
+	if hook.config.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.config.FlushTimeout)
+		defer cancel()
+	}
+	return hook.flushContext(ctx)
+}
+
+// flushContext sends the collected log entries to ClickHouse in a batch.
+// The buffer is swapped out under the lock so logging can continue
+// while the insert is in flight; on failure the entries are spilled to
+// the disk buffer or put back in front of anything buffered in the
+// meantime. After a successful insert the disk buffer is replayed. A panic
+// before the insert is recovered, counted in Stats.Panics and handled as a
+// failed insert of the swapped out entries.
+func (hook *ClickHouseHook) flushContext(ctx context.Context) (err error) {
+	if hook.slots != nil {
+		select {
+		case hook.slots <- struct{}{}:
+			defer func() { <-hook.slots }()
+		case <-ctx.Done():
+			return fmt.Errorf("clickhouse hook: waiting for a flush slot: %w", ctx.Err())
+		}
+	}
+	hook.inFlight.Add(1)
+	defer hook.flushDone()
+
+	hook.mu.Lock()
+	unpacked, lossErr := hook.unpack()
+	entries := slices.Concat(unpacked, hook.takeHeld(), hook.entries)
+	batchSize := hook.config.BatchSize
+	hook.entries = nil
+	hook.bytes = 0
+	hook.oldest = time.Time{}
+	hook.metrics.buffered.Set(0)
+	hook.mu.Unlock()
+	hook.reportLost(lossErr)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = hook.recovered("flush", r)
+			if len(entries) > 0 {
+				err = hook.fail(entries, err)
+			}
+		}
+	}()
+	if hook.mayHold(ctx) {
+		entries = hook.holdBack(entries)
+	}
+	if len(entries) == 0 {
+		return hook.replayIdle(ctx, batchSize)
+	}
+	if hook.config.Deduplicate {
+		entries = dedup(entries)
+	}
+	if hook.config.RowMarshaler != nil {
+		if entries = hook.marshalRows(entries); len(entries) == 0 {
+			return nil
+		}
+	}
+	if !hook.breakerAllow() {
+		return hook.fail(entries, ErrCircuitOpen)
+	}
+	if err := hook.ready(ctx); err != nil {
+		hook.breakerRecord(true)
+		return hook.fail(entries, err)
+	}
+
+	failed, errs := hook.insertGroups(ctx, hook.shards(entries))
+	// The entries are stored or in failed now, so a later panic must not
+	// put them back.
+	entries = nil
+	hook.breakerRecord(len(failed) > 0)
+	if len(errs) > 0 {
+		if len(failed) == 0 {
+			// Only additional sinks failed; they keep the batch themselves.
+			err := errors.Join(errs...)
+			hook.mu.Lock()
+			hook.recordFailure(err, 0)
+			hook.mu.Unlock()
+			return err
+		}
+		if hook.config.DeadLetterTable != "" {
+			return hook.deadLetter(ctx, failed, errors.Join(errs...))
+		}
+		return hook.fail(failed, errors.Join(errs...))
+	}
+
+	return hook.replayDisk(ctx, batchSize)
+}
+
+// replayIdle replays the disk buffer for a flush that found nothing to
+// insert, so that entries an earlier run spilled are replayed by an idle
+// hook too.
+func (hook *ClickHouseHook) replayIdle(ctx context.Context, batchSize int) error {
+	if hook.disk == nil || hook.disk.empty() || !hook.breakerAllow() {
+		return nil
+	}
+	if err := hook.ready(ctx); err != nil {
+		hook.breakerRecord(true)
+		return err
+	}
+	err := hook.replayDisk(ctx, batchSize)
+	hook.breakerRecord(err != nil)
+	return err
+}
+
+// replayDisk inserts the entries of the disk buffer, batchSize at a time.
+func (hook *ClickHouseHook) replayDisk(ctx context.Context, batchSize int) error {
+	if hook.disk != nil {
+		err := hook.disk.drain(batchSize, func(replayed []logrus.Entry) error {
+			start := hook.config.Clock.Now()
+			if hook.config.RowMarshaler != nil {
+				replayed = hook.marshalRows(replayed)
+			}
+			for _, s := range hook.shards(replayed) {
+				if err := hook.write(ctx, s.table, s.entries); err != nil && !storedByPrimary(err) {
+					return err
+				}
+			}
+			hook.recordFlush(len(replayed), start)
+			return nil
+		})
+		if err != nil {
+			hook.logLimited(hook.log(), logrus.WarnLevel, err, "replaying disk buffer failed")
+			return fmt.Errorf("clickhouse hook: replaying disk buffer: %w", err)
+		}
+	}
+	return nil
+}
+
+// minSplitSize is the smallest batch insertSplitting halves.
+const minSplitSize = 64
+
+// insertSplitting inserts entries into table, halving the batch and
+// inserting each half in turn, recursively, when the server rejects it as
+// too large. It returns the entries that could not be inserted.
+func (hook *ClickHouseHook) insertSplitting(ctx context.Context, table string, entries []logrus.Entry) ([]logrus.Entry, error) {
+	start := hook.config.Clock.Now()
+	err := hook.tracedInsert(ctx, table, entries)
+	if err == nil || storedByPrimary(err) {
+		hook.recordFlush(len(entries), start)
+		return nil, err
+	}
+	if len(entries) < 2*minSplitSize || !isTooLarge(err) {
+		return entries, err
+	}
+
+	hook.logLimited(hook.log().WithField("entries", len(entries)), logrus.DebugLevel, err, "batch too large, splitting it")
+	half := len(entries) / 2
+	first, firstErr := hook.insertSplitting(ctx, table, entries[:half])
+	second, secondErr := hook.insertSplitting(ctx, table, entries[half:])
+	rejected := append(append([]logrus.Entry(nil), first...), second...)
+	return rejected, errors.Join(firstErr, secondErr)
+}
+
+// insertWithRetry inserts entries into table, retrying with exponential
+// backoff up to MaxRetries times while ctx allows. A batch the primary
+// sink stored is not retried when only additional sinks failed.
+func (hook *ClickHouseHook) insertWithRetry(ctx context.Context, table string, entries []logrus.Entry) error {
+	err := hook.attempt(ctx, table, entries)
+	if err != nil && isAuthError(err) && !storedByPrimary(err) && hook.refreshCredentials() {
+		err = hook.attempt(ctx, table, entries)
+	}
+	for attempt := 0; err != nil && !storedByPrimary(err) && !isTooLarge(err) && hook.config.Retryable(err) && attempt < hook.config.MaxRetries; attempt++ {
+		delay := hook.retryDelay(attempt)
+		hook.logLimited(hook.log().WithField("attempt", attempt+1), logrus.DebugLevel, err, "retrying insert")
+		if hook.sleep(ctx, delay) != nil {
+			break
+		}
+		err = hook.attempt(ctx, table, entries)
+	}
+	return err
+}
+
+// attempt is one try of insertWithRetry, bounded by StatementTimeout.
+func (hook *ClickHouseHook) attempt(ctx context.Context, table string, entries []logrus.Entry) error {
+	if hook.config.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.config.StatementTimeout)
+		defer cancel()
+	}
+	return hook.write(ctx, table, entries)
+}
+
+// recordFlush records a successfully inserted batch of n entries whose
+// insert started at start, and reports it to OnFlush.
+func (hook *ClickHouseHook) recordFlush(n int, start time.Time) {
+	duration := hook.config.Clock.Now().Sub(start)
+	hook.mu.Lock()
+	hook.flushed += uint64(n)
+	hook.batches++
+	hook.latencies.add(duration)
+	hook.metrics.batches.Inc()
+	hook.metrics.latency.Observe(duration.Seconds())
+	hook.mu.Unlock()
+
+	if hook.config.OnFlush != nil {
+		hook.onFlushMu.Lock()
+		defer hook.onFlushMu.Unlock()
+		hook.config.OnFlush(n, duration)
+	}
+}
+
+// fail records a flush that failed with err and keeps its entries: on disk
+// when a disk buffer is configured, in memory otherwise or if spilling
+// fails.
+func (hook *ClickHouseHook) fail(entries []logrus.Entry, err error) error {
+	if hook.disk != nil {
+		dropped, written, diskErr := hook.disk.append(entries)
+		if written {
+			if diskErr != nil {
+				hook.logLimited(hook.log(), logrus.WarnLevel, diskErr, "compacting disk buffer failed")
+			}
+			hook.mu.Lock()
+			hook.recordFailure(err, len(dropped))
+			hook.mu.Unlock()
+			hook.logFailure(len(entries), len(dropped), err)
+			hook.fallback(decodeRecords(dropped))
+			return lostEntries(err, len(dropped))
+		}
+		err = errors.Join(err, fmt.Errorf("clickhouse hook: spilling to disk: %w", diskErr))
+	}
+
+	dropped := hook.requeue(entries, err)
+	hook.logFailure(len(entries), len(dropped), err)
+	hook.fallback(dropped)
+	return lostEntries(err, len(dropped))
+}
+
+// logFailure reports a failed flush of n entries, dropped of which were
+// discarded, to the diagnostic logger.
+func (hook *ClickHouseHook) logFailure(n, dropped int, err error) {
+	diag := hook.log().WithField("entries", n)
+	if dropped > 0 {
+		hook.logLimited(diag.WithField("dropped", dropped), logrus.WarnLevel, err, "flush failed, dropped entries")
+		return
+	}
+	hook.logLimited(diag, logrus.WarnLevel, err, "flush failed")
+}
+
+// requeue puts entries from a flush that failed with err back in front of
+// the buffer, trims it to MaxBufferSize, oldest first, and compresses what
+// lies beyond CompressThreshold. It returns the entries dropped.
+func (hook *ClickHouseHook) requeue(entries []logrus.Entry, err error) []logrus.Entry {
+	hook.mu.Lock()
+	var dropped []logrus.Entry
+	var lossErr error
+	limit := hook.config.MaxBufferSize
+	if excess := len(entries) + hook.packedCount + len(hook.entries) - limit; limit > 0 && excess > 0 {
+		n := min(excess, len(entries))
+		dropped, entries = entries[:n:n], entries[n:]
+		if excess > n {
+			var older []logrus.Entry
+			older, lossErr = hook.dropOldest(excess - n)
+			dropped = append(dropped, older...)
+		}
+	}
+	if len(hook.packed) > 0 {
+		// The entries are older than the compressed ones, which are left
+		// as they are.
+		chunks, kept := hook.packEntries(entries)
+		hook.packed = append(chunks, hook.packed...)
+		hook.entries = slices.Concat(kept, hook.entries)
+	} else {
+		hook.entries = slices.Concat(entries, hook.entries)
+	}
+	hook.bytes = 0
+	for i := range hook.entries {
+		hook.bytes += entrySize(&hook.entries[i])
+	}
+	hook.pack()
+	buffered := len(hook.entries) + hook.packedCount
+	if buffered > 0 {
+		hook.oldest = hook.config.Clock.Now()
+	}
+	hook.metrics.buffered.Set(float64(buffered))
+	hook.recordFailure(err, len(dropped))
+	hook.mu.Unlock()
+	hook.reportLost(lossErr)
+	return dropped
+}
+
+// reportLost logs err, the loss of compressed entries that could not be
+// decoded, if any.
+func (hook *ClickHouseHook) reportLost(err error) {
+	if err != nil {
+		hook.logLimited(hook.log(), logrus.ErrorLevel, err, "dropped compressed entries that failed to decode")
+	}
+}
+
+// recordFailure updates the counters for a failed flush that dropped
+// entries. Callers must hold hook.mu.
+func (hook *ClickHouseHook) recordFailure(err error, dropped int) {
+	hook.lastError = err
+	hook.failedAt = hook.config.Clock.Now()
+	hook.dropped += uint64(dropped)
+	hook.failures++
+	hook.metrics.dropped.Add(float64(dropped))
+	hook.metrics.flushErrors.Inc()
+}
+
+// retryDelay returns the backoff before retry number attempt (zero based).
+func (hook *ClickHouseHook) retryDelay(attempt int) time.Duration {
+	delay := hook.config.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	return delay << uint(attempt)
+}
+
+// sleep waits for d on the hook's clock or until ctx is done, whichever
+// comes first.
+func (hook *ClickHouseHook) sleep(ctx context.Context, d time.Duration) error {
+	timer := hook.config.Clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Levels returns the logging levels for which the hook is triggered.
 func (hook *ClickHouseHook) Levels() []logrus.Level {
+	if len(hook.config.Levels) > 0 {
+		return hook.config.Levels
+	}
 	return logrus.AllLevels
 }
 
@@ -86,7 +2029,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to connect to ClickHouse: %v", err)
 	}
-	defer hook.db.Close()
+
+	// Flush what's buffered if the process is interrupted
+	uninstall := hook.InstallSignalHandler()
+	defer uninstall()
 
 	// Set up logrus
 	logger := logrus.New()
@@ -105,8 +2051,8 @@ func main() {
 		time.Sleep(time.Second)
 	}
 
-	// Flush any remaining log entries before exiting
-	if err := hook.flush(); err != nil {
+	// Flush any remaining log entries and close the connection before exiting
+	if err := hook.Close(); err != nil {
 		log.Fatalf("failed to flush logs to ClickHouse: %v", err)
 	}
 
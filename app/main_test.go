@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// countingSink is a MemorySink that also counts every write attempted,
+// failed ones included.
+type countingSink struct {
+	MemorySink
+	mu       sync.Mutex
+	attempts int
+}
+
+func (s *countingSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	s.mu.Lock()
+	s.attempts++
+	s.mu.Unlock()
+	return s.MemorySink.WriteBatch(ctx, entries)
+}
+
+func (s *countingSink) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func testEntry(level logrus.Level, message string) *logrus.Entry {
+	return &logrus.Entry{Level: level, Message: message, Data: logrus.Fields{}}
+}
+
+func TestFireBacksOffAfterFailedFlush(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	hook, err := NewHookWithSink(sink, 2, WithClock(clock), WithRetries(0, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "two")); err == nil {
+		t.Fatal("Fire of a full batch into a failing sink returned nil")
+	}
+	if got := sink.Attempts(); got != 1 {
+		t.Fatalf("%d write attempts after the first full batch, want 1", got)
+	}
+
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "three")); err != nil {
+		t.Fatalf("Fire while backing off: %v", err)
+	}
+	if got := sink.Attempts(); got != 1 {
+		t.Fatalf("%d write attempts while backing off, want 1", got)
+	}
+
+	sink.SetError(nil)
+	clock.Advance(time.Second)
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "four")); err != nil {
+		t.Fatalf("Fire after the retry delay: %v", err)
+	}
+	if got := len(sink.Entries()); got != 4 {
+		t.Fatalf("%d entries flushed after the retry delay, want 4", got)
+	}
+}
+
+func TestFlushOnLevelIgnoresBackoff(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	hook, err := NewHookWithSink(sink, 2, WithClock(clock), WithRetries(0, time.Minute),
+		WithFlushOnLevel(logrus.ErrorLevel), WithCircuitBreaker(3, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "two")); err == nil {
+		t.Fatal("Fire of a full batch into a failing sink returned nil")
+	}
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "three")); err != nil || sink.Attempts() != 1 {
+		t.Fatalf("Fire while backing off returned %v after %d write attempts, want nil after 1", err, sink.Attempts())
+	}
+
+	// An error entry is flushed straight away, backing off or not.
+	if err := hook.Fire(testEntry(logrus.ErrorLevel, "four")); err == nil {
+		t.Fatal("Fire of an error entry into a failing sink returned nil")
+	}
+	if got := sink.Attempts(); got != 2 {
+		t.Fatalf("%d write attempts after an error entry while backing off, want 2", got)
+	}
+	sink.SetError(nil)
+	if err := hook.Fire(testEntry(logrus.ErrorLevel, "five")); err != nil {
+		t.Fatalf("Fire of an error entry once the sink recovered: %v", err)
+	}
+	if got := messagesOf(sink.Entries()); !slices.Equal(got, []string{"one", "two", "three", "four", "five"}) {
+		t.Fatalf("flushed %v while backing off, want every entry", got)
+	}
+
+	// The breaker, once open, still skips them.
+	sink.SetError(errors.New("server down"))
+	for i := 0; i < 3; i++ {
+		hook.Fire(testEntry(logrus.ErrorLevel, "six"))
+	}
+	attempts := sink.Attempts()
+	if err := hook.Fire(testEntry(logrus.ErrorLevel, "seven")); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Fire of an error entry with the breaker open returned %v, want ErrCircuitOpen", err)
+	}
+	if got := sink.Attempts(); got != attempts {
+		t.Fatalf("%d write attempts with the breaker open, want %d", got, attempts)
+	}
+}
+
+func TestAsyncFlushOnLevelIgnoresBackoff(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	hook, err := NewHookWithSink(sink, 2, WithClock(clock), WithRetries(0, time.Minute),
+		WithFlushOnLevel(logrus.ErrorLevel), WithAsync(10, OverflowBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	waitFor(t, func() bool { return sink.Attempts() == 1 })
+	sink.SetError(nil)
+	hook.Fire(testEntry(logrus.InfoLevel, "three"))
+	hook.Fire(testEntry(logrus.ErrorLevel, "four"))
+	waitFor(t, func() bool { return len(sink.Entries()) == 4 })
+	if got := sink.Attempts(); got != 2 {
+		t.Fatalf("%d write attempts, want the failed one and one for the error entry", got)
+	}
+}
+
+func TestAsyncWriterBacksOffAfterFailedFlush(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	hook, err := NewHookWithSink(sink, 2, WithClock(clock), WithRetries(0, time.Second),
+		WithAsync(10, OverflowBlock), WithFlushInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	waitFor(t, func() bool { return sink.Attempts() == 1 })
+
+	hook.Fire(testEntry(logrus.InfoLevel, "three"))
+	hook.Fire(testEntry(logrus.InfoLevel, "four"))
+	waitFor(t, func() bool { return hook.Stats().Buffered == 4 })
+	for i := 0; i < 9; i++ {
+		clock.Advance(100 * time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := sink.Attempts(); got != 1 {
+		t.Fatalf("%d write attempts while backing off, want 1", got)
+	}
+
+	sink.SetError(nil)
+	advanceUntil(t, clock, 100*time.Millisecond, func() bool { return len(sink.Entries()) == 4 })
+}
+
+func TestAsyncWriterSkipsFlushesWhileBreakerOpen(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &countingSink{}
+	sink.SetError(errors.New("server down"))
+	hook, err := NewHookWithSink(sink, 2, WithClock(clock), WithRetries(0, 100*time.Millisecond),
+		WithAsync(10, OverflowBlock), WithFlushInterval(100*time.Millisecond), WithCircuitBreaker(1, 10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	waitFor(t, func() bool { return hook.Stats().Breaker == BreakerOpen })
+
+	// Past the retry delay the writer flushes on every tick and full
+	// batch, but the open breaker keeps them from reaching the sink.
+	for i := 0; i < 10; i++ {
+		hook.Fire(testEntry(logrus.InfoLevel, "more"))
+		clock.Advance(time.Second / 2)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := sink.Attempts(); got != 1 {
+		t.Fatalf("%d write attempts while the breaker was open, want 1", got)
+	}
+
+	sink.SetError(nil)
+	advanceUntil(t, clock, time.Second, func() bool { return len(sink.Entries()) == 12 })
+	if got := hook.Stats().Breaker; got != BreakerClosed {
+		t.Fatalf("breaker %s after the probe succeeded, want closed", got)
+	}
+}
+
+// panickingSink is a MemorySink whose first write panics.
+type panickingSink struct {
+	MemorySink
+	once sync.Once
+}
+
+func (s *panickingSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	s.once.Do(func() { panic("sink bug") })
+	return s.MemorySink.WriteBatch(ctx, entries)
+}
+
+// panickingMarshaler is a RowMarshaler whose first call panics.
+type panickingMarshaler struct {
+	once sync.Once
+}
+
+func (m *panickingMarshaler) MarshalRow(entry *logrus.Entry) ([]interface{}, error) {
+	m.once.Do(func() { panic("marshaler bug") })
+	return []interface{}{entry.Message}, nil
+}
+
+func TestFireDropsEntryWhenFilterPanics(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithFilter(func(*logrus.Entry) bool { panic("filter bug") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "filtered")); err == nil {
+		t.Fatal("Fire with a panicking Filter returned nil")
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(sink.Entries()); got != 0 {
+		t.Fatalf("%d entries flushed past a panicking Filter, want 0", got)
+	}
+	if got := hook.Stats().Panics; got != 1 {
+		t.Fatalf("Stats.Panics = %d, want 1", got)
+	}
+}
+
+func TestFireSamplesLevels(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 1000, WithSampleRate(logrus.InfoLevel, 0.1), WithSampleRate(logrus.WarnLevel, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+	hook.random = rand.New(rand.NewSource(1)).Float64
+
+	const fired = 10000
+	for i := 0; i < fired; i++ {
+		for _, level := range []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel} {
+			if err := hook.Fire(testEntry(level, "m")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	kept := make(map[logrus.Level]int)
+	for _, entry := range sink.Entries() {
+		kept[entry.Level]++
+	}
+	if kept[logrus.ErrorLevel] != fired || kept[logrus.WarnLevel] != fired {
+		t.Errorf("kept %d errors and %d warnings, want every one of %d", kept[logrus.ErrorLevel], kept[logrus.WarnLevel], fired)
+	}
+	if info := kept[logrus.InfoLevel]; info < fired*9/100 || info > fired*11/100 {
+		t.Errorf("kept %d of %d info entries, want about 10%%", info, fired)
+	}
+	if got, want := hook.Stats().SampledOut, uint64(fired-kept[logrus.InfoLevel]); got != want {
+		t.Errorf("Stats.SampledOut = %d, want %d", got, want)
+	}
+}
+
+func TestFireRequeuesEntryWhenEncoderPanics(t *testing.T) {
+	var once sync.Once
+	config, err := prepareConfig(Config{BatchSize: 1}, []Option{
+		WithFields(),
+		WithFieldValueEncoder(func(key string, value interface{}) string {
+			once.Do(func() { panic("encoder bug") })
+			return "encoded"
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := &countingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	hook.sink = newSQLSink([]*node{{db: db}}, "logs", hook.columns, "", nil, FlushStrategyPrepared)
+	if err := hook.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	entry := testEntry(logrus.InfoLevel, "encoded")
+	entry.Data["user"] = "alice"
+	if err := hook.Fire(entry); err == nil {
+		t.Fatal("Fire with a panicking FieldValueEncoder returned nil")
+	}
+	if got := hook.Stats().Panics; got != 1 {
+		t.Fatalf("Stats.Panics = %d, want 1", got)
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush after the panic: %v", err)
+	}
+	if got := connector.execs.Load(); got != 1 {
+		t.Fatalf("%d rows inserted after the panic, want the requeued 1", got)
+	}
+}
+
+func TestFlushRequeuesBatchWhenMarshalerPanics(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithRowMarshaler(&panickingMarshaler{}, "message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "one"))
+	hook.Fire(testEntry(logrus.InfoLevel, "two"))
+	if err := hook.Flush(); err == nil {
+		t.Fatal("Flush with a panicking RowMarshaler returned nil")
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush after the panic: %v", err)
+	}
+	if got := len(sink.Entries()); got != 2 {
+		t.Fatalf("%d entries flushed after the panic, want 2", got)
+	}
+}
+
+func TestConcurrentGroupPanicFailsOnlyItsGroup(t *testing.T) {
+	sink := &panickingSink{}
+	hook, err := NewHookWithSink(sink, 10, WithGroupConcurrency(2), WithLevelTables(map[logrus.Level]string{
+		logrus.InfoLevel: "info_logs",
+		logrus.WarnLevel: "warn_logs",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "info"))
+	hook.Fire(testEntry(logrus.WarnLevel, "warn"))
+	if err := hook.Flush(); err == nil {
+		t.Fatal("Flush with a panicking group returned nil")
+	}
+	if got := len(sink.Entries()); got != 1 {
+		t.Fatalf("%d entries stored by the group that didn't panic, want 1", got)
+	}
+	if got := hook.Stats().Panics; got != 1 {
+		t.Fatalf("Stats.Panics = %d, want 1", got)
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush after the panic: %v", err)
+	}
+	if got := len(sink.Entries()); got != 2 {
+		t.Fatalf("%d entries stored after the panic, want 2", got)
+	}
+}
+
+// waitFor fails t unless done returns true within a few seconds, for
+// effects of the hook's goroutines.
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the hook")
+		}
+	}
+}
+
+func TestFireFlushesFatalEntrySynchronously(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithAsync(100, OverflowBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	// Stop the writer so the queued entry can only get out with the Fatal one.
+	hook.Stop()
+	hook.queue <- *testEntry(logrus.InfoLevel, "queued")
+	if err := hook.Fire(testEntry(logrus.FatalLevel, "fatal")); err != nil {
+		t.Fatal(err)
+	}
+	got := messagesOf(sink.Entries())
+	if want := []string{"queued", "fatal"}; !slices.Equal(got, want) {
+		t.Fatalf("flushed %v by the time Fire returned, want %v", got, want)
+	}
+}
+
+func TestCloseDuringConcurrentFire(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 50, WithAsync(1000, OverflowBlock), WithFlushInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fired atomic.Int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				hook.Fire(testEntry(logrus.InfoLevel, "concurrent"))
+				fired.Add(1)
+			}
+		}()
+	}
+
+	waitFor(t, func() bool { return fired.Load() >= 2000 })
+	before := fired.Load()
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	close(done)
+	wg.Wait()
+
+	if got := int64(len(sink.Entries())); got < before {
+		t.Fatalf("%d entries flushed, want at least the %d fired before Close", got, before)
+	}
+	if err := hook.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+// hangingSink is a MemorySink whose first hangs writes block until their
+// context is done.
+type hangingSink struct {
+	MemorySink
+	mu    sync.Mutex
+	hangs int
+}
+
+func (s *hangingSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	s.mu.Lock()
+	hang := s.hangs > 0
+	s.hangs--
+	s.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.MemorySink.WriteBatch(ctx, entries)
+}
+
+func TestStatementTimeoutRetriesHungInsert(t *testing.T) {
+	sink := &hangingSink{hangs: 1}
+	hook, err := NewHookWithSink(sink, 10, WithQueryTimeout(20*time.Millisecond),
+		WithFlushTimeout(10*time.Second), WithRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "hung"))
+	if err := hook.Flush(); err != nil {
+		t.Fatalf("Flush with a hung first attempt: %v", err)
+	}
+	if got := len(sink.Entries()); got != 1 {
+		t.Fatalf("%d entries stored by the retry, want 1", got)
+	}
+}
+
+func TestFlushTimeoutBoundsStatementTimeout(t *testing.T) {
+	sink := &hangingSink{hangs: 1}
+	hook, err := NewHookWithSink(sink, 10, WithQueryTimeout(time.Hour),
+		WithFlushTimeout(20*time.Millisecond), WithRetries(0, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "hung"))
+	if err := hook.Flush(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Flush of a hung insert returned %v, want the flush deadline", err)
+	}
+}
+
+// advanceUntil moves clock forward by step, giving the hook's goroutines a
+// moment after every step, until done returns true, and returns how far it
+// moved the clock.
+func advanceUntil(t *testing.T, clock *FakeClock, step time.Duration, done func() bool) time.Duration {
+	t.Helper()
+	var moved time.Duration
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		clock.Advance(step)
+		moved += step
+		for wait := time.Now().Add(10 * time.Millisecond); time.Now().Before(wait); time.Sleep(time.Millisecond) {
+			if done() {
+				return moved
+			}
+		}
+	}
+	t.Fatal("timed out advancing the clock")
+	return moved
+}
+
+func TestFlushIntervalFollowsClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithClock(clock), WithFlushInterval(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "partial"))
+	moved := advanceUntil(t, clock, 100*time.Millisecond, func() bool { return len(sink.Entries()) == 1 })
+	if moved < time.Second {
+		t.Fatalf("partial batch flushed after %s, want the flush interval of 1s", moved)
+	}
+}
+
+func TestMaxEntryAgeFollowsClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithClock(clock), WithMaxEntryAge(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "aging"))
+	moved := advanceUntil(t, clock, 250*time.Millisecond, func() bool { return len(sink.Entries()) == 1 })
+	if moved < 2*time.Second {
+		t.Fatalf("entry flushed at age %s, want 2s", moved)
+	}
+}
+
+func TestIdleFlushDelayFollowsClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10, WithClock(clock), WithIdleFlushDelay(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	hook.Fire(testEntry(logrus.InfoLevel, "first"))
+	for i := 0; i < 3; i++ {
+		clock.Advance(500 * time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := len(sink.Entries()); got != 0 {
+		t.Fatalf("%d entries flushed 1.5s after the last one, want 0", got)
+	}
+
+	// A new entry restarts the idle delay.
+	hook.Fire(testEntry(logrus.InfoLevel, "second"))
+	moved := advanceUntil(t, clock, 250*time.Millisecond, func() bool { return len(sink.Entries()) == 2 })
+	if moved < 2*time.Second {
+		t.Fatalf("flushed %s after the last entry, want the idle delay of 2s", moved)
+	}
+}
+
+func TestFlushWithoutSinkFailsNotConnected(t *testing.T) {
+	hook := newTestHook(t)
+	hook.Fire(testEntry(logrus.InfoLevel, "kept"))
+	if err := hook.Flush(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Flush without a sink returned %v, want ErrNotConnected", err)
+	}
+	if got := hook.Stats().Buffered; got != 1 {
+		t.Fatalf("%d entries buffered after the failed flush, want 1", got)
+	}
+	if err := hook.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Ping without a sink returned %v, want ErrNotConnected", err)
+	}
+}
+
+func TestFlushAfterCloseFailsNotConnected(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hook.Fire(testEntry(logrus.InfoLevel, "late")); err != nil {
+		t.Fatalf("Fire after Close: %v", err)
+	}
+	if err := hook.Flush(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Flush after Close returned %v, want ErrNotConnected", err)
+	}
+	if err := hook.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Ping after Close returned %v, want ErrNotConnected", err)
+	}
+	if got := len(sink.Entries()); got != 0 {
+		t.Fatalf("%d entries written after Close, want 0", got)
+	}
+	if err := hook.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
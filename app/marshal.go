@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RowMarshaler builds the whole row for an entry, for schemas the built-in
+// columns can't describe. MarshalRow returns one value per column passed to
+// WithRowMarshaler, in the same order.
+type RowMarshaler interface {
+	MarshalRow(entry *logrus.Entry) ([]interface{}, error)
+}
+
+// rowKey is the entry.Context key of the values marshalRows computed.
+type rowKey struct{}
+
+// marshalColumns returns one column per MarshalColumns name, filled from the
+// values marshalRows stored in the entry.
+func (hook *ClickHouseHook) marshalColumns() []column {
+	columns := make([]column, len(hook.config.MarshalColumns))
+	for i, name := range hook.config.MarshalColumns {
+		columns[i] = column{name: name, value: func(entry *logrus.Entry) interface{} {
+			values, _ := entry.Context.Value(rowKey{}).([]interface{})
+			if i >= len(values) {
+				return nil
+			}
+			return values[i]
+		}}
+	}
+	return columns
+}
+
+// marshalRows runs RowMarshaler over entries ahead of an insert, storing
+// each row in its entry's Context. Entries it fails on, or that come back
+// with the wrong number of values, are left out and passed to OnRowError
+// when set, or dropped with a warning otherwise.
+func (hook *ClickHouseHook) marshalRows(entries []logrus.Entry) []logrus.Entry {
+	rows := make([]logrus.Entry, 0, len(entries))
+	var failed []logrus.Entry
+	var lastErr error
+	for _, entry := range entries {
+		values, err := hook.config.RowMarshaler.MarshalRow(&entry)
+		if err == nil && len(values) != len(hook.columns) {
+			err = fmt.Errorf("clickhouse hook: row marshaler returned %d values for %d columns", len(values), len(hook.columns))
+		}
+		if err != nil {
+			if hook.config.OnRowError != nil {
+				hook.config.OnRowError(entry, err)
+			}
+			failed, lastErr = append(failed, entry), err
+			continue
+		}
+		ctx := entry.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		entry.Context = context.WithValue(ctx, rowKey{}, values)
+		rows = append(rows, entry)
+	}
+
+	if len(failed) > 0 {
+		hook.mu.Lock()
+		hook.dropped += uint64(len(failed))
+		hook.metrics.dropped.Add(float64(len(failed)))
+		hook.mu.Unlock()
+		hook.logLimited(hook.log().WithField("dropped", len(failed)), logrus.WarnLevel, lastErr, "marshaling rows failed, dropped entries")
+		hook.emitDropped(failed)
+	}
+	return rows
+}
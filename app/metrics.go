@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "clickhouse_hook"
+
+// metrics holds the Prometheus collectors describing the hook. They are
+// always created so the hook can update them unconditionally, but are only
+// exported when a registerer is supplied via WithMetrics.
+type metrics struct {
+	entries     prometheus.Counter
+	batches     prometheus.Counter
+	flushErrors prometheus.Counter
+	dropped     prometheus.Counter
+	buffered    prometheus.Gauge
+	latency     prometheus.Histogram
+
+	compressionIn    prometheus.Counter
+	compressionOut   prometheus.Counter
+	compressionRatio prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		entries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "entries_total",
+			Help:      "Log entries accepted by the hook.",
+		}),
+		batches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "batches_flushed_total",
+			Help:      "Batches successfully inserted into ClickHouse.",
+		}),
+		flushErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "flush_errors_total",
+			Help:      "Flushes that failed after all retries.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "entries_dropped_total",
+			Help:      "Buffered entries discarded because the buffer was full.",
+		}),
+		buffered: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "buffer_depth",
+			Help:      "Entries currently waiting to be flushed.",
+		}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "flush_duration_seconds",
+			Help:      "Time taken to insert a batch, retries included.",
+			Buckets:   prometheus.ExponentialBucketsRange(0.001, 10, 14),
+		}),
+		compressionIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "compression_input_bytes_total",
+			Help:      "Bytes of buffered entries compressed in memory, before compression.",
+		}),
+		compressionOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "compression_output_bytes_total",
+			Help:      "Bytes of buffered entries compressed in memory, after compression.",
+		}),
+		compressionRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "compression_ratio",
+			Help:      "Bytes before in-memory compression per byte after it, over the hook's lifetime.",
+		}),
+	}
+}
+
+// collectors returns every collector in m, for registration.
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.entries, m.batches, m.flushErrors, m.dropped, m.buffered, m.latency,
+		m.compressionIn, m.compressionOut, m.compressionRatio}
+}
+
+// register adds all collectors to registerer.
+func (m *metrics) register(registerer prometheus.Registerer) error {
+	for _, c := range m.collectors() {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithMetrics exports the hook's Prometheus metrics through registerer.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(config *Config) {
+		config.Registerer = registerer
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSourceField is the field Named sets without a SourceField.
+const defaultSourceField = "source"
+
+// namedHook is a ClickHouseHook that tags every entry with its source.
+type namedHook struct {
+	*ClickHouseHook
+	source string
+}
+
+// Named returns a hook to add to one of several loggers sharing this hook,
+// which sets the SourceField of their entries, or a source field without
+// one, to source unless the entry already has it. Entries go through this
+// hook's buffer; it is the one to close.
+func (hook *ClickHouseHook) Named(source string) logrus.Hook {
+	return namedHook{ClickHouseHook: hook, source: source}
+}
+
+// Fire passes a copy of entry with the source field set to the wrapped
+// hook, leaving entry itself to the logger's other hooks as it was.
+func (h namedHook) Fire(entry *logrus.Entry) error {
+	key := h.config.SourceField
+	if key == "" {
+		key = defaultSourceField
+	}
+	if _, ok := entry.Data[key]; ok {
+		return h.ClickHouseHook.Fire(entry)
+	}
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data[key] = h.source
+	tagged := *entry
+	tagged.Data = data
+	return h.ClickHouseHook.Fire(&tagged)
+}
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option adjusts a Config before the hook is built. Options are applied in
+// order on top of the Config passed to NewClickHouseHookWithConfig, or on
+// top of the batch size given to NewClickHouseHook.
+type Option func(*Config)
+
+// WithFlushInterval flushes the buffer every interval.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(config *Config) {
+		config.FlushInterval = interval
+	}
+}
+
+// WithMaxEntryAge flushes the buffer once its oldest entry is age old.
+func WithMaxEntryAge(age time.Duration) Option {
+	return func(config *Config) {
+		config.MaxEntryAge = age
+	}
+}
+
+// WithFields writes entry fields to the fields Map column.
+func WithFields() Option {
+	return func(config *Config) {
+		config.IncludeFields = true
+	}
+}
+
+// WithRetries retries failed inserts up to maxRetries times, starting at
+// delay and doubling after each attempt.
+func WithRetries(maxRetries int, delay time.Duration) Option {
+	return func(config *Config) {
+		config.MaxRetries = maxRetries
+		config.RetryDelay = delay
+	}
+}
+
+// WithMaxBufferSize caps the entries kept after a failed flush.
+func WithMaxBufferSize(size int) Option {
+	return func(config *Config) {
+		config.MaxBufferSize = size
+	}
+}
+
+// WithTableName inserts into table instead of tiered_logs.
+func WithTableName(table string) Option {
+	return func(config *Config) {
+		config.TableName = table
+	}
+}
+
+// WithFlushTimeout bounds every flush, retries included, to timeout.
+func WithFlushTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		config.FlushTimeout = timeout
+	}
+}
+
+// WithQueryTimeout bounds every insert attempt to timeout, within the flush
+// timeout, so a hung statement is retried rather than waited out.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		config.StatementTimeout = timeout
+	}
+}
+
+// WithDefaultFields merges fields into every entry.
+func WithDefaultFields(fields map[string]string) Option {
+	return func(config *Config) {
+		config.DefaultFields = fields
+	}
+}
+
+// WithCaller records the call site in the caller column, including the
+// function name when function is true.
+func WithCaller(function bool) Option {
+	return func(config *Config) {
+		config.IncludeCaller = true
+		config.IncludeCallerFunction = function
+	}
+}
+
+// WithLevels restricts the hook to levels.
+func WithLevels(levels ...logrus.Level) Option {
+	return func(config *Config) {
+		config.Levels = levels
+	}
+}
+
+// WithMaxOpenConns limits the number of open connections to ClickHouse.
+func WithMaxOpenConns(n int) Option {
+	return func(config *Config) {
+		config.MaxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns limits the number of idle connections kept in the pool.
+func WithMaxIdleConns(n int) Option {
+	return func(config *Config) {
+		config.MaxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime closes pooled connections older than d.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(config *Config) {
+		config.ConnMaxLifetime = d
+	}
+}
+
+// WithFieldEncoding writes entry fields to the column matching encoding.
+func WithFieldEncoding(encoding FieldEncoding) Option {
+	return func(config *Config) {
+		config.IncludeFields = true
+		config.FieldEncoding = encoding
+	}
+}
+
+// WithTimePrecision keeps digits fractional second digits in event_time, for
+// a DateTime64(digits) column.
+func WithTimePrecision(digits int) Option {
+	return func(config *Config) {
+		config.TimePrecision = digits
+	}
+}
+
+// WithFlushOnLevel flushes as soon as an entry at level or above is fired.
+func WithFlushOnLevel(level logrus.Level) Option {
+	return func(config *Config) {
+		config.FlushOnLevel = &level
+	}
+}
+
+// WithSchemaVerification checks the target table's columns on startup.
+func WithSchemaVerification() Option {
+	return func(config *Config) {
+		config.VerifySchema = true
+	}
+}
+
+// WithCreateTable creates the target table on startup if it doesn't exist.
+// Empty engine and orderBy keep the MergeTree ordered by the time column
+// default.
+func WithCreateTable(engine, orderBy string) Option {
+	return func(config *Config) {
+		config.CreateTableIfNotExists = true
+		config.TableEngine = engine
+		config.TableOrderBy = orderBy
+	}
+}
+
+// WithTableTTL adds a TTL clause to the created table.
+func WithTableTTL(ttl string) Option {
+	return func(config *Config) {
+		config.TableTTL = ttl
+	}
+}
+
+// WithMessageCodec compresses the created message column with codec.
+func WithMessageCodec(codec string) Option {
+	return func(config *Config) {
+		config.MessageCodec = codec
+	}
+}
+
+// WithDiskBuffer spills batches that can't be inserted to a file in dir,
+// capped at maxBytes (zero for no cap), and replays them once ClickHouse
+// is reachable again.
+func WithDiskBuffer(dir string, maxBytes int64) Option {
+	return func(config *Config) {
+		config.DiskBufferDir = dir
+		config.DiskBufferMaxBytes = maxBytes
+	}
+}
+
+// WithDiskBufferRotation gzips the disk buffer into a new segment each time
+// it reaches maxFileBytes, keeping at most maxFiles segments (zero for no
+// limit) and deleting the oldest beyond that.
+func WithDiskBufferRotation(maxFileBytes int64, maxFiles int) Option {
+	return func(config *Config) {
+		config.DiskBufferMaxFileBytes = maxFileBytes
+		config.DiskBufferMaxFiles = maxFiles
+	}
+}
+
+// WithFailover inserts into the servers at dsns when the primary is
+// unreachable.
+func WithFailover(dsns ...string) Option {
+	return func(config *Config) {
+		config.FailoverDSNs = dsns
+	}
+}
+
+// WithRowErrorHandler skips rows the driver rejects, passing each to fn,
+// instead of failing the whole batch.
+func WithRowErrorHandler(fn func(entry logrus.Entry, err error)) Option {
+	return func(config *Config) {
+		config.OnRowError = fn
+	}
+}
+
+// WithMaxMessageBytes truncates messages longer than limit bytes, and
+// string field values too when fields is true.
+func WithMaxMessageBytes(limit int, fields bool) Option {
+	return func(config *Config) {
+		config.MaxMessageBytes = limit
+		config.TruncateFields = fields
+	}
+}
+
+// WithTraceFields copies the traceID and spanID fields into the trace_id
+// and span_id columns. Either may be empty to skip that column.
+func WithTraceFields(traceID, spanID string) Option {
+	return func(config *Config) {
+		config.TraceIDField = traceID
+		config.SpanIDField = spanID
+	}
+}
+
+// WithMaxBatchBytes flushes once the buffered entries reach about n bytes.
+func WithMaxBatchBytes(n int) Option {
+	return func(config *Config) {
+		config.MaxBatchBytes = n
+	}
+}
+
+// WithLogger sends the hook's own diagnostics to logger, which must not have
+// the hook attached.
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(config *Config) {
+		config.Logger = logger
+	}
+}
+
+// WithColumnMap writes to the physical columns named in columns, keyed by
+// logical column: "time", "level", "message" or "fields".
+func WithColumnMap(columns map[string]string) Option {
+	return func(config *Config) {
+		config.ColumnMap = columns
+	}
+}
+
+// WithAsync makes Fire queue entries for a writer goroutine, with room for
+// queueSize of them, applying policy when the queue is full.
+func WithAsync(queueSize int, policy OverflowPolicy) Option {
+	return func(config *Config) {
+		config.AsyncQueueSize = queueSize
+		config.OverflowPolicy = policy
+	}
+}
+
+// WithProcessInfo writes the process ID to the pid column when pid is true,
+// and the goroutine count at log time to the goroutines column when
+// goroutines is true.
+func WithProcessInfo(pid, goroutines bool) Option {
+	return func(config *Config) {
+		config.IncludePID = pid
+		config.IncludeGoroutines = goroutines
+	}
+}
+
+// WithSampleRate keeps only rate, from 0 to 1, of the entries at level.
+// It may be given once per level.
+func WithSampleRate(level logrus.Level, rate float64) Option {
+	return func(config *Config) {
+		rates := make(map[logrus.Level]float64, len(config.SampleRate)+1)
+		for l, r := range config.SampleRate {
+			rates[l] = r
+		}
+		rates[level] = rate
+		config.SampleRate = rates
+	}
+}
+
+// WithContextExtractor merges the fields extract returns for each entry's
+// Context into the row's fields.
+func WithContextExtractor(extract func(ctx context.Context) map[string]string) Option {
+	return func(config *Config) {
+		config.ContextExtractor = extract
+	}
+}
+
+// WithSharding inserts entries into the table tableFor returns for their
+// keyField value, falling back to the configured table.
+func WithSharding(keyField string, tableFor func(key string) string) Option {
+	return func(config *Config) {
+		config.ShardKeyField = keyField
+		config.ShardTableFunc = tableFor
+	}
+}
+
+// WithStackTrace writes the stack trace of errors logged at Error level and
+// above to the stack_trace column.
+func WithStackTrace() Option {
+	return func(config *Config) {
+		config.IncludeStackTrace = true
+	}
+}
+
+// WithDryRun logs the INSERTs the hook would run to the logger set by
+// WithLogger instead of connecting to ClickHouse.
+func WithDryRun() Option {
+	return func(config *Config) {
+		config.DryRun = true
+	}
+}
+
+// WithCompression turns LZ4 compression of native protocol inserts on or
+// off, overriding the DSN's compress parameter. On the log rows of
+// BenchmarkCompression, LZ4 shrinks the encoded batch about tenfold, from
+// 57 to 6 bytes a row, trading bandwidth for client CPU time.
+func WithCompression(enabled bool) Option {
+	return func(config *Config) {
+		config.Compression = &enabled
+	}
+}
+
+// WithClock drives the hook's timers from clock, such as a FakeClock in
+// tests.
+func WithClock(clock Clock) Option {
+	return func(config *Config) {
+		config.Clock = clock
+	}
+}
+
+// WithQuerySettings adds a SETTINGS clause with settings to every INSERT.
+// Settings add to those of other options, in any order; of two values for
+// the same setting, the later option's wins.
+func WithQuerySettings(settings map[string]string) Option {
+	return func(config *Config) {
+		addSettings(config, settings)
+	}
+}
+
+// WithDistributedSync sets insert_distributed_sync on every INSERT, so that
+// an insert into a Distributed table only returns once the data reached
+// every shard, waiting up to timeout, rounded to seconds, or indefinitely
+// when zero. A flush then takes as long as the slowest shard and fails if
+// one is unreachable, in exchange for inserted rows being readable from any
+// replica right away.
+func WithDistributedSync(timeout time.Duration) Option {
+	return func(config *Config) {
+		addSettings(config, map[string]string{
+			"insert_distributed_sync":    "1",
+			"insert_distributed_timeout": strconv.FormatInt(int64(timeout.Round(time.Second)/time.Second), 10),
+		})
+	}
+}
+
+// WithMaxExecutionTime sets max_execution_time on every insert, so that the
+// server aborts an insert running longer than limit, rounded up to whole
+// seconds, with TIMEOUT_EXCEEDED, which IsTransient retries.
+func WithMaxExecutionTime(limit time.Duration) Option {
+	return func(config *Config) {
+		seconds := max(int64((limit+time.Second-1)/time.Second), 1)
+		addSettings(config, map[string]string{"max_execution_time": strconv.FormatInt(seconds, 10)})
+	}
+}
+
+// WithAsyncInsert sets async_insert on every insert, so the server collects
+// small inserts into its own buffer and writes them out together, which
+// suits many hooks flushing small batches. With wait, an insert returns
+// once its data is written, as usual, only later. Without it the server
+// acknowledges the insert as soon as it is buffered: the hook counts the
+// batch as flushed, but it is lost if the server fails before writing it,
+// and errors such as a type mismatch are only logged by the server.
+func WithAsyncInsert(wait bool) Option {
+	waitSetting := "0"
+	if wait {
+		waitSetting = "1"
+	}
+	return func(config *Config) {
+		addSettings(config, map[string]string{"async_insert": "1", "wait_for_async_insert": waitSetting})
+	}
+}
+
+// addSettings sets settings in a copy of config's QuerySettings, so the map
+// passed to WithQuerySettings is not modified.
+func addSettings(config *Config, settings map[string]string) {
+	merged := make(map[string]string, len(config.QuerySettings)+len(settings))
+	for name, value := range config.QuerySettings {
+		merged[name] = value
+	}
+	for name, value := range settings {
+		merged[name] = value
+	}
+	config.QuerySettings = merged
+}
+
+// WithDeduplication collapses identical entries within a batch into one row
+// with a count column.
+func WithDeduplication() Option {
+	return func(config *Config) {
+		config.Deduplicate = true
+	}
+}
+
+// WithBackpressure calls fn when the buffer fills to threshold, from 0 to 1,
+// after having been below it.
+func WithBackpressure(threshold float64, fn func(ratio float64)) Option {
+	return func(config *Config) {
+		config.BackpressureThreshold = threshold
+		config.OnBackpressure = fn
+	}
+}
+
+// WithFieldValueEncoder renders field values for the fields column with
+// encode instead of fmt.Sprint.
+func WithFieldValueEncoder(encode func(key string, value interface{}) string) Option {
+	return func(config *Config) {
+		config.FieldValueEncoder = encode
+	}
+}
+
+// WithDeadLetterTable writes batches that still fail after all retries to
+// table, with the error in an error_reason column.
+func WithDeadLetterTable(table string) Option {
+	return func(config *Config) {
+		config.DeadLetterTable = table
+	}
+}
+
+// WithFallbackWriter writes entries the hook drops to w, such as os.Stderr.
+func WithFallbackWriter(w io.Writer) Option {
+	return func(config *Config) {
+		config.FallbackWriter = w
+	}
+}
+
+// WithRowType writes the ch-tagged fields of the struct v as extra typed
+// columns.
+func WithRowType(v interface{}) Option {
+	return func(config *Config) {
+		config.RowType = v
+	}
+}
+
+// WithZeroTimePreserved keeps unset entry times as they are instead of
+// stamping them with the current time.
+func WithZeroTimePreserved() Option {
+	return func(config *Config) {
+		config.PreserveZeroTime = true
+	}
+}
+
+// WithLevelTables inserts entries at each level of tables into the mapped
+// table instead of the configured one.
+func WithLevelTables(tables map[logrus.Level]string) Option {
+	return func(config *Config) {
+		config.LevelTableMap = tables
+	}
+}
+
+// WithNullableColumns writes NULL to columns when the entry lacks the field
+// they are filled from.
+func WithNullableColumns(columns ...string) Option {
+	return func(config *Config) {
+		config.NullableColumns = columns
+	}
+}
+
+// WithOnFlush calls fn after every batch inserted with its row count and
+// insert duration.
+func WithOnFlush(fn func(count int, duration time.Duration)) Option {
+	return func(config *Config) {
+		config.OnFlush = fn
+	}
+}
+
+// WithFlushStrategy selects how batches are sent over the native protocol.
+func WithFlushStrategy(strategy FlushStrategy) Option {
+	return func(config *Config) {
+		config.FlushStrategy = strategy
+	}
+}
+
+// WithSeverityCode writes the numeric severity of each entry to the severity
+// column, using codes for the levels it lists and SeverityCode otherwise.
+func WithSeverityCode(codes map[logrus.Level]uint8) Option {
+	return func(config *Config) {
+		config.IncludeSeverityCode = true
+		config.SeverityCodes = codes
+	}
+}
+
+// WithArrayColumns writes each of fields to an Array(String) column of the
+// same name instead of stringifying slices.
+func WithArrayColumns(fields ...string) Option {
+	return func(config *Config) {
+		config.ArrayColumns = fields
+	}
+}
+
+// WithTracerProvider traces every batch insert as a clickhouse.flush span of
+// a tracer from tp.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(config *Config) {
+		config.TracerProvider = tp
+	}
+}
+
+// WithCluster adds ON CLUSTER cluster to the generated DDL, defaulting the
+// engine to ReplicatedMergeTree. A non-empty distributedTable is created as
+// a Distributed table over the configured one and receives the inserts.
+func WithCluster(cluster, distributedTable string) Option {
+	return func(config *Config) {
+		config.ClusterName = cluster
+		config.DistributedTable = distributedTable
+	}
+}
+
+// WithFilter skips entries for which keep returns false.
+func WithFilter(keep func(entry *logrus.Entry) bool) Option {
+	return func(config *Config) {
+		config.Filter = keep
+	}
+}
+
+// WithRowMarshaler builds every row with marshaler instead of the built-in
+// columns, writing its values to columns in order.
+func WithRowMarshaler(marshaler RowMarshaler, columns ...string) Option {
+	return func(config *Config) {
+		config.RowMarshaler = marshaler
+		config.MarshalColumns = columns
+	}
+}
+
+// WithTimeField writes the time held in field, when present and parseable,
+// to the time column instead of the entry's time.
+func WithTimeField(field string) Option {
+	return func(config *Config) {
+		config.TimeField = field
+	}
+}
+
+// WithLazyConnect lets the hook be created while ClickHouse is unreachable,
+// connecting on the first flush instead.
+func WithLazyConnect() Option {
+	return func(config *Config) {
+		config.LazyConnect = true
+	}
+}
+
+// WithLevelEnum types the level column as an Enum8 of the level names.
+func WithLevelEnum() Option {
+	return func(config *Config) {
+		config.LevelEnum = true
+	}
+}
+
+// WithAllowedFields stores only the listed entry fields in the fields
+// column, counting the others under "other".
+func WithAllowedFields(keys ...string) Option {
+	return func(config *Config) {
+		config.AllowedFields = keys
+	}
+}
+
+// WithFormatted writes each entry as its logger formats it to the formatted
+// column.
+func WithFormatted() Option {
+	return func(config *Config) {
+		config.IncludeFormatted = true
+	}
+}
+
+// WithMaxInFlightBatches lets at most n flushes run at once.
+func WithMaxInFlightBatches(n int) Option {
+	return func(config *Config) {
+		config.MaxInFlightBatches = n
+	}
+}
+
+// WithCredentialFiles reads the username and password from the given files
+// instead of the DSN. Either may be "" to keep the DSN's.
+func WithCredentialFiles(usernameFile, passwordFile string) Option {
+	return func(config *Config) {
+		config.UsernameFile = usernameFile
+		config.PasswordFile = passwordFile
+	}
+}
+
+// WithReconnectInterval reopens the connection pools every interval.
+func WithReconnectInterval(interval time.Duration) Option {
+	return func(config *Config) {
+		config.ReconnectInterval = interval
+	}
+}
+
+// WithMessageTemplate renders the message column with the text/template
+// tmpl executed against each entry.
+func WithMessageTemplate(tmpl string) Option {
+	return func(config *Config) {
+		config.MessageTemplate = tmpl
+	}
+}
+
+// WithInsertDeduplicationToken tags every batch insert with a token derived
+// from its contents, so retries of the same batch are deduplicated by the
+// server.
+func WithInsertDeduplicationToken() Option {
+	return func(config *Config) {
+		config.DeduplicationToken = true
+	}
+}
+
+// WithRetentionField writes the retention in days held in field, or
+// defaultDays, to the retention_days column.
+func WithRetentionField(field string, defaultDays uint16) Option {
+	return func(config *Config) {
+		config.TTLField = field
+		config.DefaultRetentionDays = defaultDays
+	}
+}
+
+// WithDatabaseField inserts each entry into the database named by field.
+func WithDatabaseField(field string) Option {
+	return func(config *Config) {
+		config.DatabaseField = field
+	}
+}
+
+// WithDetailedErrors formats error fields with %+v, and with column also
+// writes the error field to the error column.
+func WithDetailedErrors(column bool) Option {
+	return func(config *Config) {
+		config.DetailedErrors = true
+		config.IncludeErrorColumn = column
+	}
+}
+
+// WithRetryable replaces IsTransient in deciding which failed inserts are
+// retried.
+func WithRetryable(retryable func(err error) bool) Option {
+	return func(config *Config) {
+		config.Retryable = retryable
+	}
+}
+
+// WithMinGroupSize holds back groups of fewer than size entries for up to
+// maxDelay, or FlushInterval when zero.
+func WithMinGroupSize(size int, maxDelay time.Duration) Option {
+	return func(config *Config) {
+		config.MinGroupSize = size
+		config.MaxGroupDelay = maxDelay
+	}
+}
+
+// WithSourceField copies field into the source column.
+func WithSourceField(field string) Option {
+	return func(config *Config) {
+		config.SourceField = field
+	}
+}
+
+// WithCustomInsert runs query for every batch, bound to the arguments args
+// returns for each entry, instead of the built-in INSERT.
+func WithCustomInsert(query string, args func(entry *logrus.Entry) []interface{}) Option {
+	return func(config *Config) {
+		config.CustomInsert = query
+		config.CustomInsertArgs = args
+	}
+}
+
+// WithTimeZone renders the time column in zone. The instant stored is the
+// same in any zone; see Config.TimeZone.
+func WithTimeZone(zone *time.Location) Option {
+	return func(config *Config) {
+		config.TimeZone = zone
+	}
+}
+
+// WithCircuitBreaker skips flushes for cooldown after threshold consecutive
+// ones failed.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(config *Config) {
+		config.BreakerThreshold = threshold
+		config.BreakerCooldown = cooldown
+	}
+}
+
+// WithRequestIDField copies field into the request_id column.
+func WithRequestIDField(field string) Option {
+	return func(config *Config) {
+		config.RequestIDField = field
+	}
+}
+
+// WithSkipInvalid makes ReplayJSONLines skip lines it can't parse.
+func WithSkipInvalid() Option {
+	return func(config *Config) {
+		config.SkipInvalid = true
+	}
+}
+
+// WithIngestLag writes the delay between logging and inserting each entry
+// to the ingest_lag_ms column.
+func WithIngestLag() Option {
+	return func(config *Config) {
+		config.IncludeIngestLag = true
+	}
+}
+
+// WithFlattenFields expands nested map and struct fields into dotted keys,
+// down to maxDepth levels.
+func WithFlattenFields(maxDepth int) Option {
+	return func(config *Config) {
+		config.FlattenDepth = maxDepth
+	}
+}
+
+// WithIdleFlushDelay flushes a partial batch once no entry has been
+// buffered for delay.
+func WithIdleFlushDelay(delay time.Duration) Option {
+	return func(config *Config) {
+		config.IdleFlushDelay = delay
+	}
+}
+
+// WithNumericFields writes the fields in types to numeric columns of the
+// same name and the given ClickHouse type.
+func WithNumericFields(types map[string]string) Option {
+	return func(config *Config) {
+		config.NumericFields = types
+	}
+}
+
+// WithInMemoryCompression compresses the entries kept after a failed flush
+// beyond the newest thresholdEntries. Compressed entries lose their Context,
+// Caller and Logger, as described on CompressThreshold.
+func WithInMemoryCompression(thresholdEntries int) Option {
+	return func(config *Config) {
+		config.CompressThreshold = thresholdEntries
+	}
+}
+
+// WithRemoveExtractedFields sets whether fields written to a column of their
+// own are left out of the fields column, which they are by default.
+func WithRemoveExtractedFields(remove bool) Option {
+	return func(config *Config) {
+		config.RemoveExtractedFields = &remove
+	}
+}
+
+// WithLevelNames stores names instead of logrus's level names for the levels
+// it lists.
+func WithLevelNames(names map[logrus.Level]string) Option {
+	return func(config *Config) {
+		config.LevelNames = names
+	}
+}
+
+// WithRowBinary sends HTTP inserts as RowBinary instead of JSONEachRow.
+func WithRowBinary() Option {
+	return func(config *Config) {
+		config.RowBinary = true
+	}
+}
+
+// WithTransform runs transform over every batch right before it is
+// inserted.
+func WithTransform(transform func(entries []logrus.Entry) []logrus.Entry) Option {
+	return func(config *Config) {
+		config.Transform = transform
+	}
+}
+
+// WithPartitionBucket inserts the entries of each bucket of event time, such
+// as an hour, separately.
+func WithPartitionBucket(bucket time.Duration) Option {
+	return func(config *Config) {
+		config.PartitionBucket = bucket
+	}
+}
+
+// WithMaxFieldsPerEntry keeps at most limit keys in the fields column of an
+// entry.
+func WithMaxFieldsPerEntry(limit int) Option {
+	return func(config *Config) {
+		config.MaxFieldsPerEntry = limit
+	}
+}
+
+// WithCredentialProvider connects with the credentials provider returns,
+// fetching fresh ones when the server rejects them.
+func WithCredentialProvider(provider func() (username, password string, err error)) Option {
+	return func(config *Config) {
+		config.CredentialProvider = provider
+	}
+}
+
+// WithAdditionalSink also writes every inserted batch to sink. It may be
+// given more than once.
+func WithAdditionalSink(sink Sink) Option {
+	return func(config *Config) {
+		config.AdditionalSinks = append(config.AdditionalSinks, sink)
+	}
+}
+
+// WithFanOutPolicy sets whether a failing additional sink fails the flush.
+func WithFanOutPolicy(policy FanOutPolicy) Option {
+	return func(config *Config) {
+		config.FanOutPolicy = policy
+	}
+}
+
+// WithColumnTypes sets the ClickHouse types of the columns in types.
+func WithColumnTypes(types map[string]string) Option {
+	return func(config *Config) {
+		config.ColumnTypes = types
+	}
+}
+
+// WithDeadlineFlush flushes entries whose context deadline is less than
+// threshold away before Fire returns.
+func WithDeadlineFlush(threshold time.Duration) Option {
+	return func(config *Config) {
+		config.DeadlineFlushThreshold = threshold
+	}
+}
+
+// WithInsertSettingsFunc adds the settings fn returns for each batch to its
+// INSERT.
+func WithInsertSettingsFunc(fn func(entries []logrus.Entry) map[string]string) Option {
+	return func(config *Config) {
+		config.InsertSettingsFunc = fn
+	}
+}
+
+// WithDynamicConfig reads batch_size, flush_interval and sample_rate.<level>
+// settings from table every pollInterval and applies them live.
+func WithDynamicConfig(table string, pollInterval time.Duration) Option {
+	return func(config *Config) {
+		config.DynamicConfigTable = table
+		config.DynamicConfigInterval = pollInterval
+	}
+}
+
+// WithSchemaConnection runs schema and metadata queries on a connection of
+// their own instead of the insert pool.
+func WithSchemaConnection() Option {
+	return func(config *Config) {
+		config.SchemaConnection = true
+	}
+}
+
+// WithBuildVersion writes version to the build_version column.
+func WithBuildVersion(version string) Option {
+	return func(config *Config) {
+		config.BuildVersion = version
+	}
+}
+
+// WithBuildCommit writes commit to the build_commit column.
+func WithBuildCommit(commit string) Option {
+	return func(config *Config) {
+		config.BuildCommit = commit
+	}
+}
+
+// WithBuildInfo fills in BuildVersion and BuildCommit, where not set yet,
+// from the module version and VCS revision recorded in the binary.
+func WithBuildInfo() Option {
+	return func(config *Config) {
+		version, commit := buildInfo()
+		if config.BuildVersion == "" {
+			config.BuildVersion = version
+		}
+		if config.BuildCommit == "" {
+			config.BuildCommit = commit
+		}
+	}
+}
+
+// WithGroupConcurrency runs up to limit of the per-table inserts of a flush
+// concurrently.
+func WithGroupConcurrency(limit int) Option {
+	return func(config *Config) {
+		config.GroupConcurrency = limit
+	}
+}
+
+// WithReplacingVersion writes the version of every row, computed by
+// version or from the entry time if nil, to column, and creates the table
+// as a ReplacingMergeTree collapsing duplicates by it.
+func WithReplacingVersion(column string, version func(entry *logrus.Entry) uint64) Option {
+	return func(config *Config) {
+		config.VersionColumn = column
+		config.VersionFunc = version
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// settingsOf returns the SETTINGS clause of the inserts of a hook
+// configured with opts.
+func settingsOf(t *testing.T, opts ...Option) string {
+	t.Helper()
+	config, err := prepareConfig(Config{BatchSize: 1}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settingsClause(config.QuerySettings)
+}
+
+func TestQuerySettingsMergeInAnyOrder(t *testing.T) {
+	settings := map[string]string{"insert_quorum": "2", "async_insert": "0"}
+	want := " SETTINGS async_insert = 1, insert_quorum = 2, wait_for_async_insert = 1"
+	for _, opts := range [][]Option{
+		{WithQuerySettings(settings), WithAsyncInsert(true)},
+		{WithAsyncInsert(true), WithQuerySettings(map[string]string{"insert_quorum": "2"})},
+	} {
+		if got := settingsOf(t, opts...); got != want {
+			t.Errorf("settings %q, want %q", got, want)
+		}
+	}
+	if len(settings) != 2 || settings["async_insert"] != "0" {
+		t.Errorf("WithAsyncInsert modified the map passed to WithQuerySettings: %v", settings)
+	}
+
+	columns := []column{{name: "message"}}
+	clause := settingsOf(t, WithQuerySettings(map[string]string{"max_threads": "1"}), WithAsyncInsert(false))
+	want = "INSERT INTO `logs` (`message`) SETTINGS async_insert = 1, max_threads = 1, wait_for_async_insert = 0 VALUES (?)"
+	if got := insertQuery("logs", columns, clause); got != want {
+		t.Errorf("insertQuery = %q, want %q", got, want)
+	}
+	if got := settingsOf(t, WithQuerySettings(map[string]string{"a": "1"}), WithQuerySettings(map[string]string{"b": "x"})); !strings.Contains(got, "a = 1, b = 'x'") {
+		t.Errorf("two WithQuerySettings gave %q, want both settings", got)
+	}
+}
+
+func TestDistributedSyncInAnyOrder(t *testing.T) {
+	want := " SETTINGS insert_distributed_sync = 1, insert_distributed_timeout = 3, max_threads = 2"
+	settings := WithQuerySettings(map[string]string{"max_threads": "2"})
+	for _, opts := range [][]Option{
+		{settings, WithDistributedSync(2500 * time.Millisecond)},
+		{WithDistributedSync(2500 * time.Millisecond), settings},
+	} {
+		if got := settingsOf(t, opts...); got != want {
+			t.Errorf("settings %q, want %q", got, want)
+		}
+	}
+	if got, want := settingsOf(t, WithDistributedSync(0)), " SETTINGS insert_distributed_sync = 1, insert_distributed_timeout = 0"; got != want {
+		t.Errorf("settings %q, want %q", got, want)
+	}
+}
+
+func TestMaxExecutionTimeInAnyOrder(t *testing.T) {
+	want := " SETTINGS async_insert = 1, max_execution_time = 2, wait_for_async_insert = 1"
+	for _, opts := range [][]Option{
+		{WithQuerySettings(map[string]string{"max_execution_time": "60"}), WithMaxExecutionTime(1500 * time.Millisecond), WithAsyncInsert(true)},
+		{WithAsyncInsert(true), WithMaxExecutionTime(1500 * time.Millisecond)},
+		{WithMaxExecutionTime(time.Minute), WithAsyncInsert(true), WithQuerySettings(map[string]string{"max_execution_time": "2"})},
+	} {
+		if got := settingsOf(t, opts...); got != want {
+			t.Errorf("settings %q, want %q", got, want)
+		}
+	}
+	if got, want := settingsOf(t, WithMaxExecutionTime(time.Millisecond)), " SETTINGS max_execution_time = 1"; got != want {
+		t.Errorf("settings %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReplayJSONLines feeds the newline-delimited JSON log objects read from r
+// through Fire, for backfilling archived logs, and returns how many were
+// accepted. The keys logrus.JSONFormatter writes by default map to the
+// entry: time, as RFC 3339 or Unix seconds, level and msg, or message.
+// Every other key becomes a field. Objects without a time get the current
+// one, and without a level Info.
+//
+// It stops at the first line that isn't a JSON object, or has a level or
+// time that doesn't parse, unless SkipInvalid is set, and at the first
+// error Fire returns. Entries are buffered like any other, so call Flush
+// afterwards to insert the last batch.
+func (hook *ClickHouseHook) ReplayJSONLines(r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	var count int
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return count, readErr
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			entry, err := parseJSONLine(data)
+			switch {
+			case err == nil:
+				if err := hook.Fire(entry); err != nil {
+					return count, err
+				}
+				count++
+			case !hook.config.SkipInvalid:
+				return count, fmt.Errorf("clickhouse hook: replaying line %d: %w", line, err)
+			}
+		}
+		if readErr != nil {
+			return count, nil
+		}
+	}
+}
+
+// parseJSONLine converts one JSON log object into an entry.
+func parseJSONLine(data []byte) (*logrus.Entry, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	entry := &logrus.Entry{Level: logrus.InfoLevel, Data: make(logrus.Fields, len(object))}
+	for key, value := range object {
+		switch key {
+		case logrus.FieldKeyTime:
+			t, ok := parseTime(value)
+			if !ok {
+				return nil, fmt.Errorf("invalid time %v", value)
+			}
+			entry.Time = t
+		case logrus.FieldKeyLevel:
+			level, err := logrus.ParseLevel(fmt.Sprint(value))
+			if err != nil {
+				return nil, err
+			}
+			entry.Level = level
+		case logrus.FieldKeyMsg, "message":
+			entry.Message = fmt.Sprint(value)
+		default:
+			entry.Data[key] = value
+		}
+	}
+	return entry, nil
+}
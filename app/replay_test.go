@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const replayLines = `{"time":"2024-01-01T00:00:00Z","level":"error","msg":"a","status":404,"latency":1.5}
+{"time":1700000000,"level":"warning","message":"b","user":"u"}
+not json
+{"msg":"c"}
+`
+
+func TestReplayJSONLines(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithNumericFields(map[string]string{"status": "UInt16", "latency": "Float64"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	n, err := hook.ReplayJSONLines(strings.NewReader(replayLines))
+	if n != 2 || err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("ReplayJSONLines = %d, %v, want 2 and an error naming line 3", n, err)
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	entries := sink.Entries()
+	if got := messagesOf(entries); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("replayed %v, want [a b]", got)
+	}
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !entries[0].Time.Equal(want) || entries[0].Level != logrus.ErrorLevel {
+		t.Errorf("first entry at %v, %s, want %v, error", entries[0].Time, entries[0].Level, want)
+	}
+	if want := time.Unix(1700000000, 0); !entries[1].Time.Equal(want) || entries[1].Level != logrus.WarnLevel || entries[1].Data["user"] != "u" {
+		t.Errorf("second entry at %v, %s with %v, want %v, warning with user u", entries[1].Time, entries[1].Level, entries[1].Data, want)
+	}
+
+	// JSON numbers decode as float64, both from the archive and from the
+	// disk buffer's records, and the numeric columns convert them.
+	record, err := encodeRecord(&entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []logrus.Entry{entries[0], decoded} {
+		if status, ok := entry.Data["status"].(float64); !ok || status != 404 {
+			t.Errorf("status field %#v, want float64 404", entry.Data["status"])
+		}
+		if got := columnNamed(t, hook, "status").value(&entry); got != uint16(404) {
+			t.Errorf("status column %#v, want uint16 404", got)
+		}
+		if got := columnNamed(t, hook, "latency").value(&entry); got != 1.5 {
+			t.Errorf("latency column %#v, want 1.5", got)
+		}
+	}
+}
+
+func TestReplayJSONLinesSkipInvalid(t *testing.T) {
+	sink := &MemorySink{}
+	hook, err := NewMemoryHook(sink, 100, WithSkipInvalid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+
+	n, err := hook.ReplayJSONLines(strings.NewReader(replayLines + `{"level":"loud","msg":"d"}`))
+	if n != 3 || err != nil {
+		t.Fatalf("ReplayJSONLines = %d, %v, want 3 and no error", n, err)
+	}
+	if err := hook.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	entries := sink.Entries()
+	if got := messagesOf(entries); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("replayed %v, want [a b c]", got)
+	}
+	if entries[2].Level != logrus.InfoLevel || entries[2].Time.IsZero() {
+		t.Errorf("entry without level or time at %v, %s, want now, info", entries[2].Time, entries[2].Level)
+	}
+}
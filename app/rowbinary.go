@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rowBinaryEncoder appends a column value to b in ClickHouse's RowBinary
+// format.
+type rowBinaryEncoder func(b []byte, value interface{}) ([]byte, error)
+
+// rowBinaryEncoders returns an encoder for each of columns, or an error
+// naming the first column whose type RowBinary inserts don't support.
+func rowBinaryEncoders(columns []column) ([]rowBinaryEncoder, error) {
+	encoders := make([]rowBinaryEncoder, len(columns))
+	for i, col := range columns {
+		encoder, ok := rowBinaryEncoderFor(col.typ)
+		if !ok {
+			return nil, fmt.Errorf("clickhouse hook: column %q of type %q can't be inserted as RowBinary", col.name, col.typ)
+		}
+		encoders[i] = encoder
+	}
+	return encoders, nil
+}
+
+// rowBinaryEncoderFor returns the encoder of ClickHouse type typ: String,
+// DateTime, DateTime64, the integer and float types, Array(String),
+// Map(String, String), and LowCardinality or Nullable variants of them.
+func rowBinaryEncoderFor(typ string) (rowBinaryEncoder, bool) {
+	if inner, ok := unwrapType(typ, "LowCardinality("); ok {
+		return rowBinaryEncoderFor(inner)
+	}
+	if inner, ok := unwrapType(typ, "Nullable("); ok {
+		encoder, ok := rowBinaryEncoderFor(inner)
+		if !ok {
+			return nil, false
+		}
+		return func(b []byte, value interface{}) ([]byte, error) {
+			if value == nil {
+				return append(b, 1), nil
+			}
+			return encoder(append(b, 0), value)
+		}, true
+	}
+	if inner, ok := unwrapType(typ, "DateTime64("); ok {
+		precision, err := strconv.Atoi(inner)
+		if err != nil || precision < 0 || precision > 9 {
+			return nil, false
+		}
+		return func(b []byte, value interface{}) ([]byte, error) {
+			t, ok := value.(time.Time)
+			if !ok {
+				return nil, encodeError(value, typ)
+			}
+			scale := int64(math.Pow10(9 - precision))
+			ticks := t.Unix()*int64(math.Pow10(precision)) + int64(t.Nanosecond())/scale
+			return binary.LittleEndian.AppendUint64(b, uint64(ticks)), nil
+		}, true
+	}
+
+	switch typ {
+	case "String":
+		return func(b []byte, value interface{}) ([]byte, error) {
+			switch v := value.(type) {
+			case string:
+				return appendRowBinaryString(b, v), nil
+			case []byte:
+				return appendRowBinaryString(b, string(v)), nil
+			}
+			return appendRowBinaryString(b, fmt.Sprint(value)), nil
+		}, true
+	case "DateTime":
+		return func(b []byte, value interface{}) ([]byte, error) {
+			t, ok := value.(time.Time)
+			if !ok {
+				return nil, encodeError(value, typ)
+			}
+			seconds := min(max(t.Unix(), 0), math.MaxUint32)
+			return binary.LittleEndian.AppendUint32(b, uint32(seconds)), nil
+		}, true
+	case "Array(String)":
+		return func(b []byte, value interface{}) ([]byte, error) {
+			items, ok := value.([]string)
+			if !ok {
+				return nil, encodeError(value, typ)
+			}
+			b = binary.AppendUvarint(b, uint64(len(items)))
+			for _, item := range items {
+				b = appendRowBinaryString(b, item)
+			}
+			return b, nil
+		}, true
+	case "Map(String, String)":
+		return func(b []byte, value interface{}) ([]byte, error) {
+			m, ok := value.(map[string]string)
+			if !ok {
+				return nil, encodeError(value, typ)
+			}
+			b = binary.AppendUvarint(b, uint64(len(m)))
+			for _, key := range slices.Sorted(maps.Keys(m)) {
+				b = appendRowBinaryString(appendRowBinaryString(b, key), m[key])
+			}
+			return b, nil
+		}, true
+	}
+	if zero, ok := numericZero[typ]; ok {
+		return numberEncoder(typ, reflect.TypeOf(zero)), true
+	}
+	return nil, false
+}
+
+// numberEncoder returns the encoder of the numeric ClickHouse type typ,
+// whose Go equivalent is t. Values of any integer or float kind are
+// converted to t.
+func numberEncoder(typ string, t reflect.Type) rowBinaryEncoder {
+	size := int(t.Size())
+	return func(b []byte, value interface{}) ([]byte, error) {
+		v := reflect.ValueOf(value)
+		if !v.IsValid() || !isNumeric(v.Kind()) {
+			return nil, encodeError(value, typ)
+		}
+		v = v.Convert(t)
+		var bits uint64
+		switch t.Kind() {
+		case reflect.Float32:
+			bits = uint64(math.Float32bits(float32(v.Float())))
+		case reflect.Float64:
+			bits = math.Float64bits(v.Float())
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			bits = v.Uint()
+		default:
+			bits = uint64(v.Int())
+		}
+		for i := 0; i < size; i++ {
+			b = append(b, byte(bits>>(8*i)))
+		}
+		return b, nil
+	}
+}
+
+// unwrapType returns the argument of typ when it is prefix, say
+// "Nullable(", applied to one.
+func unwrapType(typ, prefix string) (string, bool) {
+	if !strings.HasPrefix(typ, prefix) || !strings.HasSuffix(typ, ")") {
+		return "", false
+	}
+	return typ[len(prefix) : len(typ)-1], true
+}
+
+// appendRowBinaryString appends s with its length as a varint.
+func appendRowBinaryString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// encodeError reports a column value that doesn't fit its type.
+func encodeError(value interface{}, typ string) error {
+	return fmt.Errorf("clickhouse hook: can't encode %T as %s", value, typ)
+}
+
+// encodeRowBinary encodes the columns of entries as RowBinary rows with
+// encoders, those rowBinaryEncoders returned for columns.
+func encodeRowBinary(columns []column, encoders []rowBinaryEncoder, entries []logrus.Entry) (*bytes.Buffer, error) {
+	var b []byte
+	var err error
+	for i := range entries {
+		for j, col := range columns {
+			if b, err = encoders[j](b, col.value(&entries[i])); err != nil {
+				return nil, fmt.Errorf("%w in column %q", err, col.name)
+			}
+		}
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+// rowBinaryInsertQuery returns the INSERT of columns into table whose data
+// follows as RowBinary.
+func rowBinaryInsertQuery(table string, columns []column, settings string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s)%s FORMAT RowBinary", quoteTable(table), columnList(columns), settings)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRowBinaryEncoders(t *testing.T) {
+	at := time.Date(2021, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	beforeEpoch := time.Unix(-1, 500000000)
+	for _, tc := range []struct {
+		name  string
+		typ   string
+		value interface{}
+		want  []byte
+	}{
+		{"string", "String", "héllo", []byte{6, 'h', 0xc3, 0xa9, 'l', 'l', 'o'}},
+		{"empty string", "String", "", []byte{0}},
+		{"bytes as string", "String", []byte("ab"), []byte{2, 'a', 'b'}},
+		{"datetime", "DateTime", at, []byte{165, 226, 239, 95}},
+		{"datetime before 1970", "DateTime", beforeEpoch, []byte{0, 0, 0, 0}},
+		{"datetime64(3)", "DateTime64(3)", at, []byte{3, 85, 13, 193, 118, 1, 0, 0}},
+		{"datetime64(9)", "DateTime64(9)", at, []byte{21, 255, 115, 174, 61, 75, 86, 22}},
+		{"datetime64(3) before 1970", "DateTime64(3)", beforeEpoch, []byte{12, 254, 255, 255, 255, 255, 255, 255}},
+		{"datetime64(9) before 1970", "DateTime64(9)", beforeEpoch, []byte{0, 155, 50, 226, 255, 255, 255, 255}},
+		{"nullable nil", "Nullable(String)", nil, []byte{1}},
+		{"nullable value", "Nullable(String)", "a", []byte{0, 1, 'a'}},
+		{"low cardinality", "LowCardinality(String)", "a", []byte{1, 'a'}},
+		{"array", "Array(String)", []string{"a", "bc"}, []byte{2, 1, 'a', 2, 'b', 'c'}},
+		{"empty array", "Array(String)", []string{}, []byte{0}},
+		{"map", "Map(String, String)", map[string]string{"b": "2", "a": "1"}, []byte{2, 1, 'a', 1, '1', 1, 'b', 1, '2'}},
+		{"uint8", "UInt8", uint8(200), []byte{200}},
+		{"int8", "Int8", int8(-2), []byte{0xfe}},
+		{"uint16", "UInt16", uint16(0x0102), []byte{2, 1}},
+		{"int16", "Int16", int16(-2), []byte{0xfe, 0xff}},
+		{"uint32", "UInt32", uint32(0x01020304), []byte{4, 3, 2, 1}},
+		{"int32", "Int32", int32(-2), []byte{0xfe, 0xff, 0xff, 0xff}},
+		{"uint64", "UInt64", uint64(0x0102030405060708), []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		{"int64", "Int64", int64(-2), []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"float32", "Float32", float32(1.5), []byte{0, 0, 0xc0, 0x3f}},
+		{"float64", "Float64", 1.5, []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"converted int", "UInt16", 258, []byte{2, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			encoder, ok := rowBinaryEncoderFor(tc.typ)
+			if !ok {
+				t.Fatalf("no encoder for %s", tc.typ)
+			}
+			got, err := encoder([]byte{0xaa}, tc.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append([]byte{0xaa}, tc.want...); !bytes.Equal(got, want) {
+				t.Errorf("encoded %v as % x, want % x", tc.value, got, want)
+			}
+		})
+	}
+}
+
+func TestRowBinaryEncodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		typ   string
+		value interface{}
+	}{
+		{"DateTime", "today"},
+		{"DateTime64(3)", 1},
+		{"Array(String)", "a"},
+		{"Map(String, String)", map[string]int{"a": 1}},
+		{"Int32", "1"},
+		{"Nullable(Int32)", "1"},
+	} {
+		encoder, ok := rowBinaryEncoderFor(tc.typ)
+		if !ok {
+			t.Fatalf("no encoder for %s", tc.typ)
+		}
+		if _, err := encoder(nil, tc.value); err == nil || !strings.Contains(err.Error(), "can't encode") {
+			t.Errorf("encoding %T as %s returned %v, want an encode error", tc.value, tc.typ, err)
+		}
+	}
+}
+
+func TestRowBinaryEncodersUnsupportedType(t *testing.T) {
+	columns := []column{{name: "message", typ: "String"}, {name: "id", typ: "UUID"}}
+	_, err := rowBinaryEncoders(columns)
+	if err == nil || !strings.Contains(err.Error(), `column "id" of type "UUID"`) {
+		t.Fatalf("rowBinaryEncoders returned %v, want an error naming column id", err)
+	}
+	for _, typ := range []string{"DateTime64(10)", "DateTime64(x)", "Nullable(UUID)", "Array(Int32)"} {
+		if _, ok := rowBinaryEncoderFor(typ); ok {
+			t.Errorf("encoder for unsupported type %s", typ)
+		}
+	}
+}
+
+func TestEncodeRowBinary(t *testing.T) {
+	columns := []column{
+		{name: "message", typ: "String", value: func(entry *logrus.Entry) interface{} { return entry.Message }},
+		{name: "user", typ: "Nullable(String)", value: func(entry *logrus.Entry) interface{} { return entry.Data["user"] }},
+	}
+	encoders, err := rowBinaryEncoders(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []logrus.Entry{
+		{Message: "a", Data: logrus.Fields{"user": "u"}},
+		{Message: "bc"},
+	}
+	body, err := encodeRowBinary(columns, encoders, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 'a', 0, 1, 'u', 2, 'b', 'c', 1}; !bytes.Equal(body.Bytes(), want) {
+		t.Errorf("encoded rows as % x, want % x", body.Bytes(), want)
+	}
+
+	entries[1].Data = logrus.Fields{"user": 7}
+	columns[1].typ = "Nullable(DateTime)"
+	if encoders, err = rowBinaryEncoders(columns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encodeRowBinary(columns, encoders, entries); err == nil || !strings.Contains(err.Error(), `in column "user"`) {
+		t.Errorf("encodeRowBinary returned %v, want an error naming column user", err)
+	}
+}
+
+func TestHTTPSinkPostsRowBinary(t *testing.T) {
+	var query string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	columns := []column{{name: "message", typ: "String", value: func(entry *logrus.Entry) interface{} { return entry.Message }}}
+	sink, err := newHTTPSink(server.URL, "logs", columns, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.encoders, err = rowBinaryEncoders(columns); err != nil {
+		t.Fatal(err)
+	}
+	sink.rowBinary = true
+	if err := sink.WriteBatch(context.Background(), []logrus.Entry{{Message: "a"}, {Message: "bc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO `logs` (`message`) FORMAT RowBinary"; query != want {
+		t.Errorf("query %q, want %q", query, want)
+	}
+	if want := []byte{1, 'a', 2, 'b', 'c'}; !bytes.Equal(body, want) {
+		t.Errorf("body % x, want % x", body, want)
+	}
+}
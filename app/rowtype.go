@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EntryRow is implemented by row types, through a pointer receiver, that
+// fill themselves from an entry instead of having their fields looked up in
+// entry.Data.
+type EntryRow interface {
+	FromEntry(entry *logrus.Entry)
+}
+
+// rowType describes a struct registered with WithRowType. Each exported
+// field tagged ch:"name" becomes a column of that name after the standard
+// ones.
+type rowType struct {
+	typ    reflect.Type
+	fields []rowField
+	filled bool
+
+	// mu guards the row last built, and the entry it was built for, so the
+	// columns of one row share a single FromEntry call.
+	mu    sync.Mutex
+	entry *logrus.Entry
+	row   reflect.Value
+}
+
+// rowField is one column of a row type.
+type rowField struct {
+	index  int
+	column string
+	typ    string
+}
+
+// reflectTimeType is the reflect.Type of time.Time.
+var reflectTimeType = reflect.TypeOf(time.Time{})
+
+// newRowType checks that v is a struct, or a pointer to one, whose tagged
+// fields all have a type the hook can write.
+func newRowType(v interface{}) (*rowType, error) {
+	typ := reflect.TypeOf(v)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("clickhouse hook: row type %T is not a struct", v)
+	}
+
+	r := &rowType{typ: typ, filled: reflect.PointerTo(typ).Implements(reflect.TypeOf((*EntryRow)(nil)).Elem())}
+	seen := make(map[string]bool)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := field.Tag.Get("ch")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		if !namePattern.MatchString(name) {
+			return nil, fmt.Errorf("clickhouse hook: row type %s: invalid column name %q", typ, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("clickhouse hook: row type %s: duplicate column %q", typ, name)
+		}
+		seen[name] = true
+		chType, ok := clickHouseType(field.Type)
+		if !ok {
+			return nil, fmt.Errorf("clickhouse hook: row type %s: field %s has unsupported type %s", typ, field.Name, field.Type)
+		}
+		r.fields = append(r.fields, rowField{index: i, column: name, typ: chType})
+	}
+	if len(r.fields) == 0 {
+		return nil, fmt.Errorf("clickhouse hook: row type %s has no fields tagged ch", typ)
+	}
+	return r, nil
+}
+
+// clickHouseType returns the column type written for a Go field type.
+func clickHouseType(typ reflect.Type) (string, bool) {
+	if typ == reflectTimeType {
+		return "DateTime", true
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return "String", true
+	case reflect.Bool:
+		return "UInt8", true
+	case reflect.Int8:
+		return "Int8", true
+	case reflect.Int16:
+		return "Int16", true
+	case reflect.Int32:
+		return "Int32", true
+	case reflect.Int, reflect.Int64:
+		return "Int64", true
+	case reflect.Uint8:
+		return "UInt8", true
+	case reflect.Uint16:
+		return "UInt16", true
+	case reflect.Uint32:
+		return "UInt32", true
+	case reflect.Uint, reflect.Uint64:
+		return "UInt64", true
+	case reflect.Float32:
+		return "Float32", true
+	case reflect.Float64:
+		return "Float64", true
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.String {
+			return "Array(String)", true
+		}
+	case reflect.Map:
+		if typ.Key().Kind() == reflect.String && typ.Elem().Kind() == reflect.String {
+			return "Map(String, String)", true
+		}
+	}
+	return "", false
+}
+
+// columns returns a column for each field of the row type.
+func (r *rowType) columns() []column {
+	columns := make([]column, len(r.fields))
+	for i, field := range r.fields {
+		columns[i] = column{name: field.column, typ: field.typ, value: func(entry *logrus.Entry) interface{} {
+			value := r.build(entry).Field(field.index)
+			if value.Kind() == reflect.Bool {
+				if value.Bool() {
+					return uint8(1)
+				}
+				return uint8(0)
+			}
+			return value.Interface()
+		}}
+		if !r.filled {
+			columns[i].field = field.column
+		}
+	}
+	return columns
+}
+
+// build returns the row for entry, reusing the last one when the columns of
+// the same entry ask in turn.
+func (r *rowType) build(entry *logrus.Entry) reflect.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.entry == entry {
+		return r.row
+	}
+	row := reflect.New(r.typ)
+	if r.filled {
+		row.Interface().(EntryRow).FromEntry(entry)
+	} else {
+		for _, field := range r.fields {
+			if data, ok := entry.Data[field.column]; ok {
+				setField(row.Elem().Field(field.index), data)
+			}
+		}
+	}
+	r.entry, r.row = entry, row.Elem()
+	return r.row
+}
+
+// setField stores data in dst, converting between numeric types and parsing
+// strings as needed. Values that don't fit leave dst at its zero value.
+func setField(dst reflect.Value, data interface{}) {
+	src := reflect.ValueOf(data)
+	if !src.IsValid() {
+		return
+	}
+	switch {
+	case src.Type().AssignableTo(dst.Type()):
+		dst.Set(src)
+	case dst.Kind() == reflect.String:
+		dst.SetString(fmt.Sprint(data))
+	case src.Kind() == reflect.String:
+		parseField(dst, src.String())
+	case isNumeric(src.Kind()) && isNumeric(dst.Kind()):
+		dst.Set(src.Convert(dst.Type()))
+	}
+}
+
+// parseField parses s into a numeric or boolean dst.
+func parseField(dst reflect.Value, s string) {
+	switch {
+	case dst.Kind() == reflect.Bool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			dst.SetBool(b)
+		}
+	case dst.CanInt():
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && !dst.OverflowInt(n) {
+			dst.SetInt(n)
+		}
+	case dst.CanUint():
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil && !dst.OverflowUint(n) {
+			dst.SetUint(n)
+		}
+	case dst.CanFloat():
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			dst.SetFloat(f)
+		}
+	}
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
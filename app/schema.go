@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SchemaError describes how the target table differs from the columns the
+// hook writes.
+type SchemaError struct {
+	Table string
+	// Missing lists columns the hook writes that the table lacks.
+	Missing []string
+	// Mismatched lists columns whose type is incompatible, as
+	// "name: have <type>, want <type>".
+	Mismatched []string
+}
+
+func (e *SchemaError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing columns "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Mismatched) > 0 {
+		problems = append(problems, "mismatched columns "+strings.Join(e.Mismatched, "; "))
+	}
+	return fmt.Sprintf("clickhouse hook: table %s: %s", e.Table, strings.Join(problems, "; "))
+}
+
+// createTableQuery builds the CREATE TABLE IF NOT EXISTS statement for the
+// columns the hook writes.
+func createTableQuery(config Config, columns []column) string {
+	engine := config.TableEngine
+	switch {
+	case engine != "":
+	case config.VersionColumn != "":
+		engine = replacingEngine(config)
+	case config.ClusterName != "":
+		engine = defaultReplicatedEngine
+	default:
+		engine = defaultEngine
+	}
+	orderBy := config.TableOrderBy
+	if orderBy == "" {
+		orderBy = quoteName(config.columnName("time", "event_time"))
+	}
+
+	definitions := make([]string, len(columns))
+	for i, col := range columns {
+		definitions[i] = fmt.Sprintf("    %s %s", quoteName(col.name), col.typ)
+		if col.codec != "" {
+			definitions[i] += fmt.Sprintf(" CODEC(%s)", col.codec)
+		}
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s (\n%s\n) ENGINE = %s\nORDER BY (%s)",
+		quoteTable(config.TableName), config.onCluster(), strings.Join(definitions, ",\n"), engine, orderBy)
+	switch {
+	case config.TableTTL != "":
+		query += "\nTTL " + config.TableTTL
+	case config.TTLField != "":
+		query += fmt.Sprintf("\nTTL %s + toIntervalDay(`retention_days`)", quoteName(config.columnName("time", "event_time")))
+	}
+	return query
+}
+
+// replacingEngine returns the ReplacingMergeTree engine, replicated with a
+// ClusterName, that collapses rows by VersionColumn.
+func replacingEngine(config Config) string {
+	version := quoteName(config.VersionColumn)
+	if config.ClusterName != "" {
+		return fmt.Sprintf("ReplicatedReplacingMergeTree(%s, %s)", replicaParams, version)
+	}
+	return fmt.Sprintf("ReplacingMergeTree(%s)", version)
+}
+
+// createDistributedQuery builds the CREATE TABLE IF NOT EXISTS statement
+// for DistributedTable, spreading inserts over the cluster's shards at
+// random.
+func createDistributedQuery(config Config) string {
+	database, name := splitTableName(config.TableName)
+	database = quoteName(database)
+	if database == "" {
+		database = "currentDatabase()"
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s AS %s\nENGINE = Distributed(%s, %s, %s, rand())",
+		quoteTable(config.DistributedTable), config.onCluster(), quoteTable(config.TableName),
+		quoteName(config.ClusterName), database, quoteName(name))
+}
+
+// onCluster returns the ON CLUSTER clause of generated DDL, or "" without a
+// ClusterName.
+func (config Config) onCluster() string {
+	if config.ClusterName == "" {
+		return ""
+	}
+	return " ON CLUSTER " + quoteName(config.ClusterName)
+}
+
+// insertTable is the table inserts go to: DistributedTable if set,
+// otherwise TableName.
+func (config Config) insertTable() string {
+	if config.DistributedTable != "" {
+		return config.DistributedTable
+	}
+	return config.TableName
+}
+
+// withSchemaDB runs fn with the pool schema and metadata queries go to: the
+// primary node's, or with SchemaConnection a single connection pool of its
+// own, opened on first use and closed again afterwards unless
+// DynamicConfigTable needs it.
+func (hook *ClickHouseHook) withSchemaDB(fn func(db *sql.DB) error) error {
+	if !hook.config.SchemaConnection {
+		return hook.primary.withDB(fn)
+	}
+	hook.schemaMu.Lock()
+	defer hook.schemaMu.Unlock()
+
+	if hook.schema == nil {
+		db, err := openPool(hook.primary.dsn, hook.currentConfig())
+		if err != nil {
+			return err
+		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		hook.schema = db
+	}
+	err := fn(hook.schema)
+	if hook.config.DynamicConfigTable == "" {
+		hook.schema.Close()
+		hook.schema = nil
+	}
+	return err
+}
+
+// closeSchemaPool closes the pool of the SchemaConnection, if it is open.
+func (hook *ClickHouseHook) closeSchemaPool() error {
+	hook.schemaMu.Lock()
+	defer hook.schemaMu.Unlock()
+	if hook.schema == nil {
+		return nil
+	}
+	err := hook.schema.Close()
+	hook.schema = nil
+	return err
+}
+
+// createTable creates the target table unless it already exists.
+func createTable(ctx context.Context, db *sql.DB, config Config, columns []column) error {
+	if _, err := db.ExecContext(ctx, createTableQuery(config, columns)); err != nil {
+		return fmt.Errorf("clickhouse hook: creating table %s: %w", config.TableName, err)
+	}
+	return nil
+}
+
+// verifySchema checks that table has every column in columns with a
+// compatible type, returning a *SchemaError otherwise.
+func verifySchema(ctx context.Context, db *sql.DB, table string, columns []column) error {
+	database, name := splitTableName(table)
+	query := "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?"
+	args := []interface{}{name}
+	if database != "" {
+		query = "SELECT name, type FROM system.columns WHERE database = ? AND table = ?"
+		args = []interface{}{database, name}
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("clickhouse hook: reading schema of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	actual := make(map[string]string)
+	for rows.Next() {
+		var colName, colType string
+		if err := rows.Scan(&colName, &colType); err != nil {
+			return fmt.Errorf("clickhouse hook: reading schema of %s: %w", table, err)
+		}
+		actual[colName] = colType
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("clickhouse hook: reading schema of %s: %w", table, err)
+	}
+	if len(actual) == 0 {
+		return fmt.Errorf("clickhouse hook: table %s does not exist", table)
+	}
+
+	schemaErr := &SchemaError{Table: table}
+	for _, col := range columns {
+		have, ok := actual[col.name]
+		switch {
+		case !ok:
+			schemaErr.Missing = append(schemaErr.Missing, col.name)
+		case typeFamily(have) != typeFamily(col.typ):
+			schemaErr.Mismatched = append(schemaErr.Mismatched,
+				fmt.Sprintf("%s: have %s, want %s", col.name, have, col.typ))
+		}
+	}
+	if len(schemaErr.Missing) > 0 || len(schemaErr.Mismatched) > 0 {
+		return schemaErr
+	}
+	return nil
+}
+
+// splitTableName splits an optionally database-qualified table name.
+func splitTableName(table string) (database, name string) {
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return "", table
+}
+
+// quoteName quotes an identifier with backticks, so that reserved words
+// such as date or index can be used as names. Names are validated against
+// namePattern beforehand, so they never contain a backtick themselves. An
+// empty name stays empty.
+func quoteName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "`" + name + "`"
+}
+
+// quoteTable quotes both parts of a table name qualified with a database.
+func quoteTable(table string) string {
+	database, name := splitTableName(table)
+	if database == "" {
+		return quoteName(name)
+	}
+	return quoteName(database) + "." + quoteName(name)
+}
+
+// typeFamily reduces a ClickHouse type to the family used for compatibility
+// checks: LowCardinality and Nullable wrappers and type parameters are
+// dropped, and DateTime64 is treated as DateTime.
+func typeFamily(typ string) string {
+	for _, wrapper := range []string{"LowCardinality(", "Nullable("} {
+		for strings.HasPrefix(typ, wrapper) && strings.HasSuffix(typ, ")") {
+			typ = typ[len(wrapper) : len(typ)-1]
+		}
+	}
+	if i := strings.IndexByte(typ, '('); i >= 0 {
+		typ = typ[:i]
+	}
+	if typ == "DateTime64" {
+		typ = "DateTime"
+	}
+	return typ
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCreateTableQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "CREATE TABLE IF NOT EXISTS `logs`.`app` (\n" +
+			"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String\n" +
+			") ENGINE = MergeTree\nORDER BY (`event_time`)"},
+		{"cluster", []Option{WithCluster("main", "logs_all")}, "CREATE TABLE IF NOT EXISTS `logs`.`app` ON CLUSTER `main` (\n" +
+			"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String\n" +
+			") ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}')\n" +
+			"ORDER BY (`event_time`)"},
+		{"ttl and codec", []Option{WithTableTTL("event_time + INTERVAL 30 DAY"), WithMessageCodec("ZSTD(3)")},
+			"CREATE TABLE IF NOT EXISTS `logs`.`app` (\n" +
+				"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String CODEC(ZSTD(3))\n" +
+				") ENGINE = MergeTree\nORDER BY (`event_time`)\nTTL event_time + INTERVAL 30 DAY"},
+		{"replacing", []Option{WithCreateTable("", "`message`, `event_time`"), WithReplacingVersion("version", nil)},
+			"CREATE TABLE IF NOT EXISTS `logs`.`app` (\n" +
+				"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String,\n    `version` UInt64\n" +
+				") ENGINE = ReplacingMergeTree(`version`)\nORDER BY (`message`, `event_time`)"},
+		{"replicated replacing", []Option{WithCreateTable("", "`message`"), WithReplacingVersion("version", nil), WithCluster("main", "")},
+			"CREATE TABLE IF NOT EXISTS `logs`.`app` ON CLUSTER `main` (\n" +
+				"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String,\n    `version` UInt64\n" +
+				") ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}', '{replica}', `version`)\n" +
+				"ORDER BY (`message`)"},
+		{"replacing with engine", []Option{WithCreateTable("ReplacingMergeTree", ""), WithReplacingVersion("version", nil)},
+			"CREATE TABLE IF NOT EXISTS `logs`.`app` (\n" +
+				"    `event_time` DateTime,\n    `level` LowCardinality(String),\n    `message` String,\n    `version` UInt64\n" +
+				") ENGINE = ReplacingMergeTree\nORDER BY (`event_time`)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := prepareConfig(Config{BatchSize: 1, TableName: "logs.app"}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := createTableQuery(config, config.writtenColumns()); got != tc.want {
+				t.Errorf("createTableQuery() =\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateDistributedQuery(t *testing.T) {
+	for _, tc := range []struct {
+		table string
+		want  string
+	}{
+		{"logs.app", "CREATE TABLE IF NOT EXISTS `logs_all` ON CLUSTER `main` AS `logs`.`app`\n" +
+			"ENGINE = Distributed(`main`, `logs`, `app`, rand())"},
+		{"app", "CREATE TABLE IF NOT EXISTS `logs_all` ON CLUSTER `main` AS `app`\n" +
+			"ENGINE = Distributed(`main`, currentDatabase(), `app`, rand())"},
+	} {
+		config, err := prepareConfig(Config{BatchSize: 1, TableName: tc.table}, []Option{WithCluster("main", "logs_all")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := createDistributedQuery(config); got != tc.want {
+			t.Errorf("createDistributedQuery() for %s =\n%s\nwant\n%s", tc.table, got, tc.want)
+		}
+	}
+}
+
+func TestReplacingVersionColumn(t *testing.T) {
+	at := time.Unix(1700000000, 123)
+	for _, tc := range []struct {
+		name    string
+		version func(entry *logrus.Entry) uint64
+		entry   logrus.Entry
+		want    uint64
+	}{
+		{"entry time", nil, logrus.Entry{Time: at}, 1700000000000000123},
+		{"before 1970", nil, logrus.Entry{Time: time.Unix(-1, 0)}, 0},
+		{"version func", func(entry *logrus.Entry) uint64 { return uint64(len(entry.Message)) }, logrus.Entry{Time: at, Message: "four"}, 4},
+	} {
+		hook := newTestHook(t, WithCreateTable("", "`message`"), WithReplacingVersion("version", tc.version))
+		col := hook.columns[len(hook.columns)-1]
+		if col.name != "version" || col.typ != "UInt64" {
+			t.Fatalf("last column %s %s, want version UInt64", col.name, col.typ)
+		}
+		if got := col.value(&tc.entry); got != tc.want {
+			t.Errorf("%s: version %v, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := prepareConfig(Config{BatchSize: 1}, []Option{WithCreateTable("", ""), WithReplacingVersion("version", nil)}); err == nil {
+		t.Error("no error creating a ReplacingMergeTree without TableOrderBy")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shard is the part of a flush bound for one table, and with
+// PartitionBucket one time bucket; table is "" for the hook's own table.
+// key identifies the shard among those of a flush.
+type shard struct {
+	key     string
+	table   string
+	entries []logrus.Entry
+}
+
+// shards groups entries by target table and PartitionBucket, in order of
+// first appearance. Without ShardKeyField, LevelTableMap, DatabaseField or
+// PartitionBucket everything is one shard for the hook's own table.
+func (hook *ClickHouseHook) shards(entries []logrus.Entry) []shard {
+	if hook.config.ShardKeyField == "" && len(hook.config.LevelTableMap) == 0 && hook.config.DatabaseField == "" &&
+		hook.config.PartitionBucket <= 0 {
+		return []shard{{entries: entries}}
+	}
+
+	var shards []shard
+	index := make(map[string]int)
+	for i := range entries {
+		table := hook.targetTable(&entries[i])
+		key := table
+		if bucket := hook.config.PartitionBucket; bucket > 0 {
+			key += "@" + strconv.FormatInt(hook.eventTime(&entries[i]).Truncate(bucket).Unix(), 10)
+		}
+		n, ok := index[key]
+		if !ok {
+			n = len(shards)
+			index[key] = n
+			shards = append(shards, shard{key: key, table: table})
+		}
+		shards[n].entries = append(shards[n].entries, entries[i])
+	}
+	return shards
+}
+
+// targetTable returns the table for entry: shardTable moved to the
+// database named by its DatabaseField, if any.
+func (hook *ClickHouseHook) targetTable(entry *logrus.Entry) string {
+	table := hook.shardTable(entry)
+	if hook.config.DatabaseField == "" {
+		return table
+	}
+	value, ok := entry.Data[hook.config.DatabaseField]
+	if !ok {
+		return table
+	}
+	database := fmt.Sprint(value)
+	if !namePattern.MatchString(database) {
+		hook.logLimited(hook.log().WithField("database", database), logrus.WarnLevel, nil,
+			"invalid database "+database+", using the default database")
+		return table
+	}
+	if table == "" {
+		table = hook.config.insertTable()
+	}
+	if i := strings.LastIndexByte(table, '.'); i >= 0 {
+		table = table[i+1:]
+	}
+	return database + "." + table
+}
+
+// shardTable returns the table for entry regardless of its database: the
+// one ShardTableFunc picks for its ShardKeyField, else the one
+// LevelTableMap maps its level to, else "" for the hook's own table. Shard
+// names that aren't valid table identifiers are reported and fall back to
+// the hook's own table.
+func (hook *ClickHouseHook) shardTable(entry *logrus.Entry) string {
+	key, ok := entry.Data[hook.config.ShardKeyField]
+	if hook.config.ShardKeyField == "" || !ok {
+		if table := hook.config.LevelTableMap[entry.Level]; table != hook.config.TableName {
+			return table
+		}
+		return ""
+	}
+	table := hook.config.ShardTableFunc(fmt.Sprint(key))
+	if table == "" || table == hook.config.TableName {
+		return ""
+	}
+	if !identifierPattern.MatchString(table) {
+		hook.logLimited(hook.log().WithField("table", table), logrus.WarnLevel, nil,
+			"invalid shard table "+table+", using the default table")
+		return ""
+	}
+	return table
+}
+
+// write inserts entries, as Transform leaves them, into table through the
+// sink, or into the sink's own table when table is "" or the sink can't
+// target other tables, then passes them to the AdditionalSinks.
+func (hook *ClickHouseHook) write(ctx context.Context, table string, entries []logrus.Entry) error {
+	if hook.config.Transform != nil {
+		var err error
+		if entries, err = hook.transform(entries); err != nil || len(entries) == 0 {
+			return err
+		}
+	}
+	if hook.config.DeduplicationToken {
+		ctx = withBatchToken(ctx, entries)
+	}
+	if hook.config.InsertSettingsFunc != nil {
+		ctx = hook.withBatchSettings(ctx, entries)
+	}
+	if err := writeTo(ctx, hook.sink, table, entries); err != nil {
+		return err
+	}
+	return hook.fanOut(ctx, table, entries)
+}
+
+// writeTo writes entries to sink, into table if the sink can target it.
+func writeTo(ctx context.Context, sink Sink, table string, entries []logrus.Entry) error {
+	if ts, ok := sink.(tableSink); ok && table != "" {
+		return ts.WriteTable(ctx, table, entries)
+	}
+	return sink.WriteBatch(ctx, entries)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// InstallSignalHandler closes the hook, flushing buffered entries, when the
+// process receives one of sig (SIGINT and SIGTERM if none are given). It is
+// opt-in and returns a function that uninstalls the handler.
+//
+// The handler listens on its own channel, so handlers the application has
+// installed keep working. Once the hook is closed the signal is raised again
+// with the handler removed: without other handlers the process then
+// terminates as it would have, while application handlers see the signal a
+// second time.
+func (hook *ClickHouseHook) InstallSignalHandler(sig ...os.Signal) (uninstall func()) {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	signals := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	signal.Notify(signals, sig...)
+
+	go func() {
+		select {
+		case s := <-signals:
+			hook.Close()
+			signal.Stop(signals)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(s)
+			}
+		case <-quit:
+			signal.Stop(signals)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sink persists batches of entries for the hook, which takes care of
+// buffering, batching, retries and field handling. WriteBatch must either
+// store the whole batch or return an error, in which case the hook keeps
+// the entries and may retry them. A Sink that also implements io.Closer is
+// closed by the hook's Close.
+//
+// NewClickHouseHook writes through a database/sql sink; NewHookWithSink
+// accepts any other implementation, such as MemorySink.
+type Sink interface {
+	WriteBatch(ctx context.Context, entries []logrus.Entry) error
+}
+
+// tableSink is a Sink that can also insert into a table other than its
+// default one, for sharded flushes.
+type tableSink interface {
+	Sink
+	WriteTable(ctx context.Context, table string, entries []logrus.Entry) error
+}
+
+// pinger is a Sink that can check whether it is reachable.
+type pinger interface {
+	ping(ctx context.Context) error
+}
+
+// columnSink is a Sink that can insert any columns into any table, for
+// writing to the dead letter table.
+type columnSink interface {
+	writeColumns(ctx context.Context, table string, columns []column, entries []logrus.Entry) error
+}
+
+// FlushStrategy selects how the database/sql sink sends a batch.
+type FlushStrategy int
+
+const (
+	// FlushStrategyPrepared prepares the INSERT in a transaction and
+	// executes it once per row, which the driver turns into one native
+	// batch insert.
+	FlushStrategyPrepared FlushStrategy = iota
+	// FlushStrategyMultiValues executes a single INSERT with a VALUES tuple
+	// per row and no transaction: bound parameters with the v2 driver,
+	// literals with v1. A rejected row fails the whole batch, so OnRowError
+	// is not called.
+	FlushStrategyMultiValues
+	// FlushStrategyBatch sends the batch with the driver's native batch
+	// API, PrepareBatch, Append and Send, over a connection of its own per
+	// server that bypasses database/sql and its transaction. It is only
+	// available with the v2 driver. A row rejected by Append is reported to
+	// OnRowError as with FlushStrategyPrepared.
+	FlushStrategyBatch
+)
+
+// batchConn is a driver's native batch insert API, for FlushStrategyBatch.
+// send prepares query, appends the n rows returned by row and sends them
+// as one block. Like tryInsert it returns the index of a row the driver
+// rejected, or -1.
+type batchConn interface {
+	send(ctx context.Context, query string, n int, row func(i int) []interface{}) (int, error)
+	Close() error
+}
+
+// sqlSink inserts batches into ClickHouse through database/sql, failing over
+// between nodes on connection errors.
+type sqlSink struct {
+	nodes      []*node
+	table      string
+	columns    []column
+	settings   string
+	query      string
+	onRowError func(entry logrus.Entry, err error)
+	strategy   FlushStrategy
+
+	// args, when set, replaces the columns' values as the arguments of
+	// every row, for CustomInsert.
+	args func(entry *logrus.Entry) []interface{}
+}
+
+func newSQLSink(nodes []*node, table string, columns []column, settings string, onRowError func(logrus.Entry, error), strategy FlushStrategy) *sqlSink {
+	return &sqlSink{
+		nodes:      nodes,
+		table:      table,
+		columns:    columns,
+		settings:   settings,
+		query:      insertQuery(table, columns, settings),
+		onRowError: onRowError,
+		strategy:   strategy,
+	}
+}
+
+// WriteBatch writes entries to the first healthy node, failing over to the
+// next one on connection errors.
+func (s *sqlSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	if hasBatchSettings(ctx) {
+		return s.writeColumns(ctx, s.table, s.columns, entries)
+	}
+	return s.write(ctx, s.query, s.columns, entries)
+}
+
+// WriteTable is WriteBatch for table instead of the sink's own table.
+func (s *sqlSink) WriteTable(ctx context.Context, table string, entries []logrus.Entry) error {
+	return s.writeColumns(ctx, table, s.columns, entries)
+}
+
+// writeColumns is WriteBatch for columns of table.
+func (s *sqlSink) writeColumns(ctx context.Context, table string, columns []column, entries []logrus.Entry) error {
+	return s.write(ctx, insertQuery(table, columns, batchSettings(ctx, s.settings)), columns, entries)
+}
+
+// write runs query for entries, trying each candidate node in turn.
+func (s *sqlSink) write(ctx context.Context, query string, columns []column, entries []logrus.Entry) error {
+	var err error
+	for _, n := range candidates(s.nodes) {
+		err = n.withConns(func(db *sql.DB, batch batchConn) error {
+			return s.insertInto(ctx, db, batch, query, columns, entries)
+		})
+		if err == nil || !isConnectionError(err) {
+			n.markHealthy()
+			return err
+		}
+		n.markFailed()
+	}
+	return err
+}
+
+// insertInto runs query for entries on db in a single transaction, or on
+// batch when the node has a native batch connection. When onRowError is
+// set, a row rejected by the driver is reported and the insert is redone
+// without it.
+//
+// A connection error may only mean that the pooled connection went stale,
+// typically because the server restarted. db is then pinged, which makes
+// the pool discard the broken connection and dial a fresh one, and the
+// insert is retried once on it, with only the rows not reported yet,
+// before write moves on to the next node.
+func (s *sqlSink) insertInto(ctx context.Context, db *sql.DB, batch batchConn, query string, columns []column, entries []logrus.Entry) error {
+	reconnected := false
+	for {
+		bad, err := s.try(ctx, db, batch, query, columns, entries)
+		if err != nil && !reconnected && isConnectionError(err) && db.PingContext(ctx) == nil {
+			reconnected = true
+			continue
+		}
+		if err == nil || bad < 0 || s.onRowError == nil {
+			return err
+		}
+		s.onRowError(entries[bad], errors.Unwrap(err))
+
+		rest := make([]logrus.Entry, 0, len(entries)-1)
+		rest = append(rest, entries[:bad]...)
+		entries = append(rest, entries[bad+1:]...)
+		if len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// try makes one insert of entries with the sink's strategy, returning the
+// index of a rejected row as tryInsert does.
+func (s *sqlSink) try(ctx context.Context, db *sql.DB, batch batchConn, query string, columns []column, entries []logrus.Entry) (int, error) {
+	switch {
+	case s.strategy == FlushStrategyMultiValues:
+		return -1, s.insertValues(ctx, db, query, columns, entries)
+	case batch != nil:
+		return s.trySend(ctx, batch, query, columns, entries)
+	}
+	return s.tryInsert(ctx, db, query, columns, entries)
+}
+
+// tryInsert writes entries to db in a single transaction. If a row is
+// rejected, its index is returned along with the error; otherwise the index
+// is -1.
+//
+// Both drivers turn a prepared INSERT inside a transaction into a native
+// batch: each Exec appends the row to an in-memory column block that
+// Commit sends. The statement is tied to its transaction, so it is
+// prepared for every batch.
+func (s *sqlSink) tryInsert(ctx context.Context, db *sql.DB, query string, columns []column, entries []logrus.Entry) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, &FlushError{Stage: StageBegin, Err: err}
+	}
+	// Also releases the connection when a column value panics; it is a
+	// no-op after Commit.
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return -1, &FlushError{Stage: StagePrepare, Err: err}
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, len(columns))
+	for i := range entries {
+		if _, err := stmt.ExecContext(ctx, s.row(&entries[i], columns, args)...); err != nil {
+			if isConnectionError(err) {
+				return -1, &FlushError{Stage: StageExec, Err: err}
+			}
+			return i, &FlushError{Stage: StageExec, Err: err}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, &FlushError{Stage: StageCommit, Err: err}
+	}
+	return -1, nil
+}
+
+// trySend is tryInsert over the native batch connection batch.
+func (s *sqlSink) trySend(ctx context.Context, batch batchConn, query string, columns []column, entries []logrus.Entry) (int, error) {
+	args := make([]interface{}, len(columns))
+	return batch.send(ctx, query, len(entries), func(i int) []interface{} {
+		return s.row(&entries[i], columns, args)
+	})
+}
+
+// row returns the arguments of entry: those of the args function when set,
+// else the values of columns, filled into args.
+func (s *sqlSink) row(entry *logrus.Entry, columns []column, args []interface{}) []interface{} {
+	if s.args != nil {
+		return s.args(entry)
+	}
+	for j, col := range columns {
+		args[j] = col.value(entry)
+	}
+	return args
+}
+
+// insertValues writes entries to db as one INSERT with a VALUES tuple per
+// row, built by the driver's multiValuesQuery.
+func (s *sqlSink) insertValues(ctx context.Context, db *sql.DB, query string, columns []column, entries []logrus.Entry) error {
+	query, args, err := multiValuesQuery(query, columns, entries)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, query, args...); err != nil {
+		return &FlushError{Stage: StageExec, Err: err}
+	}
+	return nil
+}
+
+// ping succeeds if any node answers, failing over like WriteBatch.
+func (s *sqlSink) ping(ctx context.Context) error {
+	var err error
+	for _, n := range candidates(s.nodes) {
+		if err = n.withDB(func(db *sql.DB) error { return db.PingContext(ctx) }); err == nil {
+			n.markHealthy()
+			return nil
+		}
+		n.markFailed()
+	}
+	return err
+}
+
+// Close closes the connection pools of every node.
+func (s *sqlSink) Close() error {
+	return closeNodes(s.nodes)
+}
+
+// MemorySink keeps flushed entries in memory instead of writing them to
+// ClickHouse, so code using the hook can be tested without a database.
+type MemorySink struct {
+	mu      sync.Mutex
+	entries []logrus.Entry
+	batches int
+	err     error
+}
+
+// WriteBatch records entries, or fails with the error set by SetError.
+func (m *MemorySink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.entries = append(m.entries, entries...)
+	m.batches++
+	return nil
+}
+
+// Entries returns a copy of every entry flushed so far, in flush order.
+func (m *MemorySink) Entries() []logrus.Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]logrus.Entry(nil), m.entries...)
+}
+
+// Batches returns the number of batches flushed so far.
+func (m *MemorySink) Batches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.batches
+}
+
+// SetError makes subsequent writes fail with err, or succeed again if err is
+// nil, to exercise the hook's failure handling.
+func (m *MemorySink) SetError(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+// NewHookWithSink builds a hook that flushes into sink rather than a
+// ClickHouse connection of its own. Options that only concern the database,
+// such as table creation or pool settings, are ignored.
+func NewHookWithSink(sink Sink, batchSize int, opts ...Option) (*ClickHouseHook, error) {
+	config, err := prepareConfig(Config{BatchSize: batchSize}, opts)
+	if err != nil {
+		return nil, err
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		return nil, err
+	}
+	hook.sink = sink
+	if err := hook.start(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// NewMemoryHook builds a hook that flushes into sink rather than ClickHouse.
+func NewMemoryHook(sink *MemorySink, batchSize int, opts ...Option) (*ClickHouseHook, error) {
+	return NewHookWithSink(sink, batchSize, opts...)
+}
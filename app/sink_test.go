@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// discardSink accepts every batch and keeps nothing, so benchmarks measure
+// the hook rather than a growing MemorySink.
+type discardSink struct{}
+
+func (discardSink) WriteBatch(ctx context.Context, entries []logrus.Entry) error { return nil }
+
+// fakeBatch is a batchConn that rejects rows whose message is "bad" and
+// records the messages of every batch it sends. Its dropCall-th send, when
+// set, fails with a connection error.
+type fakeBatch struct {
+	sent     [][]string
+	calls    int
+	dropCall int
+}
+
+func (f *fakeBatch) send(ctx context.Context, query string, n int, row func(i int) []interface{}) (int, error) {
+	f.calls++
+	if f.calls == f.dropCall {
+		return -1, &FlushError{Stage: StagePrepare, Err: io.EOF}
+	}
+	var messages []string
+	for i := 0; i < n; i++ {
+		args := row(i)
+		message := args[2].(string)
+		if message == "bad" {
+			return i, &FlushError{Stage: StageExec, Err: errors.New("type mismatch")}
+		}
+		messages = append(messages, message)
+	}
+	f.sent = append(f.sent, messages)
+	return -1, nil
+}
+
+func (f *fakeBatch) Close() error { return nil }
+
+func TestSQLSinkNativeBatch(t *testing.T) {
+	config, err := prepareConfig(Config{BatchSize: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected []string
+	onRowError := func(entry logrus.Entry, err error) { rejected = append(rejected, entry.Message) }
+	batch := &fakeBatch{}
+	sink := newSQLSink([]*node{{batch: batch}}, "logs", hook.columns, "", onRowError, FlushStrategyBatch)
+
+	entries := []logrus.Entry{{Message: "one"}, {Message: "bad"}, {Message: "two"}}
+	if err := sink.WriteBatch(context.Background(), entries); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if len(batch.sent) != 1 || fmt.Sprint(batch.sent[0]) != "[one two]" {
+		t.Errorf("sent %v, want one batch [one two]", batch.sent)
+	}
+	if fmt.Sprint(rejected) != "[bad]" {
+		t.Errorf("OnRowError got %v, want [bad]", rejected)
+	}
+}
+
+func TestSQLSinkReconnectKeepsReportedRowsOut(t *testing.T) {
+	config, err := prepareConfig(Config{BatchSize: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(&countingConnector{})
+	defer db.Close()
+	var rejected []string
+	onRowError := func(entry logrus.Entry, err error) { rejected = append(rejected, entry.Message) }
+	// The first send rejects "bad", the retry without it hits a stale
+	// connection.
+	batch := &fakeBatch{dropCall: 2}
+	sink := newSQLSink([]*node{{db: db, batch: batch}}, "logs", hook.columns, "", onRowError, FlushStrategyBatch)
+
+	entries := []logrus.Entry{{Message: "one"}, {Message: "bad"}, {Message: "two"}}
+	if err := sink.WriteBatch(context.Background(), entries); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if fmt.Sprint(rejected) != "[bad]" {
+		t.Errorf("OnRowError got %v, want [bad] once", rejected)
+	}
+	if len(batch.sent) != 1 || fmt.Sprint(batch.sent[0]) != "[one two]" {
+		t.Errorf("sent %v, want one batch [one two]", batch.sent)
+	}
+}
+
+// countingConnector is a database/sql driver that accepts every statement
+// and counts prepares, executions and commits.
+type countingConnector struct {
+	prepares, execs, commits atomic.Int64
+	query                    atomic.Value
+}
+
+func (c *countingConnector) Connect(context.Context) (driver.Conn, error) {
+	return countingConn{c}, nil
+}
+func (c *countingConnector) Driver() driver.Driver { return nil }
+
+type countingConn struct{ c *countingConnector }
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	c.c.prepares.Add(1)
+	c.c.query.Store(query)
+	return countingStmt(c), nil
+}
+func (c countingConn) Close() error                             { return nil }
+func (c countingConn) Begin() (driver.Tx, error)                { return countingTx(c), nil }
+func (c countingConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type countingStmt struct{ c *countingConnector }
+
+func (s countingStmt) Close() error  { return nil }
+func (s countingStmt) NumInput() int { return -1 }
+func (s countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.execs.Add(1)
+	return driver.RowsAffected(1), nil
+}
+func (s countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+type countingTx struct{ c *countingConnector }
+
+func (t countingTx) Commit() error   { t.c.commits.Add(1); return nil }
+func (t countingTx) Rollback() error { return nil }
+
+// countingSQLSink returns a sink over a countingConnector.
+func countingSQLSink(tb testing.TB, strategy FlushStrategy) (*sqlSink, *countingConnector) {
+	config, err := prepareConfig(Config{BatchSize: 10}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hook, err := newHook(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	connector := &countingConnector{}
+	db := sql.OpenDB(connector)
+	tb.Cleanup(func() { db.Close() })
+	return newSQLSink([]*node{{db: db}}, "logs", hook.columns, "", nil, strategy), connector
+}
+
+func testBatch(rows int) []logrus.Entry {
+	entries := make([]logrus.Entry, rows)
+	for i := range entries {
+		entries[i] = logrus.Entry{Level: logrus.InfoLevel, Message: fmt.Sprintf("request %d served", i)}
+	}
+	return entries
+}
+
+func TestSQLSinkPreparesOncePerBatch(t *testing.T) {
+	sink, connector := countingSQLSink(t, FlushStrategyPrepared)
+	for i := 0; i < 2; i++ {
+		if err := sink.WriteBatch(context.Background(), testBatch(1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := connector.prepares.Load(); got != 2 {
+		t.Errorf("%d prepares for 2 batches, want 2", got)
+	}
+	if got := connector.execs.Load(); got != 2000 {
+		t.Errorf("%d executions for 2000 rows, want 2000", got)
+	}
+	if got := connector.commits.Load(); got != 2 {
+		t.Errorf("%d commits for 2 batches, want 2", got)
+	}
+}
+
+// BenchmarkPreparedInsert reports how many statements a prepared insert of
+// 1k, 10k and 100k rows prepares: one per batch, whatever its size.
+func BenchmarkPreparedInsert(b *testing.B) {
+	for _, rows := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			sink, connector := countingSQLSink(b, FlushStrategyPrepared)
+			entries := testBatch(rows)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sink.WriteBatch(context.Background(), entries); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(connector.prepares.Load())/float64(b.N), "prepares/op")
+		})
+	}
+}
+
+// BenchmarkRowBinaryEncode measures encoding 1k, 10k and 100k rows of the
+// default columns as the RowBinary body of an HTTP insert.
+func BenchmarkRowBinaryEncode(b *testing.B) {
+	columns := newTestHook(b).columns
+	encoders, err := rowBinaryEncoders(columns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, rows := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			entries := testBatch(rows)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := encodeRowBinary(columns, encoders, entries); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func TestSQLSinkMultiValues(t *testing.T) {
+	sink, connector := countingSQLSink(t, FlushStrategyMultiValues)
+	if err := sink.WriteBatch(context.Background(), testBatch(3)); err != nil {
+		t.Fatal(err)
+	}
+	if got := connector.execs.Load(); got != 1 {
+		t.Errorf("%d executions for a batch, want 1", got)
+	}
+	if got := connector.commits.Load(); got != 0 {
+		t.Errorf("%d commits, want none outside a transaction", got)
+	}
+	query := connector.query.Load().(string)
+	if !strings.Contains(query, "INSERT INTO `logs` (") || strings.Count(query, "), (") != 2 {
+		t.Errorf("query %q doesn't insert 3 tuples", query)
+	}
+}
+
+// BenchmarkMultiValuesInsert measures building and running the single
+// INSERT of FlushStrategyMultiValues for 1k, 10k and 100k rows against a
+// database/sql driver that discards it.
+func BenchmarkMultiValuesInsert(b *testing.B) {
+	for _, rows := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			sink, _ := countingSQLSink(b, FlushStrategyMultiValues)
+			entries := testBatch(rows)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sink.WriteBatch(context.Background(), entries); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// BenchmarkFlush measures flushing batches of 1k, 10k and 100k rows: into a
+// discarding sink, for the hook's own cost, and with every FlushStrategy
+// into the server at CLICKHOUSE_DSN, when set.
+func BenchmarkFlush(b *testing.B) {
+	dsn := os.Getenv("CLICKHOUSE_DSN")
+	strategies := []struct {
+		name      string
+		strategy  FlushStrategy
+		supported bool
+	}{
+		{"prepared", FlushStrategyPrepared, true},
+		{"batch", FlushStrategyBatch, supportsNativeBatch},
+		{"multi-values", FlushStrategyMultiValues, true},
+	}
+	for _, rows := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("sink=discard/rows=%d", rows), func(b *testing.B) {
+			hook, err := NewHookWithSink(discardSink{}, rows+1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer hook.Close()
+			benchmarkFlush(b, hook, rows)
+		})
+		for _, s := range strategies {
+			b.Run(fmt.Sprintf("strategy=%s/rows=%d", s.name, rows), func(b *testing.B) {
+				if dsn == "" {
+					b.Skip("CLICKHOUSE_DSN not set")
+				}
+				if !s.supported {
+					b.Skip("not supported by this driver")
+				}
+				hook, err := NewClickHouseHook(dsn, rows+1, WithTableName("logrus_bench"), WithCreateTable("", ""),
+					WithFlushStrategy(s.strategy), WithFields())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer hook.Close()
+				benchmarkFlush(b, hook, rows)
+			})
+		}
+	}
+}
+
+// BenchmarkCompression compares batches of 1k, 10k and 100k rows with
+// and without LZ4: the bytes per row of the RowBinary encoding of the
+// columns, raw and compressed as a block, and, when CLICKHOUSE_DSN is set,
+// flushes into that server with WithCompression on and off.
+func BenchmarkCompression(b *testing.B) {
+	dsn := os.Getenv("CLICKHOUSE_DSN")
+	hook := newTestHook(b, WithFields())
+	encoders, err := rowBinaryEncoders(hook.columns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, rows := range []int{1000, 10000, 100000} {
+		entries := make([]logrus.Entry, rows)
+		for i := range entries {
+			entries[i] = logrus.Entry{
+				Time:    time.Unix(1700000000, int64(i)*int64(time.Millisecond)),
+				Level:   logrus.InfoLevel,
+				Message: fmt.Sprintf("request %d served", i),
+				Data:    logrus.Fields{"status": 200, "path": "/api/items"},
+			}
+		}
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("payload/compress=%t/rows=%d", compress, rows), func(b *testing.B) {
+				var compressor lz4.Compressor
+				var size int
+				for i := 0; i < b.N; i++ {
+					body, err := encodeRowBinary(hook.columns, encoders, entries)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = body.Len()
+					if compress {
+						block := make([]byte, lz4.CompressBlockBound(body.Len()))
+						if size, err = compressor.CompressBlock(body.Bytes(), block); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.ReportMetric(float64(size)/float64(rows), "bytes/row")
+			})
+		}
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("server/compress=%t/rows=%d", compress, rows), func(b *testing.B) {
+				if dsn == "" {
+					b.Skip("CLICKHOUSE_DSN not set")
+				}
+				hook, err := NewClickHouseHook(dsn, rows+1, WithTableName("logrus_bench"), WithCreateTable("", ""),
+					WithFields(), WithCompression(compress))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer hook.Close()
+				benchmarkFlush(b, hook, rows)
+			})
+		}
+	}
+}
+
+// benchmarkFlush buffers rows entries and flushes them, b.N times, timing
+// only the flushes.
+func benchmarkFlush(b *testing.B, hook *ClickHouseHook, rows int) {
+	entries := make([]*logrus.Entry, rows)
+	for i := range entries {
+		entries[i] = &logrus.Entry{
+			Level:   logrus.InfoLevel,
+			Message: fmt.Sprintf("request %d served", i),
+			Data:    logrus.Fields{"status": 200, "path": "/api/items"},
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, entry := range entries {
+			hook.Fire(entry)
+		}
+		b.StartTimer()
+		if err := hook.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of the hook's health, for debug
+// endpoints that don't warrant the Prometheus metrics.
+type Stats struct {
+	// Buffered is the number of entries waiting to be flushed.
+	Buffered int
+	// TotalEntries is the number of entries buffered since the hook was
+	// created, filtered and sampled out ones excluded.
+	TotalEntries uint64
+	// TotalFlushed is the number of entries inserted since the hook was created.
+	TotalFlushed uint64
+	// Batches is the number of batches inserted since the hook was created.
+	Batches uint64
+	// FlushErrors is the number of flushes that failed after all retries.
+	FlushErrors uint64
+	// FailedGroups is the number of inserts into one table, database or
+	// partition bucket of a flush that failed, so a flush where two of
+	// three groups failed counts two. Without routing every flush is one
+	// group.
+	FailedGroups uint64
+	// DroppedEntries is the number of entries discarded because the buffer
+	// was full.
+	DroppedEntries uint64
+	// SampledOut is the number of entries discarded by SampleRate.
+	SampledOut uint64
+	// Filtered is the number of entries skipped by Filter.
+	Filtered uint64
+	// Panics is the number of panics Fire, a flush or a group insert
+	// recovered from.
+	Panics uint64
+	// InFlightBatches is the number of flushes running.
+	InFlightBatches int
+	// FlushLatencyP50, P95 and P99 are percentiles of the time taken by
+	// the last latencySamples batch inserts, or zero before the first.
+	FlushLatencyP50 time.Duration
+	FlushLatencyP95 time.Duration
+	FlushLatencyP99 time.Duration
+	// LastError is the most recent flush error, or nil if none has failed.
+	LastError error
+	// Breaker is the state of the circuit breaker, always BreakerClosed
+	// without one.
+	Breaker BreakerState
+	// CompressionBytesIn and CompressionBytesOut are the bytes of entries
+	// CompressThreshold compressed in memory, before and after compression,
+	// and CompressionRatio the former divided by the latter, or zero
+	// before anything was compressed.
+	CompressionBytesIn  uint64
+	CompressionBytesOut uint64
+	CompressionRatio    float64
+	// AdditionalSinkErrors counts the failed writes of each of the
+	// AdditionalSinks, in order.
+	AdditionalSinkErrors []uint64
+}
+
+// latencySamples is how many insert durations latencyRing keeps.
+const latencySamples = 1024
+
+// latencyRing keeps the most recent insert durations for Stats.
+type latencyRing struct {
+	samples [latencySamples]time.Duration
+	n       int
+	next    int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencySamples
+	if r.n < latencySamples {
+		r.n++
+	}
+}
+
+// snapshot returns a copy of the kept durations.
+func (r *latencyRing) snapshot() []time.Duration {
+	return slices.Clone(r.samples[:r.n])
+}
+
+// percentile returns the p-th percentile, 0 < p <= 100, of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i, 1)-1]
+}
+
+// Stats returns a consistent snapshot of the hook's counters.
+func (hook *ClickHouseHook) Stats() Stats {
+	hook.mu.Lock()
+	latencies := hook.latencies.snapshot()
+	stats := Stats{
+		Buffered:        len(hook.entries) + len(hook.held) + hook.packedCount,
+		TotalEntries:    hook.accepted,
+		TotalFlushed:    hook.flushed,
+		Batches:         hook.batches,
+		FlushErrors:     hook.failures,
+		FailedGroups:    hook.groupErrs,
+		DroppedEntries:  hook.dropped,
+		SampledOut:      hook.sampled,
+		Filtered:        hook.filtered,
+		Panics:          hook.panics,
+		InFlightBatches: int(hook.inFlight.Load()),
+		LastError:       hook.lastError,
+
+		CompressionBytesIn:  hook.compressionIn,
+		CompressionBytesOut: hook.compressionOut,
+		CompressionRatio:    compressionRatio(hook.compressionIn, hook.compressionOut),
+
+		AdditionalSinkErrors: slices.Clone(hook.sinkErrors),
+	}
+	hook.mu.Unlock()
+
+	if hook.breaker != nil {
+		stats.Breaker = hook.breaker.current()
+	}
+	slices.Sort(latencies)
+	stats.FlushLatencyP50 = percentile(latencies, 50)
+	stats.FlushLatencyP95 = percentile(latencies, 95)
+	stats.FlushLatencyP99 = percentile(latencies, 99)
+	return stats
+}
+
+// statsJSON is the body StatsHandler serves, with durations in
+// milliseconds.
+type statsJSON struct {
+	Buffered          int     `json:"buffered"`
+	TotalEntries      uint64  `json:"total_entries"`
+	TotalFlushed      uint64  `json:"total_flushed"`
+	Batches           uint64  `json:"batches"`
+	FlushErrors       uint64  `json:"flush_errors"`
+	FailedGroups      uint64  `json:"failed_groups"`
+	DroppedEntries    uint64  `json:"dropped_entries"`
+	SampledOut        uint64  `json:"sampled_out"`
+	Filtered          uint64  `json:"filtered"`
+	Panics            uint64  `json:"panics"`
+	InFlightBatches   int     `json:"in_flight_batches"`
+	FlushLatencyP50Ms float64 `json:"flush_latency_p50_ms"`
+	FlushLatencyP95Ms float64 `json:"flush_latency_p95_ms"`
+	FlushLatencyP99Ms float64 `json:"flush_latency_p99_ms"`
+	LastError         string  `json:"last_error,omitempty"`
+	Breaker           string  `json:"breaker"`
+
+	CompressionBytesIn  uint64  `json:"compression_bytes_in"`
+	CompressionBytesOut uint64  `json:"compression_bytes_out"`
+	CompressionRatio    float64 `json:"compression_ratio"`
+
+	AdditionalSinkErrors []uint64 `json:"additional_sink_errors,omitempty"`
+}
+
+// StatsHandler serves Stats as a JSON object, for mounting at a debug path
+// such as /debug/clickhouse-hook.
+func (hook *ClickHouseHook) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := hook.Stats()
+		body := statsJSON{
+			Buffered:          stats.Buffered,
+			TotalEntries:      stats.TotalEntries,
+			TotalFlushed:      stats.TotalFlushed,
+			Batches:           stats.Batches,
+			FlushErrors:       stats.FlushErrors,
+			FailedGroups:      stats.FailedGroups,
+			DroppedEntries:    stats.DroppedEntries,
+			SampledOut:        stats.SampledOut,
+			Filtered:          stats.Filtered,
+			Panics:            stats.Panics,
+			InFlightBatches:   stats.InFlightBatches,
+			FlushLatencyP50Ms: milliseconds(stats.FlushLatencyP50),
+			FlushLatencyP95Ms: milliseconds(stats.FlushLatencyP95),
+			FlushLatencyP99Ms: milliseconds(stats.FlushLatencyP99),
+			Breaker:           stats.Breaker.String(),
+
+			CompressionBytesIn:  stats.CompressionBytesIn,
+			CompressionBytesOut: stats.CompressionBytesOut,
+			CompressionRatio:    stats.CompressionRatio,
+
+			AdditionalSinkErrors: stats.AdditionalSinkErrors,
+		}
+		if stats.LastError != nil {
+			body.LastError = stats.LastError.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// milliseconds returns d in fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Ping checks that ClickHouse is reachable, for readiness probes. Sinks
+// passed to NewHookWithSink are always considered reachable. After Close it
+// returns ErrNotConnected.
+func (hook *ClickHouseHook) Ping(ctx context.Context) error {
+	if hook.sink == nil || hook.closed.Load() {
+		return ErrNotConnected
+	}
+	if p, ok := hook.sink.(pinger); ok {
+		return p.ping(ctx)
+	}
+	return nil
+}
+
+// BufferPressure returns how full the hook's bounded buffer is, from 0 to 1:
+// the async queue in async mode, otherwise the buffer relative to
+// MaxBufferSize. It is 0 when the buffer is unbounded.
+func (hook *ClickHouseHook) BufferPressure() float64 {
+	if hook.queue != nil {
+		return float64(len(hook.queue)) / float64(cap(hook.queue))
+	}
+	if hook.config.MaxBufferSize <= 0 {
+		return 0
+	}
+	hook.mu.Lock()
+	n := len(hook.entries) + hook.packedCount
+	hook.mu.Unlock()
+	return min(float64(n)/float64(hook.config.MaxBufferSize), 1)
+}
+
+// checkPressure calls OnBackpressure when BufferPressure crosses
+// BackpressureThreshold on the way up.
+func (hook *ClickHouseHook) checkPressure() {
+	ratio := hook.BufferPressure()
+	high := ratio >= hook.config.BackpressureThreshold
+	if hook.pressured.Swap(high) != high && high {
+		hook.config.OnBackpressure(ratio)
+	}
+}
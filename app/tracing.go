@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the hook's spans.
+const tracerName = "github.com/rasif/clickhouse-spaces-tutorial"
+
+// tracedInsert is insertWithRetry inside a clickhouse.flush span recording
+// the batch size, the table, the time taken, retries included, and the
+// error of a failed insert.
+func (hook *ClickHouseHook) tracedInsert(ctx context.Context, table string, entries []logrus.Entry) error {
+	name := table
+	if name == "" {
+		name = hook.config.insertTable()
+	}
+	ctx, span := hook.tracer.Start(ctx, "clickhouse.flush", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int("clickhouse.batch_size", len(entries)),
+			attribute.String("clickhouse.table", name),
+		))
+	defer span.End()
+
+	start := hook.config.Clock.Now()
+	err := hook.insertWithRetry(ctx, table, entries)
+	span.SetAttributes(attribute.Float64("clickhouse.duration_ms",
+		float64(hook.config.Clock.Now().Sub(start))/float64(time.Millisecond)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/sirupsen/logrus"
+)
+
+// transform runs Transform over a copy of entries, their Data maps copied
+// too. A panic in it is returned as a StageTransform FlushError.
+func (hook *ClickHouseHook) transform(entries []logrus.Entry) (transformed []logrus.Entry, err error) {
+	batch := make([]logrus.Entry, len(entries))
+	for i, entry := range entries {
+		entry.Data = maps.Clone(entry.Data)
+		batch[i] = entry
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			transformed, err = nil, &FlushError{Stage: StageTransform, Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	return hook.config.Transform(batch), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tuneBatchSizes are the batch sizes TuneBatchSize tries.
+var tuneBatchSizes = []int{100, 500, 1000, 5000, 10000}
+
+// tuneRounds is how many batches of each size TuneBatchSize inserts.
+const tuneRounds = 3
+
+// TuneBatchSize inserts batches of a few sizes, built by repeating
+// sampleEntries, and returns the size with the best entries per second. It
+// is a tuning aid to run by hand before picking BatchSize, not something
+// the hook does on its own.
+//
+// The rows go to a scratch MergeTree table with the hook's columns, next to
+// the configured one and on the connected server only, which is dropped
+// again before returning, even if ctx ends first. Only hooks connected
+// through the native protocol can be tuned.
+func (hook *ClickHouseHook) TuneBatchSize(ctx context.Context, sampleEntries []logrus.Entry) (int, error) {
+	if hook.primary == nil {
+		return 0, errors.New("clickhouse hook: batch size tuning needs a native protocol connection")
+	}
+	if hook.config.CustomInsert != "" {
+		return 0, errors.New("clickhouse hook: batch size tuning needs the built-in columns")
+	}
+	if len(sampleEntries) == 0 {
+		return 0, errors.New("clickhouse hook: batch size tuning needs sample entries")
+	}
+
+	var best int
+	err := hook.primary.withDB(func(db *sql.DB) error {
+		var err error
+		best, err = hook.tune(ctx, db, sampleEntries)
+		return err
+	})
+	return best, err
+}
+
+// tune is TuneBatchSize on db.
+func (hook *ClickHouseHook) tune(ctx context.Context, db *sql.DB, sampleEntries []logrus.Entry) (int, error) {
+	config := hook.currentConfig()
+	config.TableName = fmt.Sprintf("%s_tune_%d", config.TableName, time.Now().UnixNano())
+	config.TableEngine = defaultEngine
+	config.ClusterName = ""
+	config.TableTTL = ""
+	if err := createTable(ctx, db, config, hook.columns); err != nil {
+		return 0, err
+	}
+	defer db.ExecContext(context.WithoutCancel(ctx), "DROP TABLE IF EXISTS "+quoteTable(config.TableName))
+
+	sink := newSQLSink([]*node{{db: db}}, config.TableName, hook.columns, settingsClause(config.QuerySettings), nil, config.FlushStrategy)
+	return hook.tuneSink(ctx, sink, sampleEntries)
+}
+
+// tuneSink times tuneRounds batches of each of tuneBatchSizes written to
+// sink, by Clock, and returns the size with the best entries per second.
+func (hook *ClickHouseHook) tuneSink(ctx context.Context, sink Sink, sampleEntries []logrus.Entry) (int, error) {
+	best, bestRate := 0, 0.0
+	for _, size := range tuneBatchSizes {
+		batch := make([]logrus.Entry, size)
+		for i := range batch {
+			batch[i] = sampleEntries[i%len(sampleEntries)]
+		}
+
+		start := hook.config.Clock.Now()
+		for round := 0; round < tuneRounds; round++ {
+			if err := sink.WriteBatch(ctx, batch); err != nil {
+				return 0, fmt.Errorf("clickhouse hook: tuning batch size %d: %w", size, err)
+			}
+		}
+		rate := float64(size*tuneRounds) / hook.config.Clock.Now().Sub(start).Seconds()
+		hook.log().WithFields(logrus.Fields{"batch_size": size, "entries_per_second": rate}).Debug("tuned batch size")
+		if rate > bestRate {
+			best, bestRate = size, rate
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// latencySink takes, by its clock, the time latency gives for a batch of
+// each size, or fails with err.
+type latencySink struct {
+	clock   *FakeClock
+	latency map[int]time.Duration
+	err     error
+	sizes   []int
+}
+
+func (s *latencySink) WriteBatch(ctx context.Context, entries []logrus.Entry) error {
+	s.sizes = append(s.sizes, len(entries))
+	s.clock.Advance(s.latency[len(entries)])
+	return s.err
+}
+
+func TestTuneBatchSize(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	hook := newTestHook(t, WithClock(clock))
+	// Throughput peaks at 1000 entries a batch, 40k a second, and falls
+	// off once batches get large enough to stall the server.
+	sink := &latencySink{clock: clock, latency: map[int]time.Duration{
+		100:   10 * time.Millisecond,
+		500:   20 * time.Millisecond,
+		1000:  25 * time.Millisecond,
+		5000:  250 * time.Millisecond,
+		10000: time.Second,
+	}}
+	samples := []logrus.Entry{{Message: "a"}, {Message: "b"}}
+	best, err := hook.tuneSink(context.Background(), sink, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best != 1000 {
+		t.Errorf("tuned batch size %d, want 1000", best)
+	}
+	if len(sink.sizes) != len(tuneBatchSizes)*tuneRounds {
+		t.Errorf("wrote batches of %v, want %d of each of %v", sink.sizes, tuneRounds, tuneBatchSizes)
+	}
+
+	sink = &latencySink{clock: clock, err: errors.New("server down")}
+	if _, err := hook.tuneSink(context.Background(), sink, samples); err == nil || !strings.Contains(err.Error(), "batch size 100") {
+		t.Errorf("tuneSink returned %v, want an error naming batch size 100", err)
+	}
+}
+
+func TestTuneBatchSizeNeedsNativeConnection(t *testing.T) {
+	hook, err := NewMemoryHook(&MemorySink{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Stop()
+	if _, err := hook.TuneBatchSize(context.Background(), []logrus.Entry{{Message: "a"}}); err == nil {
+		t.Error("TuneBatchSize without a native connection returned nil")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigError lists every problem Validate found in a Config.
+type ConfigError struct {
+	Problems []error
+}
+
+func (e *ConfigError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.Error()
+	}
+	return "clickhouse hook: invalid configuration: " + strings.Join(problems, "; ")
+}
+
+func (e *ConfigError) Unwrap() []error {
+	return e.Problems
+}
+
+// Validate checks config for invalid values and options that can't be
+// combined, returning a *ConfigError listing all of them, or nil. Zero
+// values stand for the defaults and are valid, except for BatchSize. The
+// constructors call it after applying their options, so a misconfigured
+// hook fails to start rather than at its first flush.
+func (config Config) Validate() error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if config.BatchSize <= 0 {
+		problem("batch size %d isn't positive", config.BatchSize)
+	}
+	if config.TableName != "" && !identifierPattern.MatchString(config.TableName) {
+		problem("invalid table name %q", config.TableName)
+	}
+	if config.ClusterName != "" && !namePattern.MatchString(config.ClusterName) {
+		problem("invalid cluster name %q", config.ClusterName)
+	}
+	if config.DistributedTable != "" {
+		if config.ClusterName == "" {
+			problem("DistributedTable requires ClusterName")
+		}
+		if !identifierPattern.MatchString(config.DistributedTable) {
+			problem("invalid distributed table name %q", config.DistributedTable)
+		}
+	}
+	if config.DeadLetterTable != "" && !identifierPattern.MatchString(config.DeadLetterTable) {
+		problem("invalid dead letter table name %q", config.DeadLetterTable)
+	}
+	if config.DynamicConfigTable != "" && !identifierPattern.MatchString(config.DynamicConfigTable) {
+		problem("invalid dynamic config table name %q", config.DynamicConfigTable)
+	}
+	for _, level := range slices.Sorted(maps.Keys(config.LevelTableMap)) {
+		if table := config.LevelTableMap[level]; !identifierPattern.MatchString(table) {
+			problem("invalid table name %q for level %s", table, level)
+		}
+	}
+
+	if strings.Contains(config.TableTTL, ";") {
+		problem("invalid table TTL %q", config.TableTTL)
+	}
+	if config.MessageCodec != "" && !codecPattern.MatchString(config.MessageCodec) {
+		problem("invalid message codec %q", config.MessageCodec)
+	}
+	for _, logical := range slices.Sorted(maps.Keys(config.ColumnMap)) {
+		if !logicalColumns[logical] {
+			problem("unknown column %q in column map", logical)
+		}
+		if name := config.ColumnMap[logical]; !namePattern.MatchString(name) {
+			problem("invalid column name %q for %s", name, logical)
+		}
+	}
+	for _, name := range config.ArrayColumns {
+		if !namePattern.MatchString(name) {
+			problem("invalid array column name %q", name)
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(config.NumericFields)) {
+		if !namePattern.MatchString(field) {
+			problem("invalid numeric column name %q", field)
+		}
+		typ := config.NumericFields[field]
+		if _, ok := numericZero[typ]; !ok {
+			problem("unsupported numeric type %q for %s", typ, field)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(config.ColumnTypes)) {
+		if !namePattern.MatchString(name) {
+			problem("invalid column name %q in column types", name)
+		}
+		if typ := config.ColumnTypes[name]; !validColumnType(typ) {
+			problem("invalid type %q for column %s", typ, name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(config.QuerySettings)) {
+		if !namePattern.MatchString(name) {
+			problem("invalid setting name %q", name)
+		}
+	}
+	if config.LevelEnum && len(config.LevelNames) > 0 {
+		seen := make(map[string]bool, len(logrus.AllLevels))
+		for _, level := range logrus.AllLevels {
+			name, ok := config.LevelNames[level]
+			if !ok {
+				name = level.String()
+			}
+			if seen[name] {
+				problem("level name %q used twice", name)
+			}
+			seen[name] = true
+		}
+	}
+	if config.TimePrecision < 0 || config.TimePrecision > 9 {
+		problem("time precision %d out of range 0-9", config.TimePrecision)
+	}
+
+	if config.RowMarshaler != nil {
+		if len(config.MarshalColumns) == 0 {
+			problem("RowMarshaler requires MarshalColumns")
+		}
+		for _, name := range config.MarshalColumns {
+			if !namePattern.MatchString(name) {
+				problem("invalid column name %q", name)
+			}
+		}
+		if config.CreateTableIfNotExists || config.VerifySchema {
+			problem("RowMarshaler can't be combined with table creation or schema verification")
+		}
+	}
+	if config.CustomInsert != "" {
+		if config.CustomInsertArgs == nil {
+			problem("CustomInsert requires CustomInsertArgs")
+		}
+		if config.CreateTableIfNotExists || config.VerifySchema || config.RowMarshaler != nil ||
+			config.ShardKeyField != "" || len(config.LevelTableMap) > 0 || config.DatabaseField != "" ||
+			config.DeadLetterTable != "" || config.DeduplicationToken || config.FlushStrategy == FlushStrategyMultiValues ||
+			config.IncludeFields || config.RowBinary || config.VersionColumn != "" {
+			problem("CustomInsert can't be combined with options that depend on the built-in columns")
+		}
+	}
+	if config.VersionColumn != "" {
+		if !namePattern.MatchString(config.VersionColumn) {
+			problem("invalid version column name %q", config.VersionColumn)
+		}
+		if config.CreateTableIfNotExists && config.TableEngine == "" && config.TableOrderBy == "" {
+			problem("VersionColumn requires TableOrderBy, the key duplicates share")
+		}
+	} else if config.VersionFunc != nil {
+		problem("VersionFunc requires VersionColumn")
+	}
+	written := make(map[string]int)
+	for _, col := range config.writtenColumns() {
+		if written[col.name]++; written[col.name] == 2 {
+			problem("column %q written twice", col.name)
+		}
+	}
+	if config.ShardKeyField != "" && config.ShardTableFunc == nil {
+		problem("ShardKeyField requires ShardTableFunc")
+	}
+	if config.MinGroupSize > 0 && config.FlushInterval <= 0 {
+		problem("MinGroupSize requires FlushInterval")
+	}
+	if config.FlushStrategy == FlushStrategyBatch && !supportsNativeBatch {
+		problem("FlushStrategyBatch requires the clickhouse_v2 build")
+	}
+
+	for _, level := range slices.Sorted(maps.Keys(config.SampleRate)) {
+		if rate := config.SampleRate[level]; rate < 0 || rate > 1 {
+			problem("sample rate %v for %s out of range 0-1", rate, level)
+		}
+	}
+	if config.BackpressureThreshold < 0 || config.BackpressureThreshold > 1 {
+		problem("backpressure threshold %v out of range 0-1", config.BackpressureThreshold)
+	}
+	for _, c := range []struct {
+		name  string
+		value int
+	}{
+		{"max retries", config.MaxRetries},
+		{"max buffer size", config.MaxBufferSize},
+		{"max batch bytes", config.MaxBatchBytes},
+		{"max message bytes", config.MaxMessageBytes},
+		{"max fields per entry", config.MaxFieldsPerEntry},
+		{"max in-flight batches", config.MaxInFlightBatches},
+		{"async queue size", config.AsyncQueueSize},
+		{"compress threshold", config.CompressThreshold},
+		{"min group size", config.MinGroupSize},
+		{"group concurrency", config.GroupConcurrency},
+	} {
+		if c.value < 0 {
+			problem("negative %s %d", c.name, c.value)
+		}
+	}
+	for _, c := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"flush interval", config.FlushInterval},
+		{"flush timeout", config.FlushTimeout},
+		{"statement timeout", config.StatementTimeout},
+		{"retry delay", config.RetryDelay},
+		{"max entry age", config.MaxEntryAge},
+		{"idle flush delay", config.IdleFlushDelay},
+		{"deadline flush threshold", config.DeadlineFlushThreshold},
+		{"partition bucket", config.PartitionBucket},
+		{"max group delay", config.MaxGroupDelay},
+		{"breaker cooldown", config.BreakerCooldown},
+		{"connection max lifetime", config.ConnMaxLifetime},
+		{"reconnect interval", config.ReconnectInterval},
+		{"dynamic config interval", config.DynamicConfigInterval},
+	} {
+		if c.value < 0 {
+			problem("negative %s %s", c.name, c.value)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ConfigError{Problems: problems}
+}
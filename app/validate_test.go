@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(config *Config)
+		want   string
+	}{
+		{"batch size", func(c *Config) { c.BatchSize = 0 }, "batch size 0 isn't positive"},
+		{"table name", func(c *Config) { c.TableName = "app logs" }, `invalid table name "app logs"`},
+		{"cluster name", func(c *Config) { c.ClusterName = "main.eu" }, `invalid cluster name "main.eu"`},
+		{"distributed without cluster", func(c *Config) { c.DistributedTable = "logs_all" }, "DistributedTable requires ClusterName"},
+		{"distributed table name", func(c *Config) { c.ClusterName, c.DistributedTable = "main", "logs all" },
+			`invalid distributed table name "logs all"`},
+		{"dead letter table", func(c *Config) { c.DeadLetterTable = "dead-letters" }, `invalid dead letter table name "dead-letters"`},
+		{"dynamic config table", func(c *Config) { c.DynamicConfigTable = "1config" }, `invalid dynamic config table name "1config"`},
+		{"level table", func(c *Config) { c.LevelTableMap = map[logrus.Level]string{logrus.ErrorLevel: "error logs"} },
+			`invalid table name "error logs" for level error`},
+		{"table TTL", func(c *Config) { c.TableTTL = "event_time + INTERVAL 1 DAY; DROP TABLE logs" },
+			`invalid table TTL "event_time + INTERVAL 1 DAY; DROP TABLE logs"`},
+		{"message codec", func(c *Config) { c.MessageCodec = "ZSTD(3" }, `invalid message codec "ZSTD(3"`},
+		{"unknown logical column", func(c *Config) { c.ColumnMap = map[string]string{"host": "hostname"} },
+			`unknown column "host" in column map`},
+		{"mapped column name", func(c *Config) { c.ColumnMap = map[string]string{"message": "msg text"} },
+			`invalid column name "msg text" for message`},
+		{"array column", func(c *Config) { c.ArrayColumns = []string{"tags[]"} }, `invalid array column name "tags[]"`},
+		{"numeric column", func(c *Config) { c.NumericFields = map[string]string{"latency ms": "UInt32"} },
+			`invalid numeric column name "latency ms"`},
+		{"numeric type", func(c *Config) { c.NumericFields = map[string]string{"latency": "Decimal(9, 2)"} },
+			`unsupported numeric type "Decimal(9, 2)" for latency`},
+		{"typed column name", func(c *Config) { c.ColumnTypes = map[string]string{"user id": "String"} },
+			`invalid column name "user id" in column types`},
+		{"column type", func(c *Config) { c.ColumnTypes = map[string]string{"user": "String; DROP"} },
+			`invalid type "String; DROP" for column user`},
+		{"setting name", func(c *Config) { c.QuerySettings = map[string]string{"async-insert": "1"} },
+			`invalid setting name "async-insert"`},
+		{"level names", func(c *Config) {
+			c.LevelEnum, c.LevelNames = true, map[logrus.Level]string{logrus.InfoLevel: "warning"}
+		}, `level name "warning" used twice`},
+		{"time precision", func(c *Config) { c.TimePrecision = 10 }, "time precision 10 out of range 0-9"},
+		{"marshaler columns", func(c *Config) { c.RowMarshaler = nopMarshaler{} }, "RowMarshaler requires MarshalColumns"},
+		{"marshaler column name", func(c *Config) { c.RowMarshaler, c.MarshalColumns = nopMarshaler{}, []string{"user id"} },
+			`invalid column name "user id"`},
+		{"marshaler with schema", func(c *Config) {
+			c.RowMarshaler, c.MarshalColumns, c.VerifySchema = nopMarshaler{}, []string{"user"}, true
+		}, "RowMarshaler can't be combined with table creation or schema verification"},
+		{"custom insert args", func(c *Config) { c.CustomInsert = "INSERT INTO logs (message) VALUES (?)" },
+			"CustomInsert requires CustomInsertArgs"},
+		{"custom insert with columns", func(c *Config) {
+			c.CustomInsert = "INSERT INTO logs (message) VALUES (?)"
+			c.CustomInsertArgs = func(entry *logrus.Entry) []interface{} { return []interface{}{entry.Message} }
+			c.IncludeFields = true
+		}, "CustomInsert can't be combined with options that depend on the built-in columns"},
+		{"version column name", func(c *Config) { c.VersionColumn = "row version" }, `invalid version column name "row version"`},
+		{"version without order", func(c *Config) { c.VersionColumn, c.CreateTableIfNotExists = "version", true },
+			"VersionColumn requires TableOrderBy, the key duplicates share"},
+		{"version func", func(c *Config) { c.VersionFunc = func(*logrus.Entry) uint64 { return 1 } },
+			"VersionFunc requires VersionColumn"},
+		{"duplicate column", func(c *Config) { c.ArrayColumns = []string{"level"} }, `column "level" written twice`},
+		{"shard key", func(c *Config) { c.ShardKeyField = "tenant" }, "ShardKeyField requires ShardTableFunc"},
+		{"min group size", func(c *Config) { c.MinGroupSize = 10 }, "MinGroupSize requires FlushInterval"},
+		{"sample rate", func(c *Config) { c.SampleRate = map[logrus.Level]float64{logrus.DebugLevel: 1.5} },
+			"sample rate 1.5 for debug out of range 0-1"},
+		{"backpressure threshold", func(c *Config) { c.BackpressureThreshold = -0.5 }, "backpressure threshold -0.5 out of range 0-1"},
+
+		{"max retries", func(c *Config) { c.MaxRetries = -1 }, "negative max retries -1"},
+		{"max buffer size", func(c *Config) { c.MaxBufferSize = -1 }, "negative max buffer size -1"},
+		{"max batch bytes", func(c *Config) { c.MaxBatchBytes = -1 }, "negative max batch bytes -1"},
+		{"max message bytes", func(c *Config) { c.MaxMessageBytes = -1 }, "negative max message bytes -1"},
+		{"max fields per entry", func(c *Config) { c.MaxFieldsPerEntry = -1 }, "negative max fields per entry -1"},
+		{"max in-flight batches", func(c *Config) { c.MaxInFlightBatches = -1 }, "negative max in-flight batches -1"},
+		{"async queue size", func(c *Config) { c.AsyncQueueSize = -1 }, "negative async queue size -1"},
+		{"compress threshold", func(c *Config) { c.CompressThreshold = -1 }, "negative compress threshold -1"},
+		{"negative min group size", func(c *Config) { c.MinGroupSize = -1 }, "negative min group size -1"},
+		{"group concurrency", func(c *Config) { c.GroupConcurrency = -1 }, "negative group concurrency -1"},
+
+		{"flush interval", func(c *Config) { c.FlushInterval = -time.Second }, "negative flush interval -1s"},
+		{"flush timeout", func(c *Config) { c.FlushTimeout = -time.Second }, "negative flush timeout -1s"},
+		{"statement timeout", func(c *Config) { c.StatementTimeout = -time.Second }, "negative statement timeout -1s"},
+		{"retry delay", func(c *Config) { c.RetryDelay = -time.Second }, "negative retry delay -1s"},
+		{"max entry age", func(c *Config) { c.MaxEntryAge = -time.Second }, "negative max entry age -1s"},
+		{"idle flush delay", func(c *Config) { c.IdleFlushDelay = -time.Second }, "negative idle flush delay -1s"},
+		{"deadline flush threshold", func(c *Config) { c.DeadlineFlushThreshold = -time.Second },
+			"negative deadline flush threshold -1s"},
+		{"partition bucket", func(c *Config) { c.PartitionBucket = -time.Second }, "negative partition bucket -1s"},
+		{"max group delay", func(c *Config) { c.MaxGroupDelay = -time.Second }, "negative max group delay -1s"},
+		{"breaker cooldown", func(c *Config) { c.BreakerCooldown = -time.Second }, "negative breaker cooldown -1s"},
+		{"connection max lifetime", func(c *Config) { c.ConnMaxLifetime = -time.Second }, "negative connection max lifetime -1s"},
+		{"reconnect interval", func(c *Config) { c.ReconnectInterval = -time.Second }, "negative reconnect interval -1s"},
+		{"dynamic config interval", func(c *Config) { c.DynamicConfigInterval = -time.Second },
+			"negative dynamic config interval -1s"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{BatchSize: 10}
+			tc.change(&config)
+			var configErr *ConfigError
+			if err := config.Validate(); !errors.As(err, &configErr) {
+				t.Fatalf("Validate() = %v, want a *ConfigError", err)
+			}
+			if len(configErr.Problems) != 1 || configErr.Problems[0].Error() != tc.want {
+				t.Fatalf("Validate() found %q, want only %q", configErr.Problems, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateBatchStrategy(t *testing.T) {
+	err := Config{BatchSize: 10, FlushStrategy: FlushStrategyBatch}.Validate()
+	if supportsNativeBatch {
+		if err != nil {
+			t.Fatalf("Validate() = %v, want nil with a native batch driver", err)
+		}
+		return
+	}
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || configErr.Problems[0].Error() != "FlushStrategyBatch requires the clickhouse_v2 build" {
+		t.Fatalf("Validate() = %v, want FlushStrategyBatch rejected", err)
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	if err := (Config{BatchSize: 10}).Validate(); err != nil {
+		t.Fatalf("Validate() of the defaults = %v, want nil", err)
+	}
+
+	err := Config{TableName: "app logs", MaxRetries: -1, FlushInterval: -time.Second}.Validate()
+	want := `clickhouse hook: invalid configuration: batch size 0 isn't positive; invalid table name "app logs"; ` +
+		"negative max retries -1; negative flush interval -1s"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Validate() = %v, want %s", err, want)
+	}
+}
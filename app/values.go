@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// literalReplacer escapes a string for a single-quoted ClickHouse literal.
+var literalReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`)
+
+// appendLiteral appends value to b as a ClickHouse literal: strings quoted,
+// times as fromUnixTimestamp64Nano, which converts to any DateTime column,
+// numbers and booleans as they print, slices as arrays and string-keyed
+// maps, in key order, as maps.
+func appendLiteral(b []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(b, "NULL"...), nil
+	case string:
+		return appendQuoted(b, v), nil
+	case []byte:
+		return appendQuoted(b, string(v)), nil
+	case time.Time:
+		seconds := min(max(v.Unix(), 0), math.MaxInt64/int64(time.Second)-1)
+		b = append(b, "fromUnixTimestamp64Nano("...)
+		b = strconv.AppendInt(b, seconds*int64(time.Second)+int64(v.Nanosecond()), 10)
+		return append(b, ')'), nil
+	case bool:
+		return strconv.AppendBool(b, v), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(b, rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.AppendUint(b, rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		switch {
+		case math.IsNaN(f):
+			return append(b, "nan"...), nil
+		case math.IsInf(f, 1):
+			return append(b, "inf"...), nil
+		case math.IsInf(f, -1):
+			return append(b, "-inf"...), nil
+		}
+		return strconv.AppendFloat(b, f, 'g', -1, rv.Type().Bits()), nil
+	case reflect.Slice, reflect.Array:
+		b = append(b, '[')
+		for i := 0; i < rv.Len(); i++ {
+			if i > 0 {
+				b = append(b, ", "...)
+			}
+			var err error
+			if b, err = appendLiteral(b, rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := rv.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		b = append(b, '{')
+		for i, key := range keys {
+			if i > 0 {
+				b = append(b, ", "...)
+			}
+			b = append(appendQuoted(b, key.String()), ": "...)
+			var err error
+			if b, err = appendLiteral(b, rv.MapIndex(key).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, '}'), nil
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return append(b, "NULL"...), nil
+		}
+		return appendLiteral(b, rv.Elem().Interface())
+	}
+	return nil, fmt.Errorf("clickhouse hook: can't encode %T as a literal", value)
+}
+
+// appendQuoted appends s as a single-quoted literal.
+func appendQuoted(b []byte, s string) []byte {
+	b = append(b, '\'')
+	b = append(b, literalReplacer.Replace(s)...)
+	return append(b, '\'')
+}
+
+// literalValuesQuery returns query, an INSERT ending in a VALUES clause of
+// placeholders, with a tuple of literals for every entry in its place.
+func literalValuesQuery(query string, columns []column, entries []logrus.Entry) (string, error) {
+	const values = " VALUES "
+	b := []byte(query[:strings.LastIndex(query, values)+len(values)])
+	for i := range entries {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = append(b, '(')
+		for j, col := range columns {
+			if j > 0 {
+				b = append(b, ", "...)
+			}
+			var err error
+			if b, err = appendLiteral(b, col.value(&entries[i])); err != nil {
+				return "", fmt.Errorf("%w in column %q", err, col.name)
+			}
+		}
+		b = append(b, ')')
+	}
+	return string(b), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAppendLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "NULL"},
+		{"it's a \\ test", `'it\'s a \\ test'`},
+		{"nul\x00", `'nul\0'`},
+		{[]byte("raw"), "'raw'"},
+		{time.Unix(1700000000, 123456789), "fromUnixTimestamp64Nano(1700000000123456789)"},
+		{time.Time{}, "fromUnixTimestamp64Nano(0)"},
+		{true, "true"},
+		{int8(-3), "-3"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{1.5, "1.5"},
+		{float32(0.25), "0.25"},
+		{math.NaN(), "nan"},
+		{math.Inf(-1), "-inf"},
+		{[]string{"a", "b"}, "['a', 'b']"},
+		{[]string{}, "[]"},
+		{map[string]string{"b": "2", "a": "1"}, "{'a': '1', 'b': '2'}"},
+		{(*string)(nil), "NULL"},
+	} {
+		got, err := appendLiteral(nil, tc.value)
+		if err != nil {
+			t.Errorf("appendLiteral(%#v): %v", tc.value, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("appendLiteral(%#v) = %s, want %s", tc.value, got, tc.want)
+		}
+	}
+
+	if _, err := appendLiteral(nil, map[int]string{1: "a"}); err == nil {
+		t.Error("appendLiteral of a map with int keys succeeded")
+	}
+	if _, err := appendLiteral(nil, struct{}{}); err == nil {
+		t.Error("appendLiteral of a struct succeeded")
+	}
+}
+
+func TestLiteralValuesQuery(t *testing.T) {
+	columns := []column{
+		{name: "message", typ: "String", value: func(entry *logrus.Entry) interface{} { return entry.Message }},
+		{name: "level", typ: "String", value: func(entry *logrus.Entry) interface{} { return entry.Level.String() }},
+	}
+	entries := []logrus.Entry{{Message: "one", Level: logrus.InfoLevel}, {Message: "two", Level: logrus.WarnLevel}}
+	got, err := literalValuesQuery(insertQuery("logs", columns, ""), columns, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "INSERT INTO `logs` (`message`, `level`) VALUES ('one', 'info'), ('two', 'warning')"
+	if got != want {
+		t.Errorf("literalValuesQuery = %s, want %s", got, want)
+	}
+}
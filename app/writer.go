@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lineWriter turns each line written to it into an Info entry for the hook.
+type lineWriter struct {
+	hook *ClickHouseHook
+
+	// mu guards partial, the unterminated tail of the last write.
+	mu      sync.Mutex
+	partial []byte
+}
+
+// Writer returns an io.Writer that fires every line written to it through
+// the hook as an Info entry with the current time, so output of the
+// standard log package, for instance via log.SetOutput, lands in the same
+// table. A trailing line without a newline is held until it is completed.
+func (hook *ClickHouseHook) Writer() io.Writer {
+	return &lineWriter{hook: hook}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	var err error
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(w.partial[:i], []byte{'\r'}))
+		w.partial = w.partial[i+1:]
+		if line == "" {
+			continue
+		}
+		entry := logrus.Entry{Time: w.hook.config.Clock.Now(), Level: logrus.InfoLevel, Message: line, Data: logrus.Fields{}}
+		if fireErr := w.hook.Fire(&entry); fireErr != nil && err == nil {
+			err = fireErr
+		}
+	}
+	if len(w.partial) == 0 {
+		w.partial = nil
+	}
+	return len(p), err
+}